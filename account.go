@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"edev/db"
+	"edev/log"
+	"edev/session"
+	"edev/user"
+)
+
+// unlinkHandler removes one provider identity from the current account
+// (POST /account/unlink?provider=x) and answers with the remaining providers.
+// The last identity cannot be removed, otherwise the account would be locked out.
+func unlinkHandler(w http.ResponseWriter, r *http.Request) {
+	sid, ok := session.GetCookie(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	u, ok := session.Get(sid)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if db.Storage == nil || u.AccountID == 0 {
+		http.Error(w, "account storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	provider := r.URL.Query().Get("provider")
+	if provider == "" {
+		http.Error(w, "missing provider", http.StatusBadRequest)
+		return
+	}
+
+	providers, err := user.Unlink(db.Storage, u.AccountID, provider)
+	switch {
+	case errors.Is(err, user.ErrLastIdentity):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "provider not linked", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("unlink %s: %v", provider, err)
+		serverError(w, "failed to unlink provider", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Providers []string `json:"providers"`
+	}{providers})
+}
+
+// writePersistError answers a callback whose login could not be saved. A
+// link refused by MaxIdentities or by an already linked provider is the
+// user's to resolve, so it gets 409.
+func writePersistError(w http.ResponseWriter, err error) {
+	if errors.Is(err, user.ErrIdentityLimit) || errors.Is(err, user.ErrProviderLinked) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("persist user: %v", err)
+	serverError(w, "failed to save user", err)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"edev/config"
+	"edev/db"
+	"edev/user"
+)
+
+// helper: point db.Storage at a fresh in-memory database with the schema.
+func useTestDB(t *testing.T) *db.SQLite {
+	t.Helper()
+	s, err := db.NewWithPath(db.MemoryPath)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := applySchema(s); err != nil {
+		t.Fatalf("apply schema: %v", err)
+	}
+	prev := db.Storage
+	db.Storage = s
+	t.Cleanup(func() {
+		db.Storage = prev
+		s.Close()
+	})
+	return s
+}
+
+// TestUnlinkHandler verifies a linked provider is removed and the last one is
+// refused with 409.
+func TestUnlinkHandler(t *testing.T) {
+	s := useTestDB(t)
+	u, _, err := persistUser(httptest.NewRequest(http.MethodGet, "/", nil), "github", user.User{ID: "42", Login: "octo"})
+	if err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	if err := s.Exec(`INSERT INTO identities(user_id, provider, provider_uid) VALUES(?, 'x', '99')`, u.AccountID); err != nil {
+		t.Fatalf("link x: %v", err)
+	}
+
+	req, _ := authedRequest(t, http.MethodPost, "/account/unlink?provider=x", u)
+	rec := httptest.NewRecorder()
+	unlinkHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Providers []string `json:"providers"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Providers) != 1 || body.Providers[0] != "github" {
+		t.Fatalf("expected [github], got %v", body.Providers)
+	}
+
+	req, _ = authedRequest(t, http.MethodPost, "/account/unlink?provider=github", u)
+	rec = httptest.NewRecorder()
+	unlinkHandler(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for the last identity, got %d", rec.Code)
+	}
+}
+
+// TestPersistUserLinksSignedIn verifies a login with a new identity while
+// signed in links it to the current account, and that MaxIdentities turns
+// the next link into a 409.
+func TestPersistUserLinksSignedIn(t *testing.T) {
+	prev := config.Cfg.MaxIdentities
+	config.Cfg.MaxIdentities = 2
+	defer func() { config.Cfg.MaxIdentities = prev }()
+
+	useTestDB(t)
+	u, _, err := persistUser(httptest.NewRequest(http.MethodGet, "/", nil), "github", user.User{ID: "42", Login: "octo"})
+	if err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+
+	req, _ := authedRequest(t, http.MethodGet, "/", u)
+	linked, created, err := persistUser(req, "x", user.User{ID: "99", Login: "octo"})
+	if err != nil {
+		t.Fatalf("link x: %v", err)
+	}
+	if created || linked.AccountID != u.AccountID {
+		t.Fatalf("expected x linked to account %d, got %d (created=%v)", u.AccountID, linked.AccountID, created)
+	}
+
+	_, _, err = persistUser(req, "fake", user.User{ID: "7", Login: "octo"})
+	rec := httptest.NewRecorder()
+	writePersistError(rec, err)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 past MaxIdentities, got %d", rec.Code)
+	}
+}
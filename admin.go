@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"edev/config"
+	"edev/db"
+	"edev/log"
+	"edev/metrics"
+	"edev/settings"
+	"edev/utils"
+)
+
+const maxBannerLen = 500
+
+// requireAdmin lets through requests carrying "Authorization: Bearer
+// <AdminToken>".
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether r carries the admin bearer token. Always false
+// when no AdminToken is configured.
+func isAdmin(r *http.Request) bool {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && config.Cfg.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(tok), []byte(config.Cfg.AdminToken)) == 1
+}
+
+// bannerHandler sets the maintenance banner from a JSON body
+// {"message": "..."}; an empty message removes the banner.
+func bannerHandler(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&in); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	in.Message = strings.TrimSpace(in.Message)
+	verr := &ValidationError{}
+	switch {
+	case utf8.RuneCountInString(in.Message) > maxBannerLen:
+		verr.Add("message", "too long")
+	case utils.HasControl(in.Message):
+		verr.Add("message", "invalid characters")
+	}
+	if !verr.Empty() {
+		writeValidationError(w, r, verr)
+		return
+	}
+	if db.Storage == nil {
+		http.Error(w, "no database", http.StatusServiceUnavailable)
+		return
+	}
+	if err := settings.Set(db.Storage, settings.MaintenanceBanner, in.Message); err != nil {
+		log.Printf("set maintenance banner: %v", err)
+		serverError(w, "failed to save setting", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// integrityTimeout and vacuumTimeout bound the on-demand maintenance
+// operations; large databases may need most of them.
+const (
+	integrityTimeout = 5 * time.Minute
+	vacuumTimeout    = 10 * time.Minute
+)
+
+// extendWriteDeadline lets a handler run for d beyond the server-wide
+// WriteTimeout, which would otherwise cut the connection before a slow
+// maintenance operation can answer.
+func extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Warnf("extend write deadline: %v", err)
+	}
+}
+
+// vacuumHandler compacts the database. It blocks writers while it runs.
+func vacuumHandler(w http.ResponseWriter, r *http.Request) {
+	if db.Storage == nil {
+		http.Error(w, "no database", http.StatusServiceUnavailable)
+		return
+	}
+	extendWriteDeadline(w, vacuumTimeout+time.Minute)
+	ctx, cancel := context.WithTimeout(r.Context(), vacuumTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := db.Storage.Vacuum(ctx); err != nil {
+		log.Printf("vacuum: %v", err)
+		serverError(w, "vacuum failed", err)
+		return
+	}
+	log.Printf("vacuum done in %s", time.Since(start))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// integrityHandler runs PRAGMA integrity_check and reports {"ok", "problems"}.
+// A damaged database answers 500 so monitors notice.
+func integrityHandler(w http.ResponseWriter, r *http.Request) {
+	if db.Storage == nil {
+		http.Error(w, "no database", http.StatusServiceUnavailable)
+		return
+	}
+	extendWriteDeadline(w, integrityTimeout+time.Minute)
+	ctx, cancel := context.WithTimeout(r.Context(), integrityTimeout)
+	defer cancel()
+	ok, problems, err := db.Storage.IntegrityCheck(ctx)
+	if err != nil {
+		log.Printf("integrity check: %v", err)
+		serverError(w, "integrity check failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		log.Errorf("integrity check reported %d problems", len(problems))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		OK       bool     `json:"ok"`
+		Problems []string `json:"problems,omitempty"`
+	}{ok, problems})
+}
+
+// metricsHandler renders every registered metric in the Prometheus text
+// format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.Write(w); err != nil {
+		log.Printf("write metrics: %v", err)
+	}
+}
+
+// maintenanceBanner returns the current banner text, read on every request so
+// changes show up without a restart. Errors hide the banner.
+func maintenanceBanner() string {
+	if db.Storage == nil {
+		return ""
+	}
+	v, err := settings.Get(db.Storage, settings.MaintenanceBanner)
+	if err != nil {
+		log.Printf("read maintenance banner: %v", err)
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"edev/config"
+)
+
+// TestMaintenanceBanner verifies the admin endpoint makes the banner appear on
+// the index, uncached while it is up, and that clearing it removes it again.
+func TestMaintenanceBanner(t *testing.T) {
+	useTestDB(t)
+	prev := config.Cfg.AdminToken
+	config.Cfg.AdminToken = "admin-secret"
+	defer func() { config.Cfg.AdminToken = prev }()
+	prevAge := config.Cfg.AnonHomeMaxAge
+	config.Cfg.AnonHomeMaxAge = time.Minute
+	defer func() { config.Cfg.AnonHomeMaxAge = prevAge }()
+	mux := routes()
+
+	set := func(token, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/admin/maintenance-banner", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	index := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec
+	}
+
+	const msg = "Manutenção programada às 22h"
+	if code := set("wrong", `{"message":"x"}`); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong token, got %d", code)
+	}
+	if code := set("admin-secret", `{"message":"`+msg+`"}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	rec := index()
+	if body := rec.Body.String(); !strings.Contains(body, msg) || !strings.Contains(body, "maintenance-banner") {
+		t.Fatalf("expected banner in index")
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("expected no-store while the banner is up, got %q", cc)
+	}
+	if code := set("admin-secret", `{"message":""}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204 on clear, got %d", code)
+	}
+	rec = index()
+	if body := rec.Body.String(); strings.Contains(body, msg) || strings.Contains(body, "maintenance-banner") {
+		t.Fatalf("expected banner removed from index")
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Fatalf("expected the anonymous home cached again, got %q", cc)
+	}
+}
+
+// TestMaintenanceEndpoints verifies the admin vacuum and integrity endpoints
+// run against the database and require the admin token.
+func TestMaintenanceEndpoints(t *testing.T) {
+	useTestDB(t)
+	prev := config.Cfg.AdminToken
+	config.Cfg.AdminToken = "admin-secret"
+	defer func() { config.Cfg.AdminToken = prev }()
+	mux := routes()
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/admin/vacuum", "wrong"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/vacuum", "admin-secret"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 from vacuum, got %d", rec.Code)
+	}
+	rec := do(http.MethodGet, "/admin/integrity", "admin-secret")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"ok":true}` {
+		t.Fatalf("expected ok integrity report, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// TestExtendWriteDeadline verifies a handler that extends its write deadline
+// can answer after the server-wide WriteTimeout has passed.
+func TestExtendWriteDeadline(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extendWriteDeadline(w, time.Second)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	}))
+	srv.Config.WriteTimeout = 20 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected a response past WriteTimeout, got %v", err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "done" {
+		t.Fatalf("expected body %q, got %q", "done", b)
+	}
+}
+
+// TestMetricsHandler verifies /metrics renders the login, logout and
+// callback-limit counters.
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, name := range []string{"edev_logins_total", "edev_logouts_total", "edev_callbacks_limited_total"} {
+		if !strings.Contains(body, "# TYPE "+name+" counter") {
+			t.Fatalf("expected %s in /metrics, got:\n%s", name, body)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package assets
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+)
+
+// Overlay serves files from dir first and falls back to base, so operators can
+// swap individual assets (logo, CSS) without rebuilding. http.Dir confines
+// lookups to dir, preventing path traversal. An empty dir returns base as is.
+func Overlay(dir string, base http.FileSystem) http.FileSystem {
+	if dir == "" {
+		return base
+	}
+	return overlayFS{over: http.Dir(dir), base: base}
+}
+
+type overlayFS struct {
+	over http.FileSystem
+	base http.FileSystem
+}
+
+func (o overlayFS) Open(name string) (http.File, error) {
+	f, err := o.over.Open(name)
+	if err == nil {
+		st, serr := f.Stat()
+		if serr == nil && !st.IsDir() {
+			return f, nil
+		}
+		_ = f.Close()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return o.base.Open(name)
+}
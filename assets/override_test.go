@@ -0,0 +1,45 @@
+//go:build !dev
+
+package assets
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestOverlay verifies an override file on disk wins over the embedded one and
+// a missing override falls back to the embedded asset.
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "style.css"), []byte("/* custom */"), 0o600); err != nil {
+		t.Fatalf("write override: %v", err)
+	}
+	h := http.FileServer(Overlay(dir, FS))
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		b, _ := io.ReadAll(rec.Body)
+		return rec.Code, string(b)
+	}
+
+	code, body := get("/style.css")
+	if code != http.StatusOK || body != "/* custom */" {
+		t.Fatalf("expected override css, got %d %q", code, body)
+	}
+
+	code, body = get("/favicon.svg")
+	if code != http.StatusOK || !strings.Contains(body, "<svg") {
+		t.Fatalf("expected embedded favicon.svg, got %d", code)
+	}
+
+	if _, err := Overlay(dir, FS).Open("../../etc/passwd"); err == nil {
+		t.Fatalf("expected traversal outside the override dir to fail")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"edev/config"
+	"edev/log"
+	"edev/metrics"
+	"edev/session"
+	"edev/templates"
+	"edev/utils"
+)
+
+// returnToCookie carries the page to go back to across the provider round
+// trip. It is set by the login page and consumed by the callbacks.
+const returnToCookie = "return_to"
+
+// lastProviderCookie remembers which provider this browser last signed in
+// with, so the login page can highlight it. It holds only the provider name.
+const lastProviderCookie = "last_provider"
+
+var (
+	loginsTotal  = metrics.NewCounter("edev_logins_total", "Logins completed through a provider callback.")
+	logoutsTotal = metrics.NewCounter("edev_logouts_total", "Sessions ended by logout.")
+)
+
+// requireAuth lets requests with a live session through. Others get a redirect
+// to the login page when they come from a browser, or a 401 JSON body when
+// they come from an API client.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session.IsAuthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeUnauthorized(w, r)
+	})
+}
+
+// writeUnauthorized answers a request without a session: browsers asking for
+// HTML on a GET are sent to /login?return_to=<path> (unless
+// AuthRedirectBrowsers is off), everybody else gets 401 JSON.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	if config.Cfg.AuthRedirectBrowsers && r.Method == http.MethodGet && wantsHTML(r) {
+		http.Redirect(w, r, "/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+}
+
+// wantsHTML reports whether r prefers an HTML page, as browser navigations do.
+func wantsHTML(r *http.Request) bool {
+	return !wantsJSON(r) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// safeReturnTo returns s when it is a local absolute path and "" otherwise,
+// so return_to cannot become an open redirect.
+func safeReturnTo(s string) string {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+	return s
+}
+
+// setReturnTo remembers path for redirectAfterLogin. The cookie is Secure when
+// the site is served over HTTPS, by BaseURL or by the request itself.
+func setReturnTo(w http.ResponseWriter, r *http.Request, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     returnToCookie,
+		Value:    url.QueryEscape(path),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Cfg.BaseURL, "https://") || utils.RequestIsSecure(r, config.Cfg.TrustProxy),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(config.Cfg.StateTTL.Seconds()),
+	})
+}
+
+// redirectAfterLogin sends the user back to the page remembered by the login
+// page, or to the home page, and clears the cookie.
+func redirectAfterLogin(w http.ResponseWriter, r *http.Request) {
+	target := "/"
+	if c, err := r.Cookie(returnToCookie); err == nil {
+		if p, err := url.QueryUnescape(c.Value); err == nil && safeReturnTo(p) != "" {
+			target = p
+		}
+		http.SetCookie(w, &http.Cookie{Name: returnToCookie, Path: "/", MaxAge: -1})
+	}
+	http.Redirect(w, r, config.Cfg.BaseURL+target, http.StatusFound)
+}
+
+// setLastProvider records provider in lastProviderCookie after a successful
+// login. LastProviderMaxAge of 0 turns the cookie off.
+func setLastProvider(w http.ResponseWriter, r *http.Request, provider string) {
+	if config.Cfg.LastProviderMaxAge <= 0 {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     lastProviderCookie,
+		Value:    provider,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Cfg.BaseURL, "https://") || utils.RequestIsSecure(r, config.Cfg.TrustProxy),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(config.Cfg.LastProviderMaxAge.Seconds()),
+	})
+}
+
+// lastProvider returns the provider named by lastProviderCookie, or "" when
+// the cookie is missing, disabled or names no known provider.
+func lastProvider(r *http.Request) string {
+	if config.Cfg.LastProviderMaxAge <= 0 {
+		return ""
+	}
+	c, err := r.Cookie(lastProviderCookie)
+	if err != nil {
+		return ""
+	}
+	if _, ok := loginButtons[c.Value]; !ok {
+		return ""
+	}
+	return c.Value
+}
+
+// emailAllowed reports whether email may sign in under AllowedEmailDomains.
+// An empty list allows everyone; otherwise the domain must match an entry
+// exactly (case-insensitive), and users without an email are refused.
+func emailAllowed(email string) bool {
+	if len(config.Cfg.AllowedEmailDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+	for _, d := range config.Cfg.AllowedEmailDomains {
+		if strings.EqualFold(strings.TrimSpace(d), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotPermitted renders the 403 page for a login refused by
+// AllowedEmailDomains. No session is created.
+func writeNotPermitted(w http.ResponseWriter, provider, email string) {
+	_, domain, _ := strings.Cut(email, "@")
+	log.Printf("login refused provider=%s domain=%q: not in AllowedEmailDomains", provider, domain)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	if err := templates.ExecuteTemplate(w, "forbidden.ghtml", nil); err != nil {
+		log.Printf("template %s execute error: %v", "forbidden.ghtml", err)
+	}
+}
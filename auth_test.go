@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"edev/config"
+	"edev/session"
+)
+
+// TestRequireAuthBrowserRedirect verifies a browser without a session is sent
+// to the login page with the original path as return_to.
+func TestRequireAuthBrowserRedirect(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/me?x=1", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected 302, got %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/login?return_to=%2Fme%3Fx%3D1" {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+}
+
+// TestRequireAuthAPI401 verifies API clients get a 401 JSON body instead of a
+// redirect.
+func TestRequireAuthAPI401(t *testing.T) {
+	for _, accept := range []string{"application/json", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		routes().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("accept %q: expected 401, got %d", accept, rec.Code)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body["error"] != "unauthorized" {
+			t.Fatalf("accept %q: expected JSON error, got %v (%v)", accept, body, err)
+		}
+	}
+
+	prev := config.Cfg.AuthRedirectBrowsers
+	config.Cfg.AuthRedirectBrowsers = false
+	defer func() { config.Cfg.AuthRedirectBrowsers = prev }()
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with redirects disabled, got %d", rec.Code)
+	}
+}
+
+// TestReturnToAfterLogin verifies the login page remembers a local return_to
+// and the callback redirect uses it, while external targets are ignored.
+func TestReturnToAfterLogin(t *testing.T) {
+	for _, tc := range []struct {
+		returnTo string
+		want     string
+	}{
+		{"/me", config.Cfg.BaseURL + "/me"},
+		{"//evil.test/x", config.Cfg.BaseURL + "/"},
+		{"https://evil.test/", config.Cfg.BaseURL + "/"},
+	} {
+		rec := httptest.NewRecorder()
+		loginPageHandler(rec, httptest.NewRequest(http.MethodGet, "/login?return_to="+tc.returnTo, nil))
+
+		req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rec = httptest.NewRecorder()
+		redirectAfterLogin(rec, req)
+		if loc := rec.Header().Get("Location"); loc != tc.want {
+			t.Fatalf("return_to %q: expected %q, got %q", tc.returnTo, tc.want, loc)
+		}
+	}
+}
+
+// helper: serve the fake provider's token and userinfo endpoints for a user
+// with the given email, pointing FakeOAuthBaseURL at it.
+func fakeProviderWithEmail(t *testing.T, token, email string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/oauth/token":
+			_ = json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+		case "/oauth/userinfo":
+			_ = json.NewEncoder(w).Encode(map[string]string{"id": "u-" + token, "username": "ana", "email": email})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	prev := config.Cfg.FakeOAuthBaseURL
+	config.Cfg.FakeOAuthBaseURL = srv.URL
+	t.Cleanup(func() { config.Cfg.FakeOAuthBaseURL = prev })
+}
+
+// TestAllowedEmailDomains verifies a callback for an allowed domain signs the
+// user in, while any other domain gets the 403 page and no session.
+func TestAllowedEmailDomains(t *testing.T) {
+	useTestDB(t)
+	prev := config.Cfg.AllowedEmailDomains
+	config.Cfg.AllowedEmailDomains = []string{"company.com"}
+	t.Cleanup(func() { config.Cfg.AllowedEmailDomains = prev })
+
+	cases := []struct {
+		token, email string
+		allowed      bool
+	}{
+		{"tok-allowed", "ana@Company.com", true},
+		{"tok-denied", "ana@elsewhere.org", false},
+	}
+	for _, tc := range cases {
+		fakeProviderWithEmail(t, tc.token, tc.email)
+		putState("st-"+tc.token, "verifier", time.Minute)
+		rec := httptest.NewRecorder()
+		fakeProvider.CallbackHandler(rec, callbackRequest("/fake/oauth/callback?state=st-"+tc.token+"&code=c", "st-"+tc.token))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		sessionCookie := session.IsAuthenticated(req)
+		if tc.allowed {
+			if rec.Code != http.StatusFound || !sessionCookie {
+				t.Fatalf("%s: expected redirect with session, got %d cookie=%v", tc.email, rec.Code, sessionCookie)
+			}
+			continue
+		}
+		if rec.Code != http.StatusForbidden || sessionCookie {
+			t.Fatalf("%s: expected 403 without session, got %d cookie=%v", tc.email, rec.Code, sessionCookie)
+		}
+		if !strings.Contains(rec.Body.String(), "Acesso não permitido") {
+			t.Fatalf("%s: expected the not permitted page, got %q", tc.email, rec.Body.String())
+		}
+	}
+
+	config.Cfg.AllowedEmailDomains = nil
+	if !emailAllowed("") || !emailAllowed("x@anything.test") {
+		t.Fatalf("expected an empty list to allow everyone")
+	}
+}
+
+// TestLastProviderCookie verifies a successful callback records only the
+// provider name, and the login page highlights that provider.
+func TestLastProviderCookie(t *testing.T) {
+	useTestDB(t)
+	prevEnabled := config.Cfg.FakeOAuthEnabled
+	config.Cfg.FakeOAuthEnabled = true
+	t.Cleanup(func() { config.Cfg.FakeOAuthEnabled = prevEnabled })
+
+	fakeProviderWithEmail(t, "tok-last", "ana@example.com")
+	putState("st-last", "verifier", time.Minute)
+	rec := httptest.NewRecorder()
+	fakeProvider.CallbackHandler(rec, callbackRequest("/fake/oauth/callback?state=st-last&code=c", "st-last"))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", rec.Code)
+	}
+
+	var last *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == lastProviderCookie {
+			last = c
+		}
+	}
+	if last == nil || last.Value != "fake" {
+		t.Fatalf("expected %s=fake, got %+v", lastProviderCookie, last)
+	}
+	if !last.HttpOnly || last.MaxAge <= 0 {
+		t.Fatalf("expected a long-lived HttpOnly cookie, got %+v", last)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.AddCookie(&http.Cookie{Name: lastProviderCookie, Value: last.Value})
+	page := httptest.NewRecorder()
+	loginPageHandler(page, req)
+	if !strings.Contains(page.Body.String(), "btn-dev btn-last") {
+		t.Fatalf("expected the fake button highlighted, got %q", page.Body.String())
+	}
+
+	// An unknown value is ignored rather than echoed.
+	req = httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.AddCookie(&http.Cookie{Name: lastProviderCookie, Value: "evil"})
+	if lastProvider(req) != "" {
+		t.Fatalf("expected unknown provider ignored")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"edev/config"
+	"edev/log"
+	"edev/session"
+)
+
+// gravatarHost serves the avatars built by gravatarURL.
+const gravatarHost = "www.gravatar.com"
+
+// maxAvatarRedirects bounds the redirects avatarClient follows.
+const maxAvatarRedirects = 3
+
+// avatarClient fetches avatars, following redirects only to allowed hosts so
+// an allowed host cannot bounce the proxy to an internal address.
+var avatarClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxAvatarRedirects {
+			return errors.New("too many avatar redirects")
+		}
+		if !avatarAllowed(req.URL) {
+			return fmt.Errorf("avatar redirect to %q not allowed", req.URL.Host)
+		}
+		return nil
+	},
+}
+
+// avatarAllowed reports whether u is an https URL on one of AvatarHosts, or
+// on Gravatar when GravatarFallback is on. AvatarURL comes from the provider
+// profile, so without this the proxy would fetch any URL a user can set
+// there, including internal ones.
+func avatarAllowed(u *url.URL) bool {
+	if u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	host := u.Hostname()
+	if config.Cfg.GravatarFallback && host == gravatarHost {
+		return true
+	}
+	return slices.Contains(config.Cfg.AvatarHosts, host)
+}
+
+// avatarHandler proxies the session user's provider avatar so pages don't
+// hit third-party hosts directly. Only https URLs on allowed hosts are
+// fetched, and responses larger than AvatarMaxBytes or with a content type
+// outside AvatarContentTypes are rejected, so the proxy can't be abused to
+// fetch arbitrary content.
+func avatarHandler(w http.ResponseWriter, r *http.Request) {
+	sid, ok := session.GetCookie(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	u, ok := session.Get(sid)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	src, err := url.Parse(u.AvatarURL)
+	if u.AvatarURL == "" || err != nil || !avatarAllowed(src) {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := providerContext(r.Context(), config.Cfg.AvatarTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	resp, err := avatarClient.Do(req)
+	if err != nil {
+		log.Printf("avatar fetch: %v", err)
+		http.Error(w, "avatar fetch failed", http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Error closing response body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "avatar fetch failed", http.StatusBadGateway)
+		return
+	}
+
+	ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !slices.Contains(config.Cfg.AvatarContentTypes, ct) {
+		http.Error(w, "unsupported avatar type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	max := config.Cfg.AvatarMaxBytes
+	if resp.ContentLength > max {
+		http.Error(w, "avatar too large", http.StatusBadGateway)
+		return
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		http.Error(w, "avatar fetch failed", http.StatusBadGateway)
+		return
+	}
+	if int64(len(b)) > max {
+		http.Error(w, "avatar too large", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"edev/config"
+	"edev/user"
+)
+
+// helper: serve avatars over TLS from an allowed host for the test.
+func useAvatarServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(h)
+	prevTransport, prevHosts := avatarClient.Transport, config.Cfg.AvatarHosts
+	avatarClient.Transport = srv.Client().Transport
+	config.Cfg.AvatarHosts = []string{"127.0.0.1"}
+	t.Cleanup(func() {
+		srv.Close()
+		avatarClient.Transport, config.Cfg.AvatarHosts = prevTransport, prevHosts
+	})
+	return srv
+}
+
+// TestAvatarHandlerLimits verifies oversized and non-image upstream responses
+// are rejected while a small image is proxied.
+func TestAvatarHandlerLimits(t *testing.T) {
+	srv := useAvatarServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("png-bytes"))
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(strings.Repeat("x", 64)))
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<html></html>"))
+		}
+	})
+
+	prev := config.Cfg.AvatarMaxBytes
+	config.Cfg.AvatarMaxBytes = 32
+	defer func() { config.Cfg.AvatarMaxBytes = prev }()
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/small.png", http.StatusOK},
+		{"/big.png", http.StatusBadGateway},
+		{"/page.html", http.StatusUnsupportedMediaType},
+	} {
+		req, _ := authedRequest(t, http.MethodGet, "/avatar", user.User{ID: "1", Login: "a", AvatarURL: srv.URL + tc.path})
+		rec := httptest.NewRecorder()
+		avatarHandler(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("%s: expected %d, got %d (%s)", tc.path, tc.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// TestAvatarHandlerHosts verifies only https URLs on allowed hosts are
+// fetched, redirects included, and that Gravatar needs GravatarFallback.
+func TestAvatarHandlerHosts(t *testing.T) {
+	srv := useAvatarServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "https://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png-bytes"))
+	})
+	plain := strings.Replace(srv.URL, "https://", "http://", 1)
+	local := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{srv.URL + "/a.png", http.StatusOK},
+		{plain + "/a.png", http.StatusNotFound},
+		{local + "/a.png", http.StatusNotFound},
+		{srv.URL + "/redirect", http.StatusBadGateway},
+	} {
+		req, _ := authedRequest(t, http.MethodGet, "/avatar", user.User{ID: "1", Login: "a", AvatarURL: tc.url})
+		rec := httptest.NewRecorder()
+		avatarHandler(rec, req)
+		if rec.Code != tc.code {
+			t.Fatalf("%s: expected %d, got %d (%s)", tc.url, tc.code, rec.Code, rec.Body.String())
+		}
+	}
+
+	prev := config.Cfg.GravatarFallback
+	defer func() { config.Cfg.GravatarFallback = prev }()
+	g, _ := url.Parse(gravatarURL("a@example.com"))
+	for _, on := range []bool{false, true} {
+		config.Cfg.GravatarFallback = on
+		if got := avatarAllowed(g); got != on {
+			t.Fatalf("GravatarFallback=%v: expected Gravatar allowed %v, got %v", on, on, got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"strings"
+
+	"edev/config"
+)
+
+// cachePolicy is the Cache-Control (and optional Vary) applied to a route.
+type cachePolicy struct {
+	CacheControl string
+	Vary         string
+}
+
+// cachePolicies maps request paths to their caching policy. Keys ending in
+// "/" match as prefixes, the others exactly; the longest match wins.
+// The index page is not listed: its policy depends on the session and is set
+// by indexHandler itself, as is the avatar's on success.
+var cachePolicies = map[string]cachePolicy{
+	"/assets/":        {CacheControl: "public, max-age=86400"},
+	"/login":          {CacheControl: "no-store"},
+	"/login/":         {CacheControl: "no-store"},
+	"/logout":         {CacheControl: "no-store"},
+	"/me":             {CacheControl: "no-store"},
+	"/whoami":         {CacheControl: "no-store"},
+	"/csrf":           {CacheControl: "no-store"},
+	"/profile":        {CacheControl: "no-store"},
+	"/account/unlink": {CacheControl: "no-store"},
+	"/admin/":         {CacheControl: "no-store"},
+	"/metrics":        {CacheControl: "no-store"},
+	"/debug/":         {CacheControl: "no-store"},
+	"/status":         {CacheControl: "no-store"},
+	"/version":        {CacheControl: "no-store"},
+	"/avatar":         {CacheControl: "no-store", Vary: "Cookie"},
+
+	// The callbacks set the session and state cookies.
+	githubCallbackPath: {CacheControl: "no-store"},
+	xCallbackPath:      {CacheControl: "no-store"},
+}
+
+// routeCachePolicies returns cachePolicies plus the entries that depend on the
+// configuration, such as the fake provider's callback.
+func routeCachePolicies() map[string]cachePolicy {
+	policies := maps.Clone(cachePolicies)
+	if config.Cfg.FakeOAuthEnabled {
+		policies[config.Cfg.FakeOAuthRedirect] = cachePolicy{CacheControl: "no-store"}
+	}
+	return policies
+}
+
+// lookupCachePolicy returns the policy for path, if any.
+func lookupCachePolicy(policies map[string]cachePolicy, path string) (cachePolicy, bool) {
+	if p, ok := policies[path]; ok {
+		return p, true
+	}
+	best, found := "", false
+	for prefix := range policies {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) && len(prefix) > len(best) {
+			best, found = prefix, true
+		}
+	}
+	return policies[best], found
+}
+
+// cacheControl sets the configured caching headers before calling next.
+// Handlers may still override them for responses that depend on the request.
+func cacheControl(policies map[string]cachePolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := lookupCachePolicy(policies, r.URL.Path); ok {
+			w.Header().Set("Cache-Control", p.CacheControl)
+			if p.Vary != "" {
+				w.Header().Set("Vary", p.Vary)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"edev/config"
+)
+
+// TestCacheControl verifies each configured path gets its policy, prefixes
+// and provider callbacks included, and unlisted paths are left alone.
+func TestCacheControl(t *testing.T) {
+	prevEnabled, prevRedirect := config.Cfg.FakeOAuthEnabled, config.Cfg.FakeOAuthRedirect
+	config.Cfg.FakeOAuthEnabled, config.Cfg.FakeOAuthRedirect = true, "/fake/cb"
+	defer func() { config.Cfg.FakeOAuthEnabled, config.Cfg.FakeOAuthRedirect = prevEnabled, prevRedirect }()
+
+	h := cacheControl(routeCachePolicies(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]string{
+		"/assets/style.css": "public, max-age=86400",
+		"/me":               "no-store",
+		"/csrf":             "no-store",
+		"/login":            "no-store",
+		"/login/github":     "no-store",
+		"/login/x":          "no-store",
+		"/login/fake":       "no-store",
+		"/avatar":           "no-store",
+		githubCallbackPath:  "no-store",
+		xCallbackPath:       "no-store",
+		"/fake/cb":          "no-store",
+		"/healthz":          "",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if cc := rec.Header().Get("Cache-Control"); cc != want {
+			t.Fatalf("%s: expected Cache-Control %q, got %q", path, want, cc)
+		}
+	}
+}
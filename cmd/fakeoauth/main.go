@@ -9,6 +9,7 @@ package main
 //    --name "Test User" --email tester@example.local
 //
 //  fakeoauth --issue-id-token --jwt-secret dev-secret
+//  fakeoauth --issue-id-token --require-nonce
 //
 // Fluxo tipico (shell):
 //  AUTHZ_URL="http://127.0.0.1:9100/oauth/authorize?response_type=code&client_id=fake-client-id&redirect_uri=http://127.0.0.1:8080/fake/oauth/callback&scope=profile+email&state=abc&code_challenge=xyz&code_challenge_method=S256"
@@ -46,6 +47,7 @@ type authCode struct {
 	ExpiresAt     time.Time
 	CodeChallenge string // opcional
 	Scope         string
+	Nonce         string // devolvido no id_token
 }
 
 type accessToken struct {
@@ -153,6 +155,7 @@ type config struct {
 	Email        string
 	AvatarURL    string
 	IssueIDToken bool
+	RequireNonce bool
 	JWTSecret    string
 	TokenTTL     time.Duration
 	Latency      time.Duration
@@ -171,6 +174,7 @@ func parseFlags() config {
 	flag.StringVar(&cfg.Email, "email", "tester@example.local", "user email")
 	flag.StringVar(&cfg.AvatarURL, "avatar-url", "", "avatar URL (optional)")
 	flag.BoolVar(&cfg.IssueIDToken, "issue-id-token", false, "issue id_token (JWT HS256)")
+	flag.BoolVar(&cfg.RequireNonce, "require-nonce", false, "reject authorize requests without nonce")
 	flag.StringVar(&cfg.JWTSecret, "jwt-secret", "dev-secret", "JWT HMAC secret")
 	flag.DurationVar(&cfg.TokenTTL, "token-ttl", 15*time.Minute, "access token TTL")
 	flag.DurationVar(&cfg.Latency, "latency", 0, "artificial latency for all endpoints")
@@ -214,12 +218,18 @@ func authorizeHandler(cfg config, st *store) http.HandlerFunc {
 			errorJSON(w, 400, "invalid_request", "only S256 supported for code_challenge_method")
 			return
 		}
+		nonce := q.Get("nonce")
+		if nonce == "" && cfg.RequireNonce {
+			errorJSON(w, 400, "invalid_request", "missing nonce")
+			return
+		}
 		ac := authCode{
 			UserID:        cfg.UserID,
 			RedirectURI:   redirectURI,
 			ExpiresAt:     time.Now().Add(2 * time.Minute),
 			CodeChallenge: "",
 			Scope:         q.Get("scope"),
+			Nonce:         nonce,
 		}
 		if codeChallenge != "" && codeChallengeMethod == "S256" {
 			ac.CodeChallenge = codeChallenge
@@ -324,6 +334,9 @@ func tokenHandler(cfg config, st *store) http.HandlerFunc {
 			if cfg.AvatarURL != "" {
 				claims["picture"] = cfg.AvatarURL
 			}
+			if ac.Nonce != "" {
+				claims["nonce"] = ac.Nonce
+			}
 			jwt, err := jwtHS256(cfg.JWTSecret, claims)
 			if err != nil {
 				errorJSON(w, 500, "server_error", "jwt generation failed")
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper: config for tests that issues id_tokens.
+func testConfig() config {
+	return config{
+		BaseURL:      "http://fake.test",
+		ClientID:     "cid",
+		UserID:       "u-1",
+		Username:     "tester",
+		Name:         "Test User",
+		Email:        "tester@example.local",
+		IssueIDToken: true,
+		JWTSecret:    "secret",
+		TokenTTL:     time.Minute,
+	}
+}
+
+// helper: run authorize with extra query parameters and return the code.
+func authorize(t *testing.T, cfg config, st *store, extra url.Values) (string, *httptest.ResponseRecorder) {
+	t.Helper()
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {cfg.ClientID},
+		"redirect_uri":  {"http://app.test/cb"},
+		"state":         {"st"},
+	}
+	for k, v := range extra {
+		q[k] = v
+	}
+	rr := httptest.NewRecorder()
+	authorizeHandler(cfg, st)(rr, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+q.Encode(), nil))
+	if rr.Code != http.StatusFound {
+		return "", rr
+	}
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	return loc.Query().Get("code"), rr
+}
+
+// helper: exchange code and return the decoded id_token claims.
+func idTokenClaims(t *testing.T, cfg config, st *store, code string) map[string]any {
+	t.Helper()
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {"http://app.test/cb"},
+		"client_id":    {cfg.ClientID},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	tokenHandler(cfg, st)(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("token: status %d body %s", rr.Code, rr.Body)
+	}
+	var resp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	parts := strings.Split(resp.IDToken, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a JWT, got %q", resp.IDToken)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decode claims: %v", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(b, &claims); err != nil {
+		t.Fatalf("unmarshal claims: %v", err)
+	}
+	return claims
+}
+
+// TestIDTokenNonce verifies a nonce sent to authorize is echoed in the
+// id_token, and omitted when none was sent.
+func TestIDTokenNonce(t *testing.T) {
+	cfg := testConfig()
+	st := newStore()
+
+	code, _ := authorize(t, cfg, st, url.Values{"nonce": {"n-0S6_WzA2Mj"}})
+	if got := idTokenClaims(t, cfg, st, code)["nonce"]; got != "n-0S6_WzA2Mj" {
+		t.Fatalf("expected nonce echoed, got %v", got)
+	}
+
+	code, _ = authorize(t, cfg, st, nil)
+	if got, ok := idTokenClaims(t, cfg, st, code)["nonce"]; ok {
+		t.Fatalf("expected no nonce claim, got %v", got)
+	}
+}
+
+// TestRequireNonce verifies --require-nonce rejects authorize requests
+// without one.
+func TestRequireNonce(t *testing.T) {
+	cfg := testConfig()
+	cfg.RequireNonce = true
+	st := newStore()
+
+	if _, rr := authorize(t, cfg, st, nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without nonce, got %d", rr.Code)
+	}
+	if code, rr := authorize(t, cfg, st, url.Values{"nonce": {"n"}}); code == "" {
+		t.Fatalf("expected a code with nonce, got status %d", rr.Code)
+	}
+}
@@ -1,25 +1,187 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type Config struct {
-	Addrs              string
-	BaseURL            string
-	FakeOAuthBaseURL   string
-	FakeOAuthClientID  string
-	FakeOAuthEnabled   bool
-	FakeOAuthRedirect  string
-	GitHubClientID     string
-	GitHubClientSecret string
-	GitTag             string
-	XClientID          string
-	XClientSecret      string
+	AccessLogSkip          []string
+	AdminToken             string
+	AllowedEmailDomains    []string
+	AnonHomeMaxAge         time.Duration
+	Addrs                  string
+	AssetsDir              string
+	AuthRedirectBrowsers   bool
+	AvatarContentTypes     []string
+	AvatarHosts            []string
+	AvatarMaxBytes         int64
+	AvatarTimeout          time.Duration
+	BaseURL                string
+	CallbackMaxInflight    int
+	CookieSameSite         string
+	DatabaseURL            string
+	DBFailFastReads        bool
+	DevMode                bool // 5xx bodies carry error details; never in production
+	FakeOAuthBaseURL       string
+	FakeOAuthClientID      string
+	FakeOAuthEnabled       bool
+	FakeOAuthRedirect      string
+	FakeOAuthTimeout       time.Duration
+	GitHubClientID         string
+	GitHubClientSecret     string
+	GitHubScopes           []string
+	GitHubScopesMode       string
+	GitHubTimeout          time.Duration
+	GitTag                 string
+	GravatarFallback       bool
+	InactivityTimeout      time.Duration
+	KeepAlivePeriod        time.Duration
+	KeepAlivesEnabled      bool
+	MaxIdentities          int
+	ProviderOrder          []string
+	RedisKeyPrefix         string
+	RedisURL               string
+	SessionCleanupInterval time.Duration
+	SessionCookieName      string
+	SessionIDBytes         int
+	SessionIDEncoding      string
+	SessionMaxAge          time.Duration
+	SessionStore           string
+	SlidingExpiration      bool
+	StateCleanupInterval   time.Duration
+	StateTTL               time.Duration
+	StateCookieCheck       bool
+	LastProviderMaxAge     time.Duration
+	TokenKeys              []string
+	TrustProxy             bool // honour X-Forwarded-Proto/-For from a TLS-terminating proxy
+	UserinfoCacheSize      int
+	UserinfoCacheTTL       time.Duration
+	WALCheckpointFrames    int
+	WALCheckpointInterval  time.Duration
+	XClientID              string
+	XClientSecret          string
+	XScopes                []string
+	XScopesMode            string
+	XTimeout               time.Duration
 }
 
 var Cfg = &Config{
-	Addrs:   ":3210",
-	BaseURL: "https://empreendedor.dev",
-	GitTag:  "dev",
+	AccessLogSkip:  []string{"/assets/", "/healthz"},
+	Addrs:          ":3210",
+	BaseURL:        "https://empreendedor.dev",
+	CookieSameSite: "lax",
+	GitTag:         "dev",
+
+	// Anonymous visitors get a cacheable home page; 0 keeps no-store, as does
+	// a maintenance banner being up.
+	AnonHomeMaxAge: time.Minute,
+
+	DatabaseURL: "edev.db",
+
+	// Render order of the login buttons.
+	ProviderOrder: []string{"github", "x"},
+
+	// Email domains allowed to sign in (e.g. "company.com"); empty allows all.
+	AllowedEmailDomains: nil,
+
+	// Provider identities one account may link.
+	MaxIdentities: 5,
+
+	// The WAL is truncated only when it holds more than WALCheckpointFrames.
+	WALCheckpointFrames:   1000,
+	WALCheckpointInterval: time.Minute,
+
+	AvatarContentTypes: []string{"image/png", "image/jpeg", "image/webp", "image/gif"},
+	AvatarMaxBytes:     1 << 20,
+	AvatarTimeout:      10 * time.Second,
+
+	// Hosts the avatar proxy may fetch from (https only). Gravatar is added
+	// when GravatarFallback is on.
+	AvatarHosts: []string{"avatars.githubusercontent.com", "pbs.twimg.com", "abs.twimg.com"},
+
+	// Derive a Gravatar avatar from the email when the provider sends none.
+	// Off by default: it reveals a hash of the email to a third-party host.
+	GravatarFallback: false,
+
+	// Queue reads for a free RO connection rather than failing with 503.
+	DBFailFastReads: false,
+
+	SessionCleanupInterval: 5 * time.Minute,
+	SessionMaxAge:          3 * time.Hour, // cookie and server-side lifetime
+
+	// Session backend: "sqlite", "redis" (shared between instances), "memory"
+	// or "sharded" (in-process, split over several locks).
+	SessionStore:      "sqlite",
+	RedisURL:          "redis://127.0.0.1:6379/0",
+	RedisKeyPrefix:    "edev:sess:",
+	SessionIDBytes:    32,
+	SessionIDEncoding: "base64url",
+	InactivityTimeout: 0, // disabled
+	SlidingExpiration: true,
+
+	// OAuth state lifetime between the login redirect and the callback.
+	StateCleanupInterval: time.Minute,
+	StateTTL:             10 * time.Minute,
+
+	// Callbacks must come back to the browser that started the login.
+	StateCookieCheck: true,
+
+	// How long the login page remembers the last provider used; 0 disables.
+	LastProviderMaxAge: 365 * 24 * time.Hour,
+
+	// Provider callbacks one client IP may have in flight; 0 disables.
+	CallbackMaxInflight: 4,
+
+	KeepAlivesEnabled: true,
+
+	// Browsers without a session are sent to /login; API clients get 401.
+	AuthRedirectBrowsers: true,
 
 	FakeOAuthRedirect: "/fake/oauth/callback",
 	FakeOAuthBaseURL:  "http://127.0.0.1:9100",
 	FakeOAuthClientID: "fake-client-id",
+
+	// Extra scopes per provider; "append" adds them to the defaults,
+	// "replace" uses them instead.
+	GitHubScopesMode: "append",
+	XScopesMode:      "append",
+
+	// Userinfo results cached per access token; 0 entries disables it.
+	UserinfoCacheSize: 1024,
+	UserinfoCacheTTL:  time.Minute,
+
+	// Per-provider deadline for the token exchange and userinfo calls.
+	FakeOAuthTimeout: 10 * time.Second,
+	GitHubTimeout:    10 * time.Second,
+	XTimeout:         10 * time.Second,
+}
+
+// AbsURL joins BaseURL and path into an absolute URL.
+func AbsURL(path string) string {
+	return strings.TrimRight(Cfg.BaseURL, "/") + path
+}
+
+// ParseAddr splits a listen address into the network and address for
+// net.Listen. "unix:/path/to.sock" selects a unix socket; anything else must
+// be host:port with a numeric port (host may be empty, as in ":3210").
+func ParseAddr(addr string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return "", "", errors.New("unix socket path is empty")
+		}
+		return "unix", path, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("want host:port (e.g. \":3210\") or unix:/path: %w", err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	return "tcp", addr, nil
 }
@@ -0,0 +1,30 @@
+package config
+
+import "testing"
+
+// TestParseAddr verifies accepted listen addresses map to the right network
+// and malformed ones are rejected.
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{":3210", "tcp", ":3210"},
+		{"127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+		{"[::1]:443", "tcp", "[::1]:443"},
+		{"localhost:0", "tcp", "localhost:0"},
+		{"unix:/run/edev.sock", "unix", "/run/edev.sock"},
+	} {
+		network, address, err := ParseAddr(tc.addr)
+		if err != nil || network != tc.network || address != tc.address {
+			t.Fatalf("%q: got %q %q %v", tc.addr, network, address, err)
+		}
+	}
+
+	for _, addr := range []string{"3210", "", "localhost", ":http", ":70000", "::1:80", "unix:"} {
+		if _, _, err := ParseAddr(addr); err == nil {
+			t.Fatalf("%q: expected error", addr)
+		}
+	}
+}
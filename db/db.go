@@ -4,6 +4,7 @@
 // - WAL + synchronous=NORMAL + busy_timeout.
 // - Short transactions with timeouts per operation (not on Begin).
 // - WAL checkpoint on Close() for hygiene.
+// - Log lines start with "db: " (see log.SetPrefixLevel).
 package db
 
 import (
@@ -11,12 +12,18 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
 
+	"edev/config"
 	"edev/log"
 	"edev/utils"
 )
@@ -28,8 +35,15 @@ var Storage *SQLite
 type SQLite struct {
 	rw *sql.DB // single-writer pool
 	ro *sql.DB // read-only pool
+
+	failFast bool // reads return ErrPoolExhausted instead of queueing
 }
 
+// ErrPoolExhausted is returned by reads on a database opened with
+// WithFailFastReads when every RO connection is checked out. Handlers can
+// answer 503 instead of waiting for the read timeout.
+var ErrPoolExhausted = errors.New("db: read pool exhausted")
+
 // Transaction wraps a write transaction.
 type Transaction struct {
 	tx *sql.Tx
@@ -101,34 +115,116 @@ const (
 	defaultConnMaxLifeRW   = 2 * time.Minute
 	defaultConnMaxLifeRO   = 5 * time.Minute
 	defaultReadPoolMinimum = 4 // will be raised to GOMAXPROCS if larger
+	defaultBackupTimeout   = 2 * time.Minute
+	defaultVacuumTimeout   = 10 * time.Minute
+)
+
+// Option customizes how NewWithPath opens the pools.
+type Option func(*options) error
+
+type options struct {
+	pragmas  string // pre-encoded "&_pragma=k(v)" pairs appended to both DSNs
+	failFast bool
+}
+
+// reservedPragmas are set by NewWithPath and must not be overridden.
+var reservedPragmas = map[string]bool{
+	"journal_mode": true,
+	"busy_timeout": true,
+	"foreign_keys": true,
+}
+
+var (
+	pragmaNameRe  = regexp.MustCompile(`^[a-z_]+$`)
+	pragmaValueRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	savepointRe   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
 )
 
+// WithExtraPragmas appends `_pragma=key(value)` pairs to both DSNs for advanced
+// tuning (e.g. mmap_size, page_size). Pragmas required by this package
+// (journal_mode, busy_timeout, foreign_keys) are rejected.
+func WithExtraPragmas(pragmas map[string]string) Option {
+	return func(o *options) error {
+		keys := make([]string, 0, len(pragmas))
+		for k := range pragmas {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		for _, k := range keys {
+			v := pragmas[k]
+			if reservedPragmas[k] {
+				return fmt.Errorf("pragma %q is managed by the db package", k)
+			}
+			if !pragmaNameRe.MatchString(k) || !pragmaValueRe.MatchString(v) {
+				return fmt.Errorf("invalid pragma %q=%q", k, v)
+			}
+			fmt.Fprintf(&b, "&_pragma=%s(%s)", k, v)
+		}
+		o.pragmas += b.String()
+		return nil
+	}
+}
+
+// WithFailFastReads makes Query, QueryRow and QueryAll (and their Context
+// variants) return ErrPoolExhausted right away when the RO pool has no free
+// connection, instead of queueing until a connection frees up or the context
+// deadline hits. The check reads the pool stats, so a connection released at
+// the same instant may still see the error.
+func WithFailFastReads() Option {
+	return func(o *options) error {
+		o.failFast = true
+		return nil
+	}
+}
+
 // New initializes RW/RO pools.
-// Uses config.Cfg.DatabaseURL as the SQLite path/URI; defaults to "app.db".
+// Uses config.Cfg.DatabaseURL as the SQLite path/URI; defaults to "edev.db".
+// config.Cfg.DBFailFastReads enables WithFailFastReads.
 func New() (*SQLite, error) {
 	path := "edev.db"
-	return NewWithPath(path)
+	if config.Cfg.DatabaseURL != "" {
+		path = config.Cfg.DatabaseURL
+	}
+	var opts []Option
+	if config.Cfg.DBFailFastReads {
+		opts = append(opts, WithFailFastReads())
+	}
+	return NewWithPath(path, opts...)
 }
 
 // NewWithPath creates SQLite pools for a specific file/URI path.
-func NewWithPath(path string) (*SQLite, error) {
+func NewWithPath(path string, opts ...Option) (*SQLite, error) {
 	if path == "" {
 		return nil, errors.New("database path required")
 	}
+	var o options
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	if path == MemoryPath {
+		return newMemory(o)
+	}
+	if err := checkWritable(path); err != nil {
+		return nil, err
+	}
 
 	// DSN for write pool: WAL, NORMAL, busy_timeout, foreign_keys ON, automatic_index ON,
 	// temp_store in memory, modest cache, and tx lock set to IMMEDIATE.
 	rwDSN := fmt.Sprintf(
 		"file:%s?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(%d)&_pragma=foreign_keys(ON)&_pragma=automatic_index(ON)&_pragma=temp_store(MEMORY)&_pragma=cache_size(-20000)&_txlock=immediate",
 		path, int(defaultBusyTimeout.Milliseconds()),
-	)
+	) + o.pragmas
 	// DSN for read-only pool: mode=ro with busy_timeout and foreign_keys ON.
 	roDSN := fmt.Sprintf(
 		"file:%s?mode=ro&_pragma=busy_timeout(%d)&_pragma=foreign_keys(ON)",
 		path, int(defaultBusyTimeout.Milliseconds()),
-	)
+	) + o.pragmas
 
-	s := &SQLite{}
+	s := &SQLite{failFast: o.failFast}
 
 	// Open writer (single connection for predictable write latency under contention).
 	rw, err := sql.Open("sqlite", rwDSN)
@@ -167,6 +263,59 @@ func NewWithPath(path string) (*SQLite, error) {
 	return s, nil
 }
 
+// MemoryPath opens a private in-memory database (fast tests, no files).
+const MemoryPath = ":memory:"
+
+// newMemory opens an in-memory database behind a single connection shared by
+// both "pools": an in-memory database lives inside one connection, so the
+// RO and RW sides must use the same one. The connection is never recycled.
+// Keep row iteration short: a pending *sql.Rows blocks every other call.
+func newMemory(o options) (*SQLite, error) {
+	dsn := fmt.Sprintf(
+		"file::memory:?_pragma=busy_timeout(%d)&_pragma=foreign_keys(ON)&_txlock=immediate",
+		int(defaultBusyTimeout.Milliseconds()),
+	) + o.pragmas
+	mem, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open memory: %w", err)
+	}
+	mem.SetMaxOpenConns(1)
+	mem.SetMaxIdleConns(1)
+	mem.SetConnMaxLifetime(0)
+	mem.SetConnMaxIdleTime(0)
+	if err := pingWithTimeout(mem, defaultWriteOpTimeout); err != nil {
+		utils.Closer(mem)
+		return nil, fmt.Errorf("ping memory: %w", err)
+	}
+	return &SQLite{rw: mem, ro: mem, failFast: o.failFast}, nil
+}
+
+// checkWritable fails early with a clear message when path is a directory or
+// cannot be created/opened for writing, instead of a cryptic driver error.
+func checkWritable(path string) error {
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		return fmt.Errorf("database path %q is a directory", path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("database path %q: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	di, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("database directory %q: %w", dir, err)
+	}
+	if !di.IsDir() {
+		return fmt.Errorf("database directory %q is not a directory", dir)
+	}
+	f, err := os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("database path %q is not writable: %w", path, err)
+	}
+	utils.Closer(f)
+	return nil
+}
+
 func pingWithTimeout(db *sql.DB, d time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), d)
 	defer cancel()
@@ -214,6 +363,33 @@ func (t *Transaction) Rollback() error {
 	return err
 }
 
+// Savepoint marks a point inside the transaction that RollbackTo can return
+// to. name must be a plain identifier (letters, digits, underscore).
+func (t *Transaction) Savepoint(name string) error {
+	return t.savepointExec("SAVEPOINT ", name)
+}
+
+// RollbackTo undoes everything after the named savepoint. The savepoint
+// stays active and can be rolled back to again.
+func (t *Transaction) RollbackTo(name string) error {
+	return t.savepointExec("ROLLBACK TO SAVEPOINT ", name)
+}
+
+// Release forgets the named savepoint (and any newer ones), keeping their
+// changes in the enclosing transaction.
+func (t *Transaction) Release(name string) error {
+	return t.savepointExec("RELEASE SAVEPOINT ", name)
+}
+
+// savepointExec runs stmt+name; name is validated because identifiers cannot
+// be bound as parameters.
+func (t *Transaction) savepointExec(stmt, name string) error {
+	if !savepointRe.MatchString(name) {
+		return fmt.Errorf("invalid savepoint name %q", name)
+	}
+	return t.Exec(stmt + name)
+}
+
 // Exec executes a write statement inside the transaction.
 func (t *Transaction) Exec(query string, args ...any) error {
 	if t == nil || t.tx == nil {
@@ -244,12 +420,30 @@ func (t *Transaction) QueryRow(query string, args ...any) *Row {
 	return newRow(t.tx.QueryRowContext(ctx, query, args...), cancel)
 }
 
+// opContext derives the per-operation context from ctx. A deadline already
+// set by the caller wins; otherwise the default timeout d applies.
+func opContext(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
 // Exec executes a write statement on the RW pool (outside explicit transactions).
 func (s *SQLite) Exec(query string, args ...any) error {
+	return s.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is Exec bound to ctx, so a canceled request aborts the
+// statement. Without a deadline on ctx the default write timeout applies.
+func (s *SQLite) ExecContext(ctx context.Context, query string, args ...any) error {
 	if s == nil || s.rw == nil {
 		return errors.New("db not initialized")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), defaultWriteOpTimeout)
+	ctx, cancel := opContext(ctx, defaultWriteOpTimeout)
 	defer cancel()
 	_, err := s.rw.ExecContext(ctx, query, args...)
 	return err
@@ -257,23 +451,51 @@ func (s *SQLite) Exec(query string, args ...any) error {
 
 // Query executes a SELECT on the RO pool (parallel reads).
 func (s *SQLite) Query(query string, args ...any) (*sql.Rows, error) {
+	return s.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext is Query bound to ctx. Without a deadline on ctx the default
+// read timeout applies.
+func (s *SQLite) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
 	if s == nil || s.ro == nil {
 		return nil, errors.New("db not initialized")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), defaultReadOpTimeout)
+	if s.readPoolExhausted() {
+		return nil, ErrPoolExhausted
+	}
+	ctx, cancel := opContext(ctx, defaultReadOpTimeout)
 	defer cancel()
 	return s.ro.QueryContext(ctx, query, args...)
 }
 
 // QueryRow executes a single-row SELECT on the RO pool.
 func (s *SQLite) QueryRow(query string, args ...any) *Row {
+	return s.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext is QueryRow bound to ctx. Without a deadline on ctx the
+// default read timeout applies.
+func (s *SQLite) QueryRowContext(ctx context.Context, query string, args ...any) *Row {
 	if s == nil || s.ro == nil {
 		return errorRow(errors.New("db not initialized"))
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), defaultReadOpTimeout)
+	if s.readPoolExhausted() {
+		return errorRow(ErrPoolExhausted)
+	}
+	ctx, cancel := opContext(ctx, defaultReadOpTimeout)
 	return newRow(s.ro.QueryRowContext(ctx, query, args...), cancel)
 }
 
+// readPoolExhausted reports whether fail-fast reads are on and every RO
+// connection is in use.
+func (s *SQLite) readPoolExhausted() bool {
+	if !s.failFast {
+		return false
+	}
+	st := s.ro.Stats()
+	return st.MaxOpenConnections > 0 && st.InUse >= st.MaxOpenConnections
+}
+
 // QueryRW allows SELECT using the RW pool (rarely needed).
 func (s *SQLite) QueryRW(query string, args ...any) (*sql.Rows, error) {
 	if s == nil || s.rw == nil {
@@ -295,14 +517,172 @@ func (s *SQLite) CheckpointWAL() error {
 	return err
 }
 
+// WALFrames returns the number of frames currently in the WAL. It runs a
+// PASSIVE checkpoint, which never blocks readers or writers, and reports its
+// log size. In-memory databases have no WAL and report 0.
+func (s *SQLite) WALFrames() (int, error) {
+	if s == nil || s.rw == nil {
+		return 0, errors.New("db not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var busy, frames, checkpointed int
+	err := s.rw.QueryRowContext(ctx, `PRAGMA wal_checkpoint(PASSIVE)`).Scan(&busy, &frames, &checkpointed)
+	if err != nil {
+		return 0, err
+	}
+	return max(frames, 0), nil
+}
+
+// CheckpointIfAbove runs CheckpointWAL only when the WAL holds more than
+// threshold frames. It reports whether the checkpoint ran.
+func (s *SQLite) CheckpointIfAbove(threshold int) (bool, error) {
+	frames, err := s.WALFrames()
+	if err != nil {
+		return false, err
+	}
+	if frames <= threshold {
+		return false, nil
+	}
+	return true, s.CheckpointWAL()
+}
+
+// Ping runs SELECT 1 on both pools, so a broken writer or reader shows up in
+// health checks. ctx bounds the whole probe.
+func (s *SQLite) Ping(ctx context.Context) error {
+	if s == nil || s.rw == nil || s.ro == nil {
+		return errors.New("db not initialized")
+	}
+	var one int
+	if err := s.rw.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("ping RW: %w", err)
+	}
+	if err := s.ro.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("ping RO: %w", err)
+	}
+	return nil
+}
+
+// PingRead runs SELECT 1 on the RO pool only. Liveness probes use it so a
+// long write holding the single RW connection (VACUUM, a backup) does not
+// make the instance look dead.
+func (s *SQLite) PingRead(ctx context.Context) error {
+	if s == nil || s.ro == nil {
+		return errors.New("db not initialized")
+	}
+	var one int
+	if err := s.ro.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return fmt.Errorf("ping RO: %w", err)
+	}
+	return nil
+}
+
+// DBStats is a snapshot of both pools and the database file for dashboards.
+type DBStats struct {
+	RW        sql.DBStats `json:"rw"`
+	RO        sql.DBStats `json:"ro"`
+	WALFrames int         `json:"wal_frames"`
+	PageCount int         `json:"page_count"`
+	PageSize  int         `json:"page_size"`
+}
+
+// Stats reports the pool statistics, the WAL frame count (see WALFrames) and
+// the database size in pages. In-memory databases share one pool, so RW and
+// RO are the same. A failed PRAGMA is logged and leaves its field at 0.
+func (s *SQLite) Stats() DBStats {
+	if s == nil || s.rw == nil || s.ro == nil {
+		return DBStats{}
+	}
+	st := DBStats{RW: s.rw.Stats(), RO: s.ro.Stats()}
+	var err error
+	if st.WALFrames, err = s.WALFrames(); err != nil {
+		log.Warnf("db: stats: wal frames: %v", err)
+	}
+	if err := s.QueryRow(`PRAGMA page_count`).Scan(&st.PageCount); err != nil {
+		log.Warnf("db: stats: page_count: %v", err)
+	}
+	if err := s.QueryRow(`PRAGMA page_size`).Scan(&st.PageSize); err != nil {
+		log.Warnf("db: stats: page_size: %v", err)
+	}
+	return st
+}
+
+// Vacuum rebuilds the database file on the RW pool to reclaim free pages.
+// It needs as much free disk as the database, blocks writers while it runs
+// and can be slow, so without a deadline on ctx it gets a generous one.
+// Cancelling ctx aborts it, leaving the file as it was.
+func (s *SQLite) Vacuum(ctx context.Context) error {
+	if s == nil || s.rw == nil {
+		return errors.New("db not initialized")
+	}
+	ctx, cancel := opContext(ctx, defaultVacuumTimeout)
+	defer cancel()
+	_, err := s.rw.ExecContext(ctx, `VACUUM`)
+	return err
+}
+
+// IntegrityCheck runs PRAGMA integrity_check on the RW pool. ok is true when
+// SQLite reports "ok"; otherwise problems holds the reported lines.
+func (s *SQLite) IntegrityCheck(ctx context.Context) (ok bool, problems []string, err error) {
+	if s == nil || s.rw == nil {
+		return false, nil, errors.New("db not initialized")
+	}
+	rows, err := s.rw.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return false, nil, err
+	}
+	defer utils.Closer(rows)
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return false, nil, err
+		}
+		problems = append(problems, line)
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+	if len(problems) == 1 && problems[0] == "ok" {
+		return true, nil, nil
+	}
+	return false, problems, nil
+}
+
+// BackupTo writes a consistent snapshot of the main database to path using
+// VACUUM INTO on the RW pool. Readers keep working; writers wait for the
+// copy, which is bounded by defaultBackupTimeout. The WAL is left as is and
+// the snapshot is a single compacted file. path must not exist yet.
+func (s *SQLite) BackupTo(path string) error {
+	if s == nil || s.rw == nil {
+		return errors.New("db not initialized")
+	}
+	if path == "" || path == MemoryPath {
+		return errors.New("backup path required")
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup path %q already exists", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("backup path %q: %w", path, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultBackupTimeout)
+	defer cancel()
+	if _, err := s.rw.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		_ = os.Remove(path) // drop a partial copy
+		return fmt.Errorf("backup to %q: %w", path, err)
+	}
+	return nil
+}
+
 // Close closes pools; performs a best-effort WAL checkpoint first.
 func (s *SQLite) Close() {
 	if s == nil {
 		return
 	}
 	if err := s.CheckpointWAL(); err != nil {
-		log.Println("wal checkpoint:", err)
+		log.Println("db: wal checkpoint:", err)
+	}
+	if s.ro != s.rw {
+		utils.Closer(s.ro)
 	}
-	utils.Closer(s.ro)
 	utils.Closer(s.rw)
 }
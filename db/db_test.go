@@ -1,11 +1,16 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"edev/config"
 	"edev/utils"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -99,6 +104,115 @@ func TestNewAndPragmas(t *testing.T) {
 	}
 }
 
+func TestNewUsesConfiguredPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "configured.db")
+	prev := config.Cfg.DatabaseURL
+	config.Cfg.DatabaseURL = path
+	defer func() { config.Cfg.DatabaseURL = prev }()
+
+	s, err := New()
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE t(x)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected database at %s: %v", path, err)
+	}
+}
+
+func TestNewWithPathRejectsInvalidPaths(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	for _, path := range []string{
+		tmp,
+		filepath.Join(tmp, "missing", "test.db"),
+	} {
+		s, err := NewWithPath(path)
+		if err == nil {
+			s.Close()
+			t.Fatalf("expected error for %q", path)
+		}
+	}
+}
+
+func TestWithExtraPragmas(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "test.db")
+
+	s, err := NewWithPath(path, WithExtraPragmas(map[string]string{"mmap_size": "268435456"}))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	r, e := s.QueryRW(`PRAGMA mmap_size`)
+	n := mustQuerySingleInt64(t, mustRows(t, r, e))
+	if n != 268435456 {
+		t.Fatalf("expected mmap_size=268435456, got %d", n)
+	}
+
+	for _, bad := range []map[string]string{
+		{"journal_mode": "DELETE"},
+		{"busy_timeout": "0"},
+		{"mmap_size": "1)&_pragma=foo(2"},
+	} {
+		if s2, err := NewWithPath(filepath.Join(tmp, "bad.db"), WithExtraPragmas(bad)); err == nil {
+			s2.Close()
+			t.Fatalf("expected error for %v", bad)
+		}
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE kv(k TEXT PRIMARY KEY, v TEXT NOT NULL)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.Exec(`INSERT INTO kv(k, v) VALUES(?, ?)`, "a", "1"); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if err := tx.Exec(`INSERT INTO kv(k, v) VALUES(?, ?)`, "b", "2"); err != nil {
+		t.Fatalf("tx insert: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// The RO side must see rows written through the RW side.
+	var v string
+	if err := s.QueryRow(`SELECT v FROM kv WHERE k = ?`, "b").Scan(&v); err != nil {
+		t.Fatalf("queryrow: %v", err)
+	}
+	if v != "2" {
+		t.Fatalf("expected v=2, got %s", v)
+	}
+	rows, err := s.Query(`SELECT COUNT(*) FROM kv`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if n := mustQuerySingleInt64(t, rows); n != 2 {
+		t.Fatalf("expected 2 rows, got %d", n)
+	}
+}
+
 func TestExecAndQuery(t *testing.T) {
 	t.Parallel()
 
@@ -230,6 +344,126 @@ func TestCheckpointAndClose(t *testing.T) {
 	s.Close()
 }
 
+func TestCheckpointIfAbove(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewWithPath(path)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	const threshold = 50
+	if err := s.Exec(`CREATE TABLE t(x)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	done, err := s.CheckpointIfAbove(threshold)
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if done {
+		t.Fatalf("expected no checkpoint below the threshold")
+	}
+
+	for i := 0; i < 2*threshold; i++ {
+		if err := s.Exec(`INSERT INTO t(x) VALUES(?)`, i); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	done, err = s.CheckpointIfAbove(threshold)
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if !done {
+		t.Fatalf("expected a checkpoint above the threshold")
+	}
+	fi, err := os.Stat(path + "-wal")
+	if err != nil {
+		t.Fatalf("stat wal: %v", err)
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("expected truncated WAL, got %d bytes", fi.Size())
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	script := `
+		-- seed; with a semicolon in a comment
+		CREATE TABLE t(x TEXT);
+		INSERT INTO t(x) VALUES('a;b'), ('it''s');
+	`
+	if err := s.ExecScript(script); err != nil {
+		t.Fatalf("exec script: %v", err)
+	}
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM t WHERE x IN ('a;b', 'it''s')`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected both statements to apply, got %d rows", n)
+	}
+
+	// A failing statement rolls back the whole script.
+	if err := s.ExecScript(`INSERT INTO t(x) VALUES('c'); INSERT INTO missing VALUES(1);`); err == nil {
+		t.Fatalf("expected error for missing table")
+	}
+	if err := s.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected rollback, got %d rows", n)
+	}
+}
+
+func TestSplitScriptTrigger(t *testing.T) {
+	t.Parallel()
+
+	stmts := splitScript(`
+		CREATE TABLE a(x);
+		CREATE TRIGGER a_ins AFTER INSERT ON a
+		BEGIN
+			UPDATE a SET x = x + 1 WHERE rowid = NEW.rowid;
+		END;
+		/* trailing ; comment */
+	`)
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %q", len(stmts), stmts)
+	}
+	if !strings.HasSuffix(stmts[1], "END") {
+		t.Fatalf("expected trigger body to be kept whole, got %q", stmts[1])
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE t(x INTEGER PRIMARY KEY, y TEXT UNIQUE)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ok, problems, err := s.IntegrityCheck(context.Background())
+	if err != nil {
+		t.Fatalf("integrity check: %v", err)
+	}
+	if !ok || len(problems) != 0 {
+		t.Fatalf("expected ok, got ok=%v problems=%v", ok, problems)
+	}
+}
+
 func TestConcurrentReadersSingleWriter(t *testing.T) {
 	t.Parallel()
 
@@ -306,3 +540,348 @@ func (a *atomicError) Load() error {
 	defer a.mu.Unlock()
 	return a.e
 }
+
+// slowQuery counts a long recursive sequence; it runs for seconds unless
+// interrupted.
+const slowQuery = `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c WHERE x < 1000000000) SELECT COUNT(*) FROM c`
+
+// TestContextCancelAbortsQuery verifies that canceling the caller's context
+// interrupts a running statement instead of waiting for the default timeout.
+func TestContextCancelAbortsQuery(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	cases := map[string]func(ctx context.Context) error{
+		"ExecContext": func(ctx context.Context) error {
+			return s.ExecContext(ctx, slowQuery)
+		},
+		"QueryRowContext": func(ctx context.Context) error {
+			var n int
+			return s.QueryRowContext(ctx, slowQuery).Scan(&n)
+		},
+	}
+	for name, run := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := run(ctx)
+		if err == nil {
+			t.Fatalf("%s: expected an error after cancel", name)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("%s: expected prompt abort, took %s", name, d)
+		}
+		cancel()
+	}
+
+	// A context that is already done never reaches the database.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.QueryContext(ctx, `SELECT 1`); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestContextDeadlineWins verifies a caller deadline shorter than the default
+// timeout is honoured.
+func TestContextDeadlineWins(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var n int
+	if err := s.QueryRowContext(ctx, slowQuery).Scan(&n); err == nil {
+		t.Fatalf("expected deadline error")
+	}
+	if d := time.Since(start); d >= defaultReadOpTimeout {
+		t.Fatalf("expected caller deadline to apply, took %s", d)
+	}
+}
+
+// TestBackupTo verifies a backup taken while the database is open holds the
+// same rows, opens read-only, and leaves the source WAL in place.
+func TestBackupTo(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "live.db")
+	s, err := NewWithPath(src)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE t(x INTEGER)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i := range 100 {
+		if err := s.Exec(`INSERT INTO t(x) VALUES(?)`, i); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	dst := filepath.Join(dir, "backup.db")
+	if err := s.BackupTo(dst); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if err := s.BackupTo(dst); err == nil {
+		t.Fatalf("expected error when the backup path exists")
+	}
+	if _, err := os.Stat(src + "-wal"); err != nil {
+		t.Fatalf("expected source WAL to remain: %v", err)
+	}
+
+	b, err := sql.Open("sqlite", "file:"+dst+"?mode=ro")
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer utils.Closer(b)
+	var want, got int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&want); err != nil {
+		t.Fatalf("count source: %v", err)
+	}
+	if err := b.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&got); err != nil {
+		t.Fatalf("count backup: %v", err)
+	}
+	if got != want || got != 100 {
+		t.Fatalf("expected %d rows in backup, got %d", want, got)
+	}
+	if _, err := b.Exec(`INSERT INTO t(x) VALUES(1)`); err == nil {
+		t.Fatalf("expected read-only backup to reject writes")
+	}
+}
+
+// TestStats verifies pool, WAL and page statistics are populated after some
+// traffic.
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE t(x INTEGER)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i := range 10 {
+		if err := s.Exec(`INSERT INTO t(x) VALUES(?)`, i); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		var n int
+		if err := s.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil {
+			t.Fatalf("count: %v", err)
+		}
+	}
+
+	st := s.Stats()
+	if st.RW.MaxOpenConnections != 1 || st.RO.MaxOpenConnections < defaultReadPoolMinimum {
+		t.Fatalf("unexpected pool limits: rw=%d ro=%d", st.RW.MaxOpenConnections, st.RO.MaxOpenConnections)
+	}
+	if st.RW.OpenConnections < 1 || st.RO.OpenConnections < 1 {
+		t.Fatalf("expected open connections on both pools, got rw=%d ro=%d", st.RW.OpenConnections, st.RO.OpenConnections)
+	}
+	if st.RW.InUse < 0 || st.RO.Idle < 0 || st.RO.WaitCount < 0 {
+		t.Fatalf("expected non-negative counters, got %+v", st)
+	}
+	if st.WALFrames <= 0 {
+		t.Fatalf("expected WAL frames after writes, got %d", st.WALFrames)
+	}
+	if st.PageCount <= 0 || st.PageSize <= 0 {
+		t.Fatalf("expected page stats, got count=%d size=%d", st.PageCount, st.PageSize)
+	}
+}
+
+// TestSavepoints verifies RollbackTo discards only the writes after the
+// savepoint, and that unsafe names are refused.
+func TestSavepoints(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE t(x TEXT)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := tx.Exec(`INSERT INTO t(x) VALUES('first')`); err != nil {
+		t.Fatalf("insert first: %v", err)
+	}
+	if err := tx.Savepoint("sp1"); err != nil {
+		t.Fatalf("savepoint: %v", err)
+	}
+	if err := tx.Exec(`INSERT INTO t(x) VALUES('second')`); err != nil {
+		t.Fatalf("insert second: %v", err)
+	}
+	if err := tx.RollbackTo("sp1"); err != nil {
+		t.Fatalf("rollback to: %v", err)
+	}
+	if err := tx.Release("sp1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	for _, name := range []string{"", "1sp", "sp; DROP TABLE t", `"sp"`} {
+		if err := tx.Savepoint(name); err == nil {
+			t.Fatalf("expected invalid savepoint name %q to be refused", name)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var n int
+	var x string
+	if err := s.QueryRow(`SELECT COUNT(*), MIN(x) FROM t`).Scan(&n, &x); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 1 || x != "first" {
+		t.Fatalf("expected only the first row, got %d rows (%q)", n, x)
+	}
+}
+
+// TestPing verifies Ping succeeds on an open database and fails once closed.
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("expected ping ok, got %v", err)
+	}
+	s.Close()
+	if err := s.Ping(context.Background()); err == nil {
+		t.Fatalf("expected ping error on a closed db")
+	}
+}
+
+// TestPingReadWhileWriterBusy verifies PingRead answers while a transaction
+// holds the RW connection, which Ping waits for.
+func TestPingReadWhileWriterBusy(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.PingRead(ctx); err != nil {
+		t.Fatalf("expected read ping ok with a busy writer, got %v", err)
+	}
+	if err := s.Ping(ctx); err == nil {
+		t.Fatalf("expected full ping to time out waiting for the writer")
+	}
+}
+
+// TestVacuum verifies VACUUM reclaims the pages of deleted rows and leaves an
+// intact database.
+func TestVacuum(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.ExecScript(`
+		CREATE TABLE t(x TEXT);
+		WITH RECURSIVE c(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM c WHERE i < 2000)
+		INSERT INTO t(x) SELECT printf('%0500d', i) FROM c;
+		DELETE FROM t WHERE rowid % 2 = 0;
+	`); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	before := s.Stats().PageCount
+	if err := s.Vacuum(context.Background()); err != nil {
+		t.Fatalf("vacuum: %v", err)
+	}
+	if after := s.Stats().PageCount; after >= before {
+		t.Fatalf("expected fewer pages after vacuum, got %d -> %d", before, after)
+	}
+
+	ok, problems, err := s.IntegrityCheck(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("expected integrity ok after vacuum, got ok=%v problems=%v err=%v", ok, problems, err)
+	}
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil || n != 1000 {
+		t.Fatalf("expected 1000 rows kept, got %d err=%v", n, err)
+	}
+}
+
+// TestFailFastReads verifies that with every RO connection checked out a read
+// fails at once with ErrPoolExhausted, and succeeds again once one is free.
+func TestFailFastReads(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"), WithFailFastReads())
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	var held []*sql.Conn
+	for range s.ro.Stats().MaxOpenConnections {
+		c, err := s.ro.Conn(ctx)
+		if err != nil {
+			t.Fatalf("conn: %v", err)
+		}
+		held = append(held, c)
+	}
+
+	start := time.Now()
+	var one int
+	if err := s.QueryRow(`SELECT 1`).Scan(&one); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("QueryRow: expected ErrPoolExhausted, got %v", err)
+	}
+	if _, err := s.Query(`SELECT 1`); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Query: expected ErrPoolExhausted, got %v", err)
+	}
+	var dest []struct{ X int }
+	if err := s.QueryAll(&dest, `SELECT 1 AS x`); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("QueryAll: expected ErrPoolExhausted, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected fast failure, took %v", d)
+	}
+
+	utils.Closer(held[0])
+	if err := s.QueryRow(`SELECT 1`).Scan(&one); err != nil || one != 1 {
+		t.Fatalf("expected read after release, got %d, %v", one, err)
+	}
+	for _, c := range held[1:] {
+		utils.Closer(c)
+	}
+}
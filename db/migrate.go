@@ -0,0 +1,167 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"edev/log"
+)
+
+// Migration is one schema step. Version orders the steps and is recorded in
+// schema_migrations once Up has been applied. Down, when set, undoes Up; it is
+// stored with the version so Rollback works without the original files.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// previewLen caps the SQL shown at info level; debug logs the full script.
+const previewLen = 120
+
+func (s *SQLite) ensureMigrationsTable() error {
+	err := s.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		down_sql TEXT NOT NULL DEFAULT ''
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the migrations not yet recorded in schema_migrations,
+// ordered by version.
+func (s *SQLite) Pending(migrations []Migration) ([]Migration, error) {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	ms := slices.Clone(migrations)
+	slices.SortFunc(ms, func(a, b Migration) int { return a.Version - b.Version })
+	var out []Migration
+	for i, m := range ms {
+		if i > 0 && ms[i-1].Version == m.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+		var n int
+		err := s.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.Version).Scan(&n)
+		if err != nil {
+			return nil, fmt.Errorf("migration %d: %w", m.Version, err)
+		}
+		if n == 0 {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// Migrate applies the pending migrations in version order, each in its own
+// transaction together with its schema_migrations row. Applied versions are
+// skipped, so running it again (or after a restart) is a no-op.
+func (s *SQLite) Migrate(migrations []Migration) error {
+	pending, err := s.Pending(migrations)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := s.applyMigration(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) applyMigration(m Migration) error {
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := tx.ExecScript(m.Up); err != nil {
+		return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+	}
+	if err := tx.Exec(`INSERT INTO schema_migrations(version, down_sql) VALUES(?, ?)`, m.Version, m.Down); err != nil {
+		return fmt.Errorf("migration %d %s: record version: %w", m.Version, m.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+	}
+
+	log.Printf("db: migration applied version=%d name=%s sql=%q", m.Version, m.Name, preview(m.Up))
+	log.Debugf("db: migration version=%d sql:\n%s", m.Version, m.Up)
+	return nil
+}
+
+// Rollback undoes every applied migration above toVersion, newest first, by
+// running the Down script recorded with it. Each step runs in its own
+// transaction together with the removal of its schema_migrations row. It
+// stops at the first migration without a Down script.
+func Rollback(s *SQLite, toVersion int) error {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return err
+	}
+	for {
+		var version int
+		var down string
+		err := s.QueryRow(`SELECT version, down_sql FROM schema_migrations WHERE version > ? ORDER BY version DESC LIMIT 1`, toVersion).Scan(&version, &down)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("list migrations: %w", err)
+		}
+		if strings.TrimSpace(down) == "" {
+			return fmt.Errorf("migration %d has no down script", version)
+		}
+		if err := s.rollbackMigration(version, down); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *SQLite) rollbackMigration(version int, down string) error {
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := tx.ExecScript(down); err != nil {
+		return fmt.Errorf("rollback migration %d: %w", version, err)
+	}
+	if err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, version); err != nil {
+		return fmt.Errorf("rollback migration %d: forget version: %w", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("rollback migration %d: %w", version, err)
+	}
+	log.Printf("db: migration rolled back version=%d sql=%q", version, preview(down))
+	return nil
+}
+
+// CurrentVersion returns the highest applied migration version, 0 when none.
+// It only reads, on the RO pool, and creates nothing, so public endpoints
+// such as /version can call it.
+func (s *SQLite) CurrentVersion() (int, error) {
+	var n int
+	err := s.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	var v int
+	err = s.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+	return v, err
+}
+
+// preview collapses whitespace and truncates sql to previewLen runes.
+func preview(sql string) string {
+	p := []rune(strings.Join(strings.Fields(sql), " "))
+	if len(p) <= previewLen {
+		return string(p)
+	}
+	return string(p[:previewLen]) + "..."
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestMigrateResumesAfterReopen verifies that applied versions survive a
+// reopen and only the new migration runs the second time.
+func TestMigrateResumesAfterReopen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	ms := []Migration{
+		// Neither step is idempotent: re-running would fail or duplicate rows.
+		{Version: 2, Name: "seed", Up: `INSERT INTO t(x) VALUES('a');`},
+		{Version: 1, Name: "create", Up: `CREATE TABLE t(x TEXT);`},
+	}
+
+	s, err := NewWithPath(path)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if err := s.Migrate(ms); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if v, err := s.CurrentVersion(); err != nil || v != 2 {
+		t.Fatalf("expected version 2, got %d err=%v", v, err)
+	}
+	if err := s.Migrate(ms); err != nil {
+		t.Fatalf("re-migrate: %v", err)
+	}
+	s.Close()
+
+	s, err = NewWithPath(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	ms = append(ms, Migration{Version: 3, Name: "more", Up: `INSERT INTO t(x) VALUES('b');`})
+	pending, err := s.Pending(ms)
+	if err != nil {
+		t.Fatalf("pending: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Version != 3 {
+		t.Fatalf("expected only version 3 pending, got %+v", pending)
+	}
+	if err := s.Migrate(ms); err != nil {
+		t.Fatalf("migrate after reopen: %v", err)
+	}
+	if v, err := s.CurrentVersion(); err != nil || v != 3 {
+		t.Fatalf("expected version 3, got %d err=%v", v, err)
+	}
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 rows (one per insert migration), got %d", n)
+	}
+}
+
+// TestMigrateRejectsDuplicateVersion verifies that two migrations sharing a
+// version are refused before anything runs.
+func TestMigrateRejectsDuplicateVersion(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	err = s.Migrate([]Migration{
+		{Version: 1, Up: `CREATE TABLE a(x);`},
+		{Version: 1, Up: `CREATE TABLE b(x);`},
+	})
+	if err == nil {
+		t.Fatalf("expected duplicate version error")
+	}
+	if v, _ := s.CurrentVersion(); v != 0 {
+		t.Fatalf("expected nothing applied, got version %d", v)
+	}
+}
+
+// TestRollback verifies rolling back runs the recorded down scripts newest
+// first, removing the tables their up scripts created.
+func TestRollback(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	ms := []Migration{
+		{Version: 1, Name: "a", Up: `CREATE TABLE a(x);`, Down: `DROP TABLE a;`},
+		{Version: 2, Name: "b", Up: `CREATE TABLE b(x);`, Down: `DROP TABLE b;`},
+		{Version: 3, Name: "c", Up: `CREATE TABLE c(x);`},
+	}
+	if err := s.Migrate(ms); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := Rollback(s, 1); err == nil {
+		t.Fatalf("expected an error for a migration without a down script")
+	}
+	if v, _ := s.CurrentVersion(); v != 3 {
+		t.Fatalf("expected nothing rolled back, got version %d", v)
+	}
+
+	if err := s.Exec(`DELETE FROM schema_migrations WHERE version = 3`); err != nil {
+		t.Fatalf("forget 3: %v", err)
+	}
+	if err := Rollback(s, 1); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if v, _ := s.CurrentVersion(); v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	tableExists := func(name string) bool {
+		var n int
+		if err := s.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+			t.Fatalf("lookup %s: %v", name, err)
+		}
+		return n == 1
+	}
+	if tableExists("b") || !tableExists("a") {
+		t.Fatalf("expected b dropped and a kept")
+	}
+
+	// Re-applying brings the rolled back step back.
+	if err := s.Migrate(ms[:2]); err != nil {
+		t.Fatalf("re-migrate: %v", err)
+	}
+	if !tableExists("b") {
+		t.Fatalf("expected b recreated")
+	}
+}
+
+// TestCurrentVersionReadOnly verifies CurrentVersion reports 0 on a fresh
+// database without creating schema_migrations.
+func TestCurrentVersionReadOnly(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if v, err := s.CurrentVersion(); err != nil || v != 0 {
+		t.Fatalf("expected version 0, got %d err=%v", v, err)
+	}
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'schema_migrations'`).Scan(&n); err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected CurrentVersion not to create schema_migrations")
+	}
+}
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"edev/utils"
+)
+
+// QueryAll runs a SELECT on the RO pool and appends one element per row to
+// dest, which must point to a slice of structs (or of struct pointers).
+// Columns map to fields by a `db:"col"` tag, or else by the lower-cased field
+// name; a `db:"-"` field is skipped. A column with no matching field is an
+// error. Pointer fields receive nil for NULL; other fields get their zero
+// value. dest is reset to an empty slice before scanning.
+func (s *SQLite) QueryAll(dest any, query string, args ...any) error {
+	if s == nil || s.ro == nil {
+		return errors.New("db not initialized")
+	}
+	sv := reflect.ValueOf(dest)
+	if sv.Kind() != reflect.Pointer || sv.IsNil() || sv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("QueryAll: dest must be a pointer to a slice, got %T", dest)
+	}
+	slice := sv.Elem()
+	elemType := slice.Type().Elem()
+	structType, ptrElems := elemType, false
+	if structType.Kind() == reflect.Pointer {
+		structType, ptrElems = structType.Elem(), true
+	}
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("QueryAll: dest elements must be structs, got %s", elemType)
+	}
+	if s.readPoolExhausted() {
+		return ErrPoolExhausted
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultReadOpTimeout)
+	defer cancel()
+	rows, err := s.ro.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer utils.Closer(rows)
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fields := structFields(structType)
+	idx := make([][]int, len(cols))
+	for i, c := range cols {
+		f, ok := fields[strings.ToLower(c)]
+		if !ok {
+			return fmt.Errorf("QueryAll: column %q has no matching field in %s", c, structType)
+		}
+		idx[i] = f
+	}
+
+	out := reflect.MakeSlice(slice.Type(), 0, 0)
+	vals := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		elem := reflect.New(structType).Elem()
+		for i, v := range vals {
+			if err := assign(elem.FieldByIndex(idx[i]), v); err != nil {
+				return fmt.Errorf("QueryAll: column %q: %w", cols[i], err)
+			}
+		}
+		if ptrElems {
+			elem = elem.Addr()
+		}
+		out = reflect.Append(out, elem)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	slice.Set(out)
+	return nil
+}
+
+// structFields maps lower-cased column names to exported field indexes.
+func structFields(t reflect.Type) map[string][]int {
+	m := make(map[string][]int, t.NumField())
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		if tag, ok := f.Tag.Lookup("db"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = strings.ToLower(tag)
+		}
+		m[name] = f.Index
+	}
+	return m
+}
+
+var (
+	timeType    = reflect.TypeFor[time.Time]()
+	scannerType = reflect.TypeFor[sql.Scanner]()
+)
+
+// timeLayouts are the text forms SQLite commonly stores timestamps in.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// assign stores the driver value v into f, converting between the types the
+// SQLite driver returns (int64, float64, string, []byte, time.Time, nil) and
+// the field's type.
+func assign(f reflect.Value, v any) error {
+	if f.Addr().Type().Implements(scannerType) {
+		return f.Addr().Interface().(sql.Scanner).Scan(v)
+	}
+	if f.Kind() == reflect.Pointer {
+		if v == nil {
+			f.SetZero()
+			return nil
+		}
+		p := reflect.New(f.Type().Elem())
+		if err := assign(p.Elem(), v); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	}
+	if v == nil {
+		f.SetZero()
+		return nil
+	}
+
+	if f.Type() == timeType {
+		t, err := toTime(v)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		switch x := v.(type) {
+		case string:
+			f.SetString(x)
+			return nil
+		case []byte:
+			f.SetString(string(x))
+			return nil
+		}
+	case reflect.Bool:
+		switch x := v.(type) {
+		case bool:
+			f.SetBool(x)
+			return nil
+		case int64:
+			f.SetBool(x != 0)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if x, ok := v.(int64); ok {
+			if f.OverflowInt(x) {
+				return fmt.Errorf("value %d overflows %s", x, f.Type())
+			}
+			f.SetInt(x)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch x := v.(type) {
+		case float64:
+			f.SetFloat(x)
+			return nil
+		case int64:
+			f.SetFloat(float64(x))
+			return nil
+		}
+	case reflect.Slice:
+		if b, ok := v.([]byte); ok && f.Type().Elem().Kind() == reflect.Uint8 {
+			f.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot store %T into %s", v, f.Type())
+}
+
+// toTime converts a driver value to time.Time: native times, text in one of
+// timeLayouts, or Unix seconds.
+func toTime(v any) (time.Time, error) {
+	switch x := v.(type) {
+	case time.Time:
+		return x, nil
+	case int64:
+		return time.Unix(x, 0).UTC(), nil
+	case []byte:
+		v = string(x)
+	}
+	if s, ok := v.(string); ok {
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("cannot parse %q as time", s)
+	}
+	return time.Time{}, fmt.Errorf("cannot store %T into time.Time", v)
+}
+
+// ForEach runs a SELECT on the RO pool and calls fn once per row with a scan
+// function for that row, so large results are processed without building a
+// slice. An error from fn stops the iteration and is returned as is. The
+// rows are closed before ForEach returns. fn must not query an in-memory
+// database itself: its single connection is busy with the iteration.
+//
+// Unlike the other reads ForEach has no timeout, since the time spent in fn
+// is part of the iteration: it runs until the rows are exhausted or fn
+// fails. Use ForEachContext to bound it.
+func (s *SQLite) ForEach(query string, args []any, fn func(scan func(dest ...any) error) error) error {
+	return s.ForEachContext(context.Background(), query, args, fn)
+}
+
+// ForEachContext is ForEach bound to ctx: the query and the whole iteration
+// stop when ctx is done. No default timeout is added.
+func (s *SQLite) ForEachContext(ctx context.Context, query string, args []any, fn func(scan func(dest ...any) error) error) error {
+	if s == nil || s.ro == nil {
+		return errors.New("db not initialized")
+	}
+	if s.readPoolExhausted() {
+		return ErrPoolExhausted
+	}
+	rows, err := s.ro.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer utils.Closer(rows)
+
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type scanItem struct {
+	ID      int64
+	Title   string `db:"name"`
+	Done    bool
+	Due     *time.Time
+	Note    *string
+	Ignored string `db:"-"`
+}
+
+// TestQueryAll verifies rows map into a slice of structs by tag or field
+// name, with NULLs left as nil pointers.
+func TestQueryAll(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	err = s.ExecScript(`
+		CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT NOT NULL, done INTEGER NOT NULL, due DATETIME, note TEXT);
+		INSERT INTO items(id, name, done, due, note) VALUES
+			(1, 'write', 0, '2026-01-02 03:04:05', 'draft'),
+			(2, 'ship', 1, NULL, NULL);
+	`)
+	if err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	var items []scanItem
+	if err := s.QueryAll(&items, `SELECT id, name, done FROM items ORDER BY id`); err != nil {
+		t.Fatalf("query all: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	if items[0].ID != 1 || items[0].Title != "write" || items[0].Done {
+		t.Fatalf("unexpected first item %+v", items[0])
+	}
+	if items[1].ID != 2 || items[1].Title != "ship" || !items[1].Done {
+		t.Fatalf("unexpected second item %+v", items[1])
+	}
+
+	var ptrs []*scanItem
+	if err := s.QueryAll(&ptrs, `SELECT id, due, note FROM items ORDER BY id`); err != nil {
+		t.Fatalf("query all nullable: %v", err)
+	}
+	want := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if ptrs[0].Due == nil || !ptrs[0].Due.Equal(want) || ptrs[0].Note == nil || *ptrs[0].Note != "draft" {
+		t.Fatalf("unexpected nullable fields %+v", ptrs[0])
+	}
+	if ptrs[1].Due != nil || ptrs[1].Note != nil {
+		t.Fatalf("expected NULLs as nil pointers, got %+v", ptrs[1])
+	}
+}
+
+// TestQueryAllEmptyAndErrors verifies an empty result resets dest to an empty
+// slice, and that unmatched columns and bad destinations are reported.
+func TestQueryAllEmptyAndErrors(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE items(id INTEGER, name TEXT, done INTEGER, extra TEXT)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	items := []scanItem{{ID: 9}}
+	if err := s.QueryAll(&items, `SELECT id, name, done FROM items`); err != nil {
+		t.Fatalf("query all: %v", err)
+	}
+	if items == nil || len(items) != 0 {
+		t.Fatalf("expected an empty, non-nil slice, got %#v", items)
+	}
+
+	err = s.QueryAll(&items, `SELECT id, extra FROM items`)
+	if err == nil || !strings.Contains(err.Error(), `"extra"`) {
+		t.Fatalf("expected unmatched column error, got %v", err)
+	}
+	if err := s.QueryAll(items, `SELECT id FROM items`); err == nil {
+		t.Fatalf("expected error for a non-pointer destination")
+	}
+}
+
+// TestForEach verifies every row reaches the callback in order, and that a
+// callback error stops the iteration and is returned.
+func TestForEach(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewWithPath(MemoryPath)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Exec(`CREATE TABLE n(v INTEGER NOT NULL, label TEXT NOT NULL)`); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := s.Exec(`INSERT INTO n(v, label) VALUES(?, ?)`, i, "n"); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	sum, rows := 0, 0
+	err = s.ForEach(`SELECT v, label FROM n WHERE v > ? ORDER BY v`, []any{50}, func(scan func(...any) error) error {
+		var v int
+		var label string
+		if err := scan(&v, &label); err != nil {
+			return err
+		}
+		if label != "n" {
+			t.Errorf("unexpected label %q", label)
+		}
+		sum += v
+		rows++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	if rows != 50 || sum != 3775 {
+		t.Fatalf("expected 50 rows summing to 3775, got %d rows sum %d", rows, sum)
+	}
+
+	stop := errors.New("stop")
+	seen := 0
+	err = s.ForEach(`SELECT v FROM n`, nil, func(scan func(...any) error) error {
+		seen++
+		if seen == 3 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || seen != 3 {
+		t.Fatalf("expected stop after 3 rows, got %d, %v", seen, err)
+	}
+
+	// The rows were closed: the single in-memory connection is free again.
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM n`).Scan(&n); err != nil || n != 100 {
+		t.Fatalf("expected the connection released, got %d, %v", n, err)
+	}
+}
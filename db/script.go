@@ -0,0 +1,125 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExecScript runs a multi-statement SQL script (schema, seed data) inside a
+// single write transaction: either every statement applies or none does.
+// Statements are split on semicolons outside quotes and comments; CREATE
+// TRIGGER bodies are kept whole up to their END.
+func (s *SQLite) ExecScript(script string) error {
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := tx.ExecScript(script); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExecScript runs each statement of script inside the transaction, so
+// callers can combine a script with their own statements atomically.
+func (t *Transaction) ExecScript(script string) error {
+	for i, stmt := range splitScript(script) {
+		if err := t.Exec(stmt); err != nil {
+			return fmt.Errorf("statement %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// splitScript splits script into statements without the trailing semicolon.
+// Empty statements (and comment-only ones) are dropped.
+func splitScript(script string) []string {
+	var (
+		out  []string
+		cur  strings.Builder
+		code strings.Builder // cur without comments, to tell empty statements apart
+	)
+	flush := func() {
+		if strings.TrimSpace(code.String()) != "" {
+			out = append(out, strings.TrimSpace(cur.String()))
+		}
+		cur.Reset()
+		code.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := i + 1
+			for j < len(script) {
+				if script[j] == end {
+					// doubled quote is an escaped quote
+					if end != ']' && j+1 < len(script) && script[j+1] == end {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j >= len(script) {
+				j = len(script) - 1
+			}
+			cur.WriteString(script[i : j+1])
+			code.WriteString(script[i : j+1])
+			i = j
+		case c == '-' && i+1 < len(script) && script[i+1] == '-':
+			j := strings.IndexByte(script[i:], '\n')
+			if j < 0 {
+				j = len(script) - i - 1
+			}
+			cur.WriteString(script[i : i+j+1])
+			i += j
+		case c == '/' && i+1 < len(script) && script[i+1] == '*':
+			j := strings.Index(script[i+2:], "*/")
+			if j < 0 {
+				j = len(script) - i - 2
+			} else {
+				j += 2
+			}
+			cur.WriteString(script[i : i+2+j])
+			i += 1 + j
+		case c == ';':
+			if inTrigger(code.String()) {
+				cur.WriteByte(c)
+				code.WriteByte(c)
+				continue
+			}
+			flush()
+		default:
+			cur.WriteByte(c)
+			code.WriteByte(c)
+		}
+	}
+	flush()
+	return out
+}
+
+// inTrigger reports whether stmt is a CREATE TRIGGER whose body has not
+// reached its closing END yet.
+func inTrigger(stmt string) bool {
+	f := strings.Fields(strings.ToUpper(stmt))
+	if len(f) < 2 || f[0] != "CREATE" {
+		return false
+	}
+	k := 1
+	if f[k] == "TEMP" || f[k] == "TEMPORARY" {
+		k++
+	}
+	if k >= len(f) || f[k] != "TRIGGER" {
+		return false
+	}
+	return f[len(f)-1] != "END"
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+
+	"edev/config"
+	"edev/db"
+)
+
+// serverError answers 500 with msg. In DevMode the body also carries err and
+// the stack of the failing handler, so local debugging does not require
+// digging through the logs; production only ever sees msg. An exhausted read
+// pool is overload, not a bug: it gets 503 with Retry-After instead.
+func serverError(w http.ResponseWriter, msg string, err error) {
+	if errors.Is(err, db.ErrPoolExhausted) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "service busy, try again", http.StatusServiceUnavailable)
+		return
+	}
+	if !config.Cfg.DevMode || err == nil {
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, msg+": "+err.Error()+"\n\n"+string(debug.Stack()), http.StatusInternalServerError)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"edev/config"
+	"edev/db"
+)
+
+// TestServerErrorDevMode verifies dev mode exposes the error and stack while
+// production keeps the generic message.
+func TestServerErrorDevMode(t *testing.T) {
+	prev := config.Cfg.DevMode
+	defer func() { config.Cfg.DevMode = prev }()
+	cause := errors.New("no such table: users")
+
+	config.Cfg.DevMode = false
+	rec := httptest.NewRecorder()
+	serverError(rec, "failed to save user", cause)
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "failed to save user\n" {
+		t.Fatalf("production: unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	config.Cfg.DevMode = true
+	rec = httptest.NewRecorder()
+	serverError(rec, "failed to save user", cause)
+	body := rec.Body.String()
+	if rec.Code != http.StatusInternalServerError ||
+		!strings.Contains(body, "failed to save user: no such table: users") ||
+		!strings.Contains(body, "TestServerErrorDevMode") {
+		t.Fatalf("dev mode: expected detail and stack, got %q", body)
+	}
+}
+
+// TestServerErrorPoolExhausted verifies an exhausted read pool answers 503
+// with Retry-After rather than 500.
+func TestServerErrorPoolExhausted(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serverError(rec, "failed to load user", fmt.Errorf("load: %w", db.ErrPoolExhausted))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %v", rec.Code, rec.Header())
+	}
+}
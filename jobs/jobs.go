@@ -0,0 +1,93 @@
+// Package jobs runs periodic background tasks (cleanups, checkpoints) on
+// tickers. A failing or panicking run is logged and the job keeps its
+// schedule; Stop cancels every job and waits for running ones to return.
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"edev/log"
+)
+
+// DefaultInterval is used when a job is registered with interval <= 0.
+const DefaultInterval = 5 * time.Minute
+
+// Scheduler owns a set of jobs sharing one cancellation context.
+type Scheduler struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a Scheduler whose jobs stop when ctx is canceled or Stop is
+// called.
+func New(ctx context.Context) *Scheduler {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Scheduler{ctx: ctx, cancel: cancel}
+}
+
+// Option tunes a job registered with Every.
+type Option func(*jobOptions)
+
+type jobOptions struct {
+	runOnStop bool
+}
+
+// RunOnStop makes the job run once more when the scheduler stops, so a
+// cleanup job leaves nothing behind on shutdown. That last run gets a context
+// that is not canceled.
+func RunOnStop() Option {
+	return func(o *jobOptions) { o.runOnStop = true }
+}
+
+// Every starts fn on a ticker of interval. The first run happens one interval
+// after registration. fn receives the scheduler context and should return
+// promptly once it is canceled.
+func (s *Scheduler) Every(name string, interval time.Duration, fn func(ctx context.Context) error, opts ...Option) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	var o jobOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s.wg.Go(func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				if o.runOnStop {
+					run(context.WithoutCancel(s.ctx), name, fn)
+				}
+				return
+			case <-t.C:
+				run(s.ctx, name, fn)
+			}
+		}
+	})
+}
+
+// Wait blocks until every job has returned after cancellation.
+func (s *Scheduler) Wait() { s.wg.Wait() }
+
+// Stop cancels all jobs and waits for them to return, including the final
+// runs of jobs registered with RunOnStop.
+func (s *Scheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// run executes one pass of fn, logging its error or panic.
+func run(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Errorf("job %s panicked: %v", name, rec)
+		}
+	}()
+	if err := fn(ctx); err != nil {
+		log.Errorf("job %s: %v", name, err)
+	}
+}
@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestEveryRunsAndStops verifies a job runs at its interval, survives errors
+// and panics, and stops once the context is canceled.
+func TestEveryRunsAndStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := New(ctx)
+
+	var calls atomic.Int32
+	s.Every("tick", 5*time.Millisecond, func(context.Context) error {
+		switch calls.Add(1) {
+		case 1:
+			return errors.New("boom")
+		case 2:
+			panic("boom")
+		}
+		return nil
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := calls.Load(); n < 3 {
+		t.Fatalf("expected at least 3 runs, got %d", n)
+	}
+
+	cancel()
+	s.Wait()
+	n := calls.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := calls.Load(); got != n {
+		t.Fatalf("expected no runs after cancel, got %d more", got-n)
+	}
+}
+
+// TestRunOnStop verifies a job registered with RunOnStop runs once more on
+// Stop with a live context, while other jobs do not.
+func TestRunOnStop(t *testing.T) {
+	s := New(context.Background())
+	var final, plain atomic.Int32
+	s.Every("final", time.Hour, func(ctx context.Context) error {
+		if ctx.Err() != nil {
+			t.Errorf("expected a live context on the final run, got %v", ctx.Err())
+		}
+		final.Add(1)
+		return nil
+	}, RunOnStop())
+	s.Every("plain", time.Hour, func(context.Context) error {
+		plain.Add(1)
+		return nil
+	})
+	s.Stop()
+
+	if n := final.Load(); n != 1 {
+		t.Fatalf("expected 1 final run, got %d", n)
+	}
+	if n := plain.Load(); n != 0 {
+		t.Fatalf("expected no run for a plain job, got %d", n)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"edev/config"
+	"edev/log"
+	"edev/metrics"
+)
+
+// inflightLimiter caps concurrent requests per client IP. Unlike a rate
+// limiter it only counts requests still being served, so a slow provider
+// can't be hit by a burst of callbacks from one client.
+type inflightLimiter struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+var callbackLimiter = &inflightLimiter{m: make(map[string]int)}
+
+var callbacksLimited = metrics.NewCounter("edev_callbacks_limited_total", "Provider callbacks refused by CallbackMaxInflight.")
+
+// acquire reserves a slot for ip when fewer than max are in flight.
+func (l *inflightLimiter) acquire(ip string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m[ip] >= max {
+		return false
+	}
+	l.m[ip]++
+	return true
+}
+
+func (l *inflightLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m[ip]--; l.m[ip] <= 0 {
+		delete(l.m, ip)
+	}
+}
+
+// limitCallbacks lets at most CallbackMaxInflight provider callbacks per
+// client IP run at once; the rest get 429. 0 disables the guard. The IP comes
+// from clientIP, so X-Forwarded-For only counts behind a trusted proxy.
+func limitCallbacks(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		max := config.Cfg.CallbackMaxInflight
+		if max <= 0 {
+			next(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if !callbackLimiter.acquire(ip, max) {
+			log.Warnf("callback limit reached ip=%s max=%d", ip, max)
+			callbacksLimited.Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent logins, please try again", http.StatusTooManyRequests)
+			return
+		}
+		defer callbackLimiter.release(ip)
+		next(w, r)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"edev/config"
+)
+
+// TestLimitCallbacksPerIP verifies that with N callbacks from one IP in
+// flight the next one gets 429, even when it claims another address in
+// X-Forwarded-For, and is counted, while another IP and a later request from
+// the same IP still get through.
+func TestLimitCallbacksPerIP(t *testing.T) {
+	const n = 3
+	prev, prevTrust := config.Cfg.CallbackMaxInflight, config.Cfg.TrustProxy
+	config.Cfg.CallbackMaxInflight = n
+	config.Cfg.TrustProxy = false
+	defer func() { config.Cfg.CallbackMaxInflight, config.Cfg.TrustProxy = prev, prevTrust }()
+
+	entered := make(chan struct{}, n)
+	release := make(chan struct{})
+	h := limitCallbacks(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusFound)
+	})
+	call := func(ip, query string, xff ...string) int {
+		req := httptest.NewRequest(http.MethodGet, "/callback"+query, nil)
+		req.RemoteAddr = ip + ":1234"
+		for _, v := range xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() { call("203.0.113.7", "?block=1") })
+	}
+	for range n {
+		<-entered
+	}
+
+	limited := callbacksLimited.Value()
+	if code := call("203.0.113.7", ""); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 for call %d, got %d", n+1, code)
+	}
+	if got := callbacksLimited.Value(); got != limited+1 {
+		t.Fatalf("expected the refusal counted, got %d after %d", got, limited)
+	}
+	if code := call("203.0.113.7", "", "198.51.100.9"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected spoofed X-Forwarded-For to still get 429, got %d", code)
+	}
+	if code := call("198.51.100.2", ""); code != http.StatusFound {
+		t.Fatalf("expected another IP to pass, got %d", code)
+	}
+
+	close(release)
+	wg.Wait()
+	if code := call("203.0.113.7", ""); code != http.StatusFound {
+		t.Fatalf("expected slots freed after the callbacks finished, got %d", code)
+	}
+}
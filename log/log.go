@@ -1,12 +1,17 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	stdlog "log"
+	"maps"
 	"os"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,13 +20,56 @@ import (
 
 type Level int32
 
+// LevelTrace sits below LevelDebug for very verbose tracing; it keeps
+// LevelDebug at zero so existing numeric levels are unchanged.
 const (
-	LevelDebug Level = iota
+	LevelTrace Level = iota - 1
+	LevelDebug
 	LevelInfo
 	LevelWarn
 	LevelError
 )
 
+func (lv Level) String() string {
+	switch lv {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + itoa(int(lv)) + ")"
+}
+
+// Format selects how lines are rendered.
+type Format int32
+
+const (
+	// FormatText is the default human-readable line, colorized on a terminal.
+	FormatText Format = iota
+	// FormatJSON writes one JSON object per line for log pipelines; never
+	// colorized.
+	FormatJSON
+)
+
+// ColorMode selects when text output is colorized.
+type ColorMode int32
+
+const (
+	// ColorAuto colorizes when stdout is a terminal.
+	ColorAuto ColorMode = iota
+	// ColorAlways colorizes even when writing to a pipe or file.
+	ColorAlways
+	// ColorNever never colorizes, e.g. under a PTY wrapper that ends up in a
+	// file. A non-empty NO_COLOR environment variable selects it at startup.
+	ColorNever
+)
+
 const (
 	colorReset  = "\033[0m"
 	colorCyan   = "\033[36m" // timestamp
@@ -36,13 +84,48 @@ var (
 	defaultLogger = newConfigured(nil)
 )
 
+// Logger writes leveled lines. Children made by With share the parent's
+// output and settings and add their own fields.
 type Logger struct {
+	*core
+	fields []field // sorted by key
+}
+
+type core struct {
 	out        *stdlog.Logger
 	level      atomic.Int32
 	useUTC     atomic.Bool
 	timeLayout atomic.Value
 	prefix     atomic.Value
 	flags      atomic.Int32
+	format     atomic.Int32
+	color      atomic.Int32
+	noCaller   atomic.Bool // zero value keeps the caller decoration on
+
+	// prefixLevels overrides the level for messages starting with a given
+	// prefix; longest prefix first. Replaced wholesale on every change.
+	prefixLevels atomic.Pointer[[]prefixLevel]
+	prefixMu     sync.Mutex
+
+	// levelOuts sends lines at or above a level elsewhere than out; highest
+	// level first. Replaced wholesale on every change.
+	levelOuts atomic.Pointer[[]levelOut]
+	levelMu   sync.Mutex
+}
+
+type levelOut struct {
+	level Level
+	out   *stdlog.Logger
+}
+
+type field struct {
+	key   string
+	value any
+}
+
+type prefixLevel struct {
+	prefix string
+	level  Level
 }
 
 func init() {
@@ -53,13 +136,16 @@ func newConfigured(w io.Writer) *Logger {
 	if w == nil {
 		w = stdlog.Default().Writer()
 	}
-	l := &Logger{out: stdlog.New(w, "", 0)}
+	l := &Logger{core: &core{out: stdlog.New(w, "", 0)}}
 	// Defaults: zero-config
 	l.level.Store(int32(LevelDebug))
 	l.useUTC.Store(true)
 	l.timeLayout.Store("2006/01/02 15:04:05")
 	l.prefix.Store("")
 	l.flags.Store(0)
+	if os.Getenv("NO_COLOR") != "" {
+		l.color.Store(int32(ColorNever))
+	}
 	return l
 }
 
@@ -77,12 +163,121 @@ func (l *Logger) SetFlags(flag int)    { l.flags.Store(int32(flag)) }
 func (l *Logger) Flags() int           { return int(l.flags.Load()) }
 func (l *Logger) SetLevel(level Level) { l.level.Store(int32(level)) }
 func (l *Logger) SetUTC(enable bool)   { l.useUTC.Store(enable) }
+func (l *Logger) SetFormat(f Format)   { l.format.Store(int32(f)) }
+func (l *Logger) SetColor(m ColorMode) { l.color.Store(int32(m)) }
+
+// SetCaller turns the file, line and function segments on or off. Off skips
+// the runtime.Callers lookup on every line.
+func (l *Logger) SetCaller(enable bool) { l.noCaller.Store(!enable) }
 func (l *Logger) SetTimeLayout(layout string) {
 	if layout != "" {
 		l.timeLayout.Store(layout)
 	}
 }
 
+// SetLevelOutput writes lines at level and above to w instead of the main
+// output, e.g. SetLevelOutput(LevelWarn, os.Stderr). With several overrides
+// the one with the highest level not above the line's level wins. A nil w
+// removes the override for level.
+func (l *Logger) SetLevelOutput(level Level, w io.Writer) {
+	l.levelMu.Lock()
+	defer l.levelMu.Unlock()
+	var next []levelOut
+	if p := l.levelOuts.Load(); p != nil {
+		next = slices.DeleteFunc(slices.Clone(*p), func(o levelOut) bool { return o.level == level })
+	}
+	if w != nil {
+		next = append(next, levelOut{level: level, out: stdlog.New(w, "", 0)})
+	}
+	slices.SortFunc(next, func(a, b levelOut) int { return int(b.level) - int(a.level) })
+	l.levelOuts.Store(&next)
+}
+
+// writer picks the destination for a line at lv.
+func (l *Logger) writer(lv Level) *stdlog.Logger {
+	if p := l.levelOuts.Load(); p != nil {
+		for _, o := range *p {
+			if lv >= o.level {
+				return o.out
+			}
+		}
+	}
+	return l.out
+}
+
+// With returns a child logger that appends fields to every line: as
+// key=value pairs in text mode, under "fields" in JSON mode. A key already on
+// l is overridden. The child shares l's output, level and format, so setting
+// them on either affects both; l itself is unchanged.
+func (l *Logger) With(fields map[string]any) *Logger {
+	merged := make(map[string]any, len(l.fields)+len(fields))
+	for _, f := range l.fields {
+		merged[f.key] = f.value
+	}
+	maps.Copy(merged, fields)
+	child := &Logger{core: l.core, fields: make([]field, 0, len(merged))}
+	for _, k := range slices.Sorted(maps.Keys(merged)) {
+		child.fields = append(child.fields, field{key: k, value: merged[k]})
+	}
+	return child
+}
+
+func (l *Logger) Trace(v ...any)                 { l.outputf(LevelTrace, 3, "%s", fmt.Sprint(v...)) }
+func (l *Logger) Tracef(format string, v ...any) { l.outputf(LevelTrace, 3, format, v...) }
+func (l *Logger) Debug(v ...any)                 { l.outputf(LevelDebug, 3, "%s", fmt.Sprint(v...)) }
+func (l *Logger) Debugf(format string, v ...any) { l.outputf(LevelDebug, 3, format, v...) }
+func (l *Logger) Info(v ...any)                  { l.outputf(LevelInfo, 3, "%s", fmt.Sprint(v...)) }
+func (l *Logger) Infof(format string, v ...any)  { l.outputf(LevelInfo, 3, format, v...) }
+func (l *Logger) Warn(v ...any)                  { l.outputf(LevelWarn, 3, "%s", fmt.Sprint(v...)) }
+func (l *Logger) Warnf(format string, v ...any)  { l.outputf(LevelWarn, 3, format, v...) }
+func (l *Logger) Error(v ...any)                 { l.outputf(LevelError, 3, "%s", fmt.Sprint(v...)) }
+func (l *Logger) Errorf(format string, v ...any) { l.outputf(LevelError, 3, format, v...) }
+
+// SetPrefixLevel sets the minimum level for messages that start with prefix
+// (e.g. "db:"), overriding SetLevel for them; the longest matching prefix
+// wins. Use ClearPrefixLevel to go back to the overall level.
+func (l *Logger) SetPrefixLevel(prefix string, level Level) {
+	l.updatePrefixLevels(func(pls []prefixLevel) []prefixLevel {
+		pls = slices.DeleteFunc(pls, func(p prefixLevel) bool { return p.prefix == prefix })
+		return append(pls, prefixLevel{prefix: prefix, level: level})
+	})
+}
+
+// ClearPrefixLevel removes the override set for prefix.
+func (l *Logger) ClearPrefixLevel(prefix string) {
+	l.updatePrefixLevels(func(pls []prefixLevel) []prefixLevel {
+		return slices.DeleteFunc(pls, func(p prefixLevel) bool { return p.prefix == prefix })
+	})
+}
+
+func (l *Logger) updatePrefixLevels(fn func([]prefixLevel) []prefixLevel) {
+	l.prefixMu.Lock()
+	defer l.prefixMu.Unlock()
+	var cur []prefixLevel
+	if p := l.prefixLevels.Load(); p != nil {
+		cur = slices.Clone(*p)
+	}
+	next := fn(cur)
+	slices.SortFunc(next, func(a, b prefixLevel) int { return len(b.prefix) - len(a.prefix) })
+	l.prefixLevels.Store(&next)
+}
+
+// enabled reports whether a message at lv should be written. msg is only
+// consulted when prefix overrides exist.
+func (l *Logger) enabled(lv Level, msg func() string) bool {
+	p := l.prefixLevels.Load()
+	if p == nil || len(*p) == 0 {
+		return lv >= Level(l.level.Load())
+	}
+	m := msg()
+	for _, pl := range *p {
+		if strings.HasPrefix(m, pl.prefix) {
+			return lv >= pl.level
+		}
+	}
+	return lv >= Level(l.level.Load())
+}
+
 // Wrappers
 func SetOutput(w io.Writer)       { defaultLogger.SetOutput(w) }
 func Writer() io.Writer           { return defaultLogger.Writer() }
@@ -93,6 +288,17 @@ func Flags() int                  { return defaultLogger.Flags() }
 func SetLevel(level Level)        { defaultLogger.SetLevel(level) }
 func SetUTC(enable bool)          { defaultLogger.SetUTC(enable) }
 func SetTimeLayout(layout string) { defaultLogger.SetTimeLayout(layout) }
+func SetFormat(f Format)          { defaultLogger.SetFormat(f) }
+func SetColor(m ColorMode)        { defaultLogger.SetColor(m) }
+func SetCaller(enable bool)       { defaultLogger.SetCaller(enable) }
+
+func SetLevelOutput(level Level, w io.Writer) { defaultLogger.SetLevelOutput(level, w) }
+
+// With returns a child of the default logger; see Logger.With.
+func With(fields map[string]any) *Logger { return defaultLogger.With(fields) }
+
+func SetPrefixLevel(prefix string, level Level) { defaultLogger.SetPrefixLevel(prefix, level) }
+func ClearPrefixLevel(prefix string)            { defaultLogger.ClearPrefixLevel(prefix) }
 
 // API drop-in
 func Print(v ...any)                 { defaultLogger.outputf(LevelInfo, 3, "%s", fmt.Sprint(v...)) }
@@ -101,6 +307,8 @@ func Println(v ...any) {
 	defaultLogger.outputf(LevelInfo, 3, "%s", strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 }
 
+func Trace(v ...any)                 { defaultLogger.outputf(LevelTrace, 3, "%s", fmt.Sprint(v...)) }
+func Tracef(format string, v ...any) { defaultLogger.outputf(LevelTrace, 3, format, v...) }
 func Debug(v ...any)                 { defaultLogger.outputf(LevelDebug, 3, "%s", fmt.Sprint(v...)) }
 func Debugf(format string, v ...any) { defaultLogger.outputf(LevelDebug, 3, format, v...) }
 func Info(v ...any)                  { defaultLogger.outputf(LevelInfo, 3, "%s", fmt.Sprint(v...)) }
@@ -135,35 +343,54 @@ func Output(callDepth int, s string) error {
 	return nil
 }
 
-func colorize(color, text string) string {
-	if isTerminal {
+// useColor resolves the color mode; ColorAuto follows terminal detection.
+func (l *Logger) useColor() bool {
+	switch ColorMode(l.color.Load()) {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	return isTerminal
+}
+
+func colorize(on bool, color, text string) string {
+	if on {
 		return color + text + colorReset
 	}
 	return text
 }
 
-func colorizedTimestamp(ts string) string {
-	return colorize(colorCyan, ts)
+func colorizedTimestamp(on bool, ts string) string {
+	return colorize(on, colorCyan, ts)
 }
 
-func colorizedPath(path string) string {
-	return colorize(colorGreen, path)
+func colorizedPath(on bool, path string) string {
+	return colorize(on, colorGreen, path)
 }
 
-func colorizedLine(line string) string {
-	return colorize(colorYellow, line)
+func colorizedLine(on bool, line string) string {
+	return colorize(on, colorYellow, line)
 }
 
-func colorizedFunction(fn string) string {
-	return colorize(colorBlue, fn)
+func colorizedFunction(on bool, fn string) string {
+	return colorize(on, colorBlue, fn)
 }
 
-func colorizedMessage(msg string) string {
-	return colorize(colorWhite, msg)
+func colorizedMessage(on bool, msg string) string {
+	return colorize(on, colorWhite, msg)
 }
 
 func (l *Logger) outputf(lv Level, callerSkip int, format string, args ...any) {
-	if lv < Level(l.level.Load()) {
+	var msg string
+	formatted := false
+	render := func() string {
+		if !formatted {
+			msg, formatted = fmt.Sprintf(format, args...), true
+		}
+		return msg
+	}
+	if !l.enabled(lv, render) {
 		return
 	}
 	now := time.Now()
@@ -173,14 +400,24 @@ func (l *Logger) outputf(lv Level, callerSkip int, format string, args ...any) {
 	layout, _ := l.timeLayout.Load().(string)
 	ts := now.Format(layout)
 
-	file, line, fn := caller(callerSkip + 1)
-	msg := fmt.Sprintf(format, args...)
+	var (
+		file, fn string
+		line     int
+	)
+	withCaller := !l.noCaller.Load()
+	if withCaller {
+		file, line, fn = caller(callerSkip + 1)
+	}
+	msg = render()
+
+	if Format(l.format.Load()) == FormatJSON {
+		l.writeJSON(lv, ts, file, line, fn, msg)
+		return
+	}
 
-	coloredTs := colorizedTimestamp(ts)
-	coloredPath := colorizedPath(file)
-	coloredLine := colorizedLine(itoa(line))
-	coloredFn := colorizedFunction(fn)
-	coloredMsg := colorizedMessage(msg)
+	color := l.useColor()
+	coloredTs := colorizedTimestamp(color, ts)
+	coloredMsg := colorizedMessage(color, msg)
 
 	var b strings.Builder
 	estimatedSize := len(ts) +
@@ -191,18 +428,67 @@ func (l *Logger) outputf(lv Level, callerSkip int, format string, args ...any) {
 	b.Grow(estimatedSize)
 
 	b.WriteString(coloredTs)
-	b.WriteByte(' ')
-	b.WriteString(coloredPath)
-	b.WriteByte(' ')
-	b.WriteByte('+')
-	b.WriteString(coloredLine)
-	b.WriteByte(' ')
-	b.WriteString(coloredFn)
+	if withCaller {
+		b.WriteByte(' ')
+		b.WriteString(colorizedPath(color, file))
+		b.WriteByte(' ')
+		b.WriteByte('+')
+		b.WriteString(colorizedLine(color, itoa(line)))
+		b.WriteByte(' ')
+		b.WriteString(colorizedFunction(color, fn))
+	}
 	if msg != "" {
 		b.WriteByte(' ')
 		b.WriteString(coloredMsg)
 	}
-	l.out.Println(b.String())
+	for _, f := range l.fields {
+		b.WriteByte(' ')
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(fieldText(f.value))
+	}
+	l.writer(lv).Println(b.String())
+}
+
+// jsonLine fixes the key order of FormatJSON output.
+type jsonLine struct {
+	TS     string         `json:"ts"`
+	Level  string         `json:"level"`
+	File   string         `json:"file,omitempty"` // empty with SetCaller(false)
+	Line   int            `json:"line,omitempty"`
+	Func   string         `json:"func,omitempty"`
+	Msg    string         `json:"msg"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+func (l *Logger) writeJSON(lv Level, ts, file string, line int, fn, msg string) {
+	jl := jsonLine{TS: ts, Level: lv.String(), File: file, Line: line, Func: fn, Msg: msg}
+	if len(l.fields) > 0 {
+		jl.Fields = make(map[string]any, len(l.fields))
+		for _, f := range l.fields {
+			jl.Fields[f.key] = f.value
+		}
+	}
+	b, err := json.Marshal(jl)
+	if err != nil {
+		// A field value JSON can't encode (a func, a channel); keep the line
+		// with the fields as text.
+		for k, v := range jl.Fields {
+			jl.Fields[k] = fmt.Sprint(v)
+		}
+		b, _ = json.Marshal(jl)
+	}
+	l.writer(lv).Println(string(b))
+}
+
+// fieldText renders a field value for text mode, quoting strings that would
+// otherwise be ambiguous in a key=value list.
+func fieldText(v any) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
 }
 
 func caller(skip int) (file string, line int, funcName string) {
@@ -0,0 +1,303 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPrefixLevel verifies a "db:" override at warn drops db debug lines while
+// other info lines still pass at an overall debug level.
+func TestPrefixLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := newConfigured(&buf)
+	l.SetLevel(LevelDebug)
+	l.SetPrefixLevel("db:", LevelWarn)
+
+	l.outputf(LevelDebug, 2, "db: query took %dms", 3)
+	l.outputf(LevelInfo, 2, "request served")
+	l.outputf(LevelWarn, 2, "db: slow query")
+	l.outputf(LevelDebug, 2, "cache miss")
+
+	out := buf.String()
+	if strings.Contains(out, "query took") {
+		t.Fatalf("expected db debug line suppressed, got %q", out)
+	}
+	for _, want := range []string{"request served", "db: slow query", "cache miss"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output, got %q", want, out)
+		}
+	}
+
+	// The longest prefix wins, and an override can also lower the threshold.
+	buf.Reset()
+	l.SetLevel(LevelWarn)
+	l.SetPrefixLevel("db: migration", LevelInfo)
+	l.outputf(LevelInfo, 2, "db: migration applied")
+	l.outputf(LevelInfo, 2, "db: checkpoint")
+	l.outputf(LevelInfo, 2, "request served")
+	out = buf.String()
+	if !strings.Contains(out, "migration applied") || strings.Contains(out, "checkpoint") || strings.Contains(out, "request served") {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	buf.Reset()
+	l.ClearPrefixLevel("db: migration")
+	l.ClearPrefixLevel("db:")
+	l.SetLevel(LevelDebug)
+	l.outputf(LevelDebug, 2, "db: query")
+	if !strings.Contains(buf.String(), "db: query") {
+		t.Fatalf("expected overall level after clearing overrides, got %q", buf.String())
+	}
+}
+
+// TestFormatJSON verifies FormatJSON writes one parseable object per line with
+// the expected fields and no color codes, honoring the time options.
+func TestFormatJSON(t *testing.T) {
+	var buf bytes.Buffer
+	prev := Writer()
+	SetOutput(&buf)
+	SetFormat(FormatJSON)
+	SetTimeLayout(time.RFC3339)
+	defer func() {
+		SetOutput(prev)
+		SetFormat(FormatText)
+		SetTimeLayout("2006/01/02 15:04:05")
+	}()
+
+	Info("user signed in")
+
+	var got struct {
+		TS    string `json:"ts"`
+		Level string `json:"level"`
+		File  string `json:"file"`
+		Line  int    `json:"line"`
+		Func  string `json:"func"`
+		Msg   string `json:"msg"`
+	}
+	out := buf.Bytes()
+	if bytes.Contains(out, []byte("\033[")) {
+		t.Fatalf("expected no color codes, got %q", out)
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("unmarshal %q: %v", out, err)
+	}
+	if got.Level != "info" || got.Msg != "user signed in" {
+		t.Fatalf("unexpected level/msg: %+v", got)
+	}
+	if !strings.HasSuffix(got.File, "log_test.go") || got.Line == 0 {
+		t.Fatalf("unexpected caller: %+v", got)
+	}
+	if !strings.HasSuffix(got.Func, "TestFormatJSON") {
+		t.Fatalf("unexpected func: %q", got.Func)
+	}
+	ts, err := time.Parse(time.RFC3339, got.TS)
+	if err != nil {
+		t.Fatalf("ts %q: %v", got.TS, err)
+	}
+	if _, off := ts.Zone(); off != 0 {
+		t.Fatalf("expected UTC timestamp, got %q", got.TS)
+	}
+}
+
+// TestWith verifies a child logger adds its fields in text and JSON mode,
+// shares the parent's level, and leaves the parent's lines untouched.
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	parent := newConfigured(&buf)
+	child := parent.With(map[string]any{"request_id": "r-1", "note": "two words"})
+	grandchild := child.With(map[string]any{"user": 7, "request_id": "r-2"})
+
+	child.Info("handled")
+	out := buf.String()
+	if !strings.Contains(out, `handled note="two words" request_id=r-1`) {
+		t.Fatalf("expected sorted fields after the message, got %q", out)
+	}
+
+	buf.Reset()
+	parent.Info("plain")
+	if out := buf.String(); strings.Contains(out, "request_id") || !strings.Contains(out, "plain") {
+		t.Fatalf("expected parent without fields, got %q", out)
+	}
+
+	buf.Reset()
+	grandchild.Info("nested")
+	if out := buf.String(); !strings.Contains(out, "request_id=r-2 user=7") {
+		t.Fatalf("expected overridden and added fields, got %q", out)
+	}
+
+	// Settings are shared: a level set on the parent gates the child.
+	buf.Reset()
+	parent.SetLevel(LevelWarn)
+	child.Info("dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("expected child to follow parent level, got %q", buf.String())
+	}
+
+	parent.SetLevel(LevelDebug)
+	parent.SetFormat(FormatJSON)
+	child.Info("as json")
+	var got struct {
+		Msg    string         `json:"msg"`
+		Fields map[string]any `json:"fields"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal %q: %v", buf.String(), err)
+	}
+	if got.Msg != "as json" || got.Fields["request_id"] != "r-1" || got.Fields["note"] != "two words" {
+		t.Fatalf("unexpected json line %+v", got)
+	}
+}
+
+// TestSetColor verifies ColorAlways and ColorNever override terminal
+// detection and ColorAuto follows it.
+func TestSetColor(t *testing.T) {
+	prevTerm := isTerminal
+	defer func() { isTerminal = prevTerm }()
+
+	for _, tc := range []struct {
+		mode     ColorMode
+		terminal bool
+		want     bool
+	}{
+		{ColorAlways, false, true},
+		{ColorNever, true, false},
+		{ColorAuto, true, true},
+		{ColorAuto, false, false},
+	} {
+		var buf bytes.Buffer
+		l := newConfigured(&buf)
+		l.SetColor(tc.mode)
+		isTerminal = tc.terminal
+		l.Info("hello")
+		if got := strings.Contains(buf.String(), "\033["); got != tc.want {
+			t.Fatalf("mode %d terminal=%v: escapes=%v, want %v in %q", tc.mode, tc.terminal, got, tc.want, buf.String())
+		}
+	}
+}
+
+// TestNoColorEnv verifies a non-empty NO_COLOR starts a logger in ColorNever.
+func TestNoColorEnv(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	prevTerm := isTerminal
+	isTerminal = true
+	defer func() { isTerminal = prevTerm }()
+
+	var buf bytes.Buffer
+	l := newConfigured(&buf)
+	l.Info("hello")
+	if strings.Contains(buf.String(), "\033[") {
+		t.Fatalf("expected no escapes with NO_COLOR, got %q", buf.String())
+	}
+}
+
+// TestSetLevelOutput verifies warn and error lines go to their own writer
+// while lower levels keep the main output, and that removing the override
+// restores it.
+func TestSetLevelOutput(t *testing.T) {
+	var out, errOut bytes.Buffer
+	l := newConfigured(&out)
+	l.SetLevelOutput(LevelWarn, &errOut)
+
+	l.Debug("debug line")
+	l.Info("info line")
+	l.Warn("warn line")
+	l.Error("error line")
+
+	for _, want := range []string{"debug line", "info line"} {
+		if !strings.Contains(out.String(), want) || strings.Contains(errOut.String(), want) {
+			t.Fatalf("expected %q only on the main output; out=%q err=%q", want, out.String(), errOut.String())
+		}
+	}
+	for _, want := range []string{"warn line", "error line"} {
+		if !strings.Contains(errOut.String(), want) || strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q only on the level output; out=%q err=%q", want, out.String(), errOut.String())
+		}
+	}
+
+	out.Reset()
+	errOut.Reset()
+	l.SetLevelOutput(LevelWarn, nil)
+	l.Error("back to main")
+	if !strings.Contains(out.String(), "back to main") || errOut.Len() != 0 {
+		t.Fatalf("expected main output after removing override; out=%q err=%q", out.String(), errOut.String())
+	}
+}
+
+// TestTraceLevel verifies each threshold lets through exactly its level and
+// the ones above it, with trace only at LevelTrace.
+func TestTraceLevel(t *testing.T) {
+	levels := []Level{LevelTrace, LevelDebug, LevelInfo, LevelWarn, LevelError}
+	for _, threshold := range levels {
+		var buf bytes.Buffer
+		l := newConfigured(&buf)
+		l.SetLevel(threshold)
+		l.Trace("at-trace")
+		l.Debug("at-debug")
+		l.Info("at-info")
+		l.Warn("at-warn")
+		l.Error("at-error")
+		for _, lv := range levels {
+			want := lv >= threshold
+			if got := strings.Contains(buf.String(), "at-"+lv.String()); got != want {
+				t.Fatalf("threshold %s: %s line present=%v, want %v", threshold, lv, got, want)
+			}
+		}
+	}
+}
+
+// TestSetCaller verifies disabling the caller drops the file, line and
+// function segments in text and JSON mode.
+func TestSetCaller(t *testing.T) {
+	var buf bytes.Buffer
+	l := newConfigured(&buf)
+	l.SetColor(ColorNever)
+
+	l.Info("with caller")
+	if out := buf.String(); !strings.Contains(out, "log_test.go +") || !strings.Contains(out, "TestSetCaller") {
+		t.Fatalf("expected caller decoration by default, got %q", out)
+	}
+
+	buf.Reset()
+	l.SetCaller(false)
+	l.Info("without caller")
+	out := buf.String()
+	if strings.Contains(out, "log_test.go") || strings.Contains(out, "TestSetCaller") {
+		t.Fatalf("expected no caller decoration, got %q", out)
+	}
+	ts, msg, ok := strings.Cut(strings.TrimSuffix(out, "\n"), " without caller")
+	if !ok || msg != "" || strings.Count(ts, " ") != 1 {
+		t.Fatalf("expected \"<date> <time> <msg>\", got %q", out)
+	}
+
+	buf.Reset()
+	l.SetFormat(FormatJSON)
+	l.Info("json")
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal %q: %v", buf.String(), err)
+	}
+	for _, k := range []string{"file", "line", "func"} {
+		if _, ok := got[k]; ok {
+			t.Fatalf("expected no %q key, got %v", k, got)
+		}
+	}
+}
+
+// BenchmarkCaller compares a line with and without the runtime.Callers lookup.
+func BenchmarkCaller(b *testing.B) {
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("enabled=%v", enabled), func(b *testing.B) {
+			l := newConfigured(io.Discard)
+			l.SetCaller(enabled)
+			b.ReportAllocs()
+			for b.Loop() {
+				l.Info("request served")
+			}
+		})
+	}
+}
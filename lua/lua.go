@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -17,6 +18,7 @@ type Lua struct {
 var (
 	ErrorFunctionNotFound = errors.New("function not found")
 	ErrorNotAllowedType   = errors.New("not allowed return type")
+	ErrorTimeout          = errors.New("script timed out")
 )
 
 func (l *Lua) fromGoToLua(v any) lua.LValue {
@@ -73,7 +75,15 @@ func (l *Lua) fromGoToLua(v any) lua.LValue {
 	}
 }
 
+// fromLuaToGo converts v and, recursively, the contents of tables. A table
+// whose keys are exactly 1..n becomes []any, any other table map[string]any;
+// tables mixing in non-string keys, or containing themselves, are rejected
+// with ErrorNotAllowedType.
 func fromLuaToGo(v lua.LValue) (any, error) {
+	return luaValueToGo(v, make(map[*lua.LTable]bool))
+}
+
+func luaValueToGo(v lua.LValue, seen map[*lua.LTable]bool) (any, error) {
 	switch v.Type() {
 	case lua.LTNil:
 		return nil, nil
@@ -84,17 +94,52 @@ func fromLuaToGo(v lua.LValue) (any, error) {
 	case lua.LTBool:
 		return bool(v.(lua.LBool)), nil
 	case lua.LTTable:
-		m := make(map[string]any)
-		t := v.(*lua.LTable)
-		t.ForEach(func(k, v lua.LValue) {
-			m[string(k.(lua.LString))] = v
-		})
-		return m, nil
+		return luaTableToGo(v.(*lua.LTable), seen)
 	default:
 		return nil, ErrorNotAllowedType
 	}
 }
 
+func luaTableToGo(t *lua.LTable, seen map[*lua.LTable]bool) (any, error) {
+	if seen[t] {
+		return nil, fmt.Errorf("%w: recursive table", ErrorNotAllowedType)
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	n, keys := t.MaxN(), 0
+	t.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+	if n > 0 && n == keys {
+		s := make([]any, n)
+		for i := range n {
+			v, err := luaValueToGo(t.RawGetInt(i+1), seen)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = v
+		}
+		return s, nil
+	}
+
+	m := make(map[string]any, keys)
+	var err error
+	t.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		ks, ok := k.(lua.LString)
+		if !ok {
+			err = fmt.Errorf("%w: table key %s", ErrorNotAllowedType, k.Type())
+			return
+		}
+		m[string(ks)], err = luaValueToGo(v, seen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (l *Lua) mapToLuaTable(m map[string]any) *lua.LTable {
 	table := l.ls.NewTable()
 	for k, v := range m {
@@ -122,12 +167,45 @@ func (l *Lua) mapToLuaTable(m map[string]any) *lua.LTable {
 	return table
 }
 
+// New opens the full gopher-lua standard library plus a preloaded math
+// module; init.lua relies on os.getenv. See NewSandboxed for untrusted input.
 func New() *Lua {
 	ls := lua.NewState()
 	ls.PreloadModule("math", lua.OpenMath)
 	return &Lua{ls: ls}
 }
 
+// sandboxLibs are the only libraries NewSandboxed opens.
+var sandboxLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// sandboxRemoved are base library globals that reach the filesystem or the
+// module loader.
+var sandboxRemoved = []string{"dofile", "loadfile", "require", "module"}
+
+// NewSandboxed is New for scripts that only compute values: just the base,
+// table, string and math libraries are opened, so os, io and the module
+// loader are absent, and dofile/loadfile are removed.
+func NewSandboxed() *Lua {
+	ls := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range sandboxLibs {
+		ls.Push(ls.NewFunction(lib.open))
+		ls.Push(lua.LString(lib.name))
+		ls.Call(1, 0)
+	}
+	for _, name := range sandboxRemoved {
+		ls.SetGlobal(name, lua.LNil)
+	}
+	return &Lua{ls: ls}
+}
+
 func (l *Lua) Close() {
 	l.ls.Close()
 }
@@ -140,6 +218,42 @@ func (l *Lua) DoString(luaScript string) error {
 	return l.ls.DoString(luaScript)
 }
 
+// CallFunction calls the global Lua function name with args converted by
+// fromGoToLua and returns its first result converted by fromLuaToGo (numbers
+// come back as float64). It returns ErrorFunctionNotFound when name is not a
+// function, and the Lua error when the call fails.
+func (l *Lua) CallFunction(name string, args ...any) (any, error) {
+	fn, ok := l.ls.GetGlobal(name).(*lua.LFunction)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorFunctionNotFound, name)
+	}
+	largs := make([]lua.LValue, len(args))
+	for i, a := range args {
+		largs[i] = l.fromGoToLua(a)
+	}
+	if err := l.ls.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, largs...); err != nil {
+		return nil, err
+	}
+	ret := l.ls.Get(-1)
+	l.ls.Pop(1)
+	return fromLuaToGo(ret)
+}
+
+// DoStringTimeout is DoString that gives up after d, so a script stuck in a
+// loop cannot hang the caller. A timeout returns an error wrapping
+// ErrorTimeout; the state stays usable for later calls.
+func (l *Lua) DoStringTimeout(luaScript string, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	l.ls.SetContext(ctx)
+	defer l.ls.RemoveContext()
+	err := l.ls.DoString(luaScript)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s", ErrorTimeout, d)
+	}
+	return err
+}
+
 func (l *Lua) SetGlobal(name string, value any) {
 	var luaValue lua.LValue
 	switch v := value.(type) {
@@ -155,6 +269,8 @@ func (l *Lua) SetGlobal(name string, value any) {
 		luaValue = lua.LNumber(v)
 	case bool:
 		luaValue = lua.LBool(v)
+	case time.Duration:
+		luaValue = lua.LString(v.String())
 	case []string:
 		luaTable := l.ls.CreateTable(len(v), 0)
 		for i, s := range v {
@@ -209,7 +325,11 @@ func (l *Lua) MustGetMap(vGlobal string) map[string]string {
 	}
 	ret := make(map[string]string)
 	for k, v := range mi {
-		ret[k] = v.(lua.LString).String()
+		s, ok := v.(string)
+		if !ok {
+			log.Fatalf("Error converting %q into map[string]string: %q is not a string", vGlobal, k)
+		}
+		ret[k] = s
 	}
 	return ret
 }
@@ -222,6 +342,19 @@ func (l *Lua) MustGetBool(vGlobal string) bool {
 	return bool(v)
 }
 
+// MustGetDuration reads a duration string such as "10s" or "1m30s".
+func (l *Lua) MustGetDuration(vGlobal string) time.Duration {
+	v, ok := l.ls.GetGlobal(vGlobal).(lua.LString)
+	if !ok {
+		log.Fatalf("Error converting %q to duration", vGlobal)
+	}
+	d, err := time.ParseDuration(string(v))
+	if err != nil {
+		log.Fatalf("Error parsing %q as duration: %v", vGlobal, err)
+	}
+	return d
+}
+
 func (l *Lua) NewTable() *lua.LTable {
 	return l.ls.NewTable()
 }
@@ -1,7 +1,11 @@
 package lua
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestDoString executes a simple Lua script that assigns a global variable
@@ -75,3 +79,177 @@ func TestSetGlobalTable(t *testing.T) {
 		t.Fatalf("Expected map length %d, got %d", len(m), len(mapTable))
 	}
 }
+
+// TestSetGlobalDuration verifies a time.Duration round-trips through Lua.
+func TestSetGlobalDuration(t *testing.T) {
+	l := New()
+	defer l.Close()
+
+	l.SetGlobal("timeout", 1500*time.Millisecond)
+	if d := l.MustGetDuration("timeout"); d != 1500*time.Millisecond {
+		t.Fatalf("Expected timeout = 1.5s, got %s", d)
+	}
+
+	if err := l.DoString(`timeout = "2m"`); err != nil {
+		t.Fatalf("DoString error: %v", err)
+	}
+	if d := l.MustGetDuration("timeout"); d != 2*time.Minute {
+		t.Fatalf("Expected timeout = 2m, got %s", d)
+	}
+}
+
+// TestNewSandboxed verifies os, io and the file loaders are gone while
+// arithmetic, string and table operations still work.
+func TestNewSandboxed(t *testing.T) {
+	l := NewSandboxed()
+	defer l.Close()
+
+	err := l.DoString(`
+		noOS = os == nil
+		noIO = io == nil
+		noLoaders = dofile == nil and loadfile == nil and require == nil
+		n = math.floor(7 / 2) + 2 ^ 3
+		s = string.upper("edev") .. "-" .. string.rep("x", 3)
+		t = table.concat({ "a", "b" }, ",")
+	`)
+	if err != nil {
+		t.Fatalf("DoString error: %v", err)
+	}
+	for _, name := range []string{"noOS", "noIO", "noLoaders"} {
+		if !l.MustGetBool(name) {
+			t.Fatalf("expected %s to be true", name)
+		}
+	}
+	if n := l.MustGetInt("n"); n != 11 {
+		t.Fatalf("Expected n = 11, got %d", n)
+	}
+	if s := l.MustGetString("s"); s != "EDEV-xxx" {
+		t.Fatalf("Expected s = 'EDEV-xxx', got %s", s)
+	}
+	if s := l.MustGetString("t"); s != "a,b" {
+		t.Fatalf("Expected t = 'a,b', got %s", s)
+	}
+
+	if err := l.DoString(`os.execute("true")`); err == nil {
+		t.Fatalf("expected os.execute to fail in the sandbox")
+	}
+
+	// New keeps the full standard library.
+	full := New()
+	defer full.Close()
+	if err := full.DoString(`hasOS = os ~= nil and os.getenv ~= nil`); err != nil || !full.MustGetBool("hasOS") {
+		t.Fatalf("expected New to keep os, err=%v", err)
+	}
+}
+
+// TestDoStringTimeout verifies an endless loop is interrupted near the
+// deadline with ErrorTimeout and that the state can still run scripts.
+func TestDoStringTimeout(t *testing.T) {
+	l := New()
+	defer l.Close()
+
+	start := time.Now()
+	err := l.DoStringTimeout("while true do end", 100*time.Millisecond)
+	if !errors.Is(err, ErrorTimeout) {
+		t.Fatalf("expected ErrorTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the loop to stop near the timeout, took %s", d)
+	}
+
+	if err := l.DoStringTimeout("x = 1 + 1", time.Second); err != nil {
+		t.Fatalf("DoStringTimeout error: %v", err)
+	}
+	if x := l.MustGetInt("x"); x != 2 {
+		t.Fatalf("Expected x = 2, got %d", x)
+	}
+}
+
+// TestCallFunction verifies a Lua function defined by a script can be called
+// from Go with arguments and its result converted back.
+func TestCallFunction(t *testing.T) {
+	l := New()
+	defer l.Close()
+
+	err := l.DoString(`
+		function double(x) return x * 2 end
+		function greet(name, loud)
+			local s = "hello " .. name
+			if loud then s = string.upper(s) end
+			return s
+		end
+		function fail() error("boom") end
+		notAFunction = 1
+	`)
+	if err != nil {
+		t.Fatalf("DoString error: %v", err)
+	}
+
+	got, err := l.CallFunction("double", 21)
+	if err != nil {
+		t.Fatalf("CallFunction error: %v", err)
+	}
+	if got != float64(42) {
+		t.Fatalf("Expected 42, got %v (%T)", got, got)
+	}
+	if got, err := l.CallFunction("greet", "ana", true); err != nil || got != "HELLO ANA" {
+		t.Fatalf("Expected 'HELLO ANA', got %v, %v", got, err)
+	}
+
+	for _, name := range []string{"missing", "notAFunction"} {
+		if _, err := l.CallFunction(name); !errors.Is(err, ErrorFunctionNotFound) {
+			t.Fatalf("%s: expected ErrorFunctionNotFound, got %v", name, err)
+		}
+	}
+	if _, err := l.CallFunction("fail"); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the Lua error, got %v", err)
+	}
+	if top := l.GetState().GetTop(); top != 0 {
+		t.Fatalf("expected a clean stack, got %d values", top)
+	}
+}
+
+// TestCallFunctionTables verifies tables returned by Lua are converted
+// recursively: sequences to []any, string-keyed tables to map[string]any,
+// while mixed keys and self-references are rejected.
+func TestCallFunctionTables(t *testing.T) {
+	l := New()
+	defer l.Close()
+
+	err := l.DoString(`
+		function list() return {1, 2, 3} end
+		function nested() return {name = "ana", tags = {"a", "b"}, meta = {age = 30}} end
+		function mixed() return {1, 2, x = 3} end
+		function cyclic() local t = {} t.self = t return t end
+	`)
+	if err != nil {
+		t.Fatalf("DoString error: %v", err)
+	}
+
+	got, err := l.CallFunction("list")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if !reflect.DeepEqual(got, []any{1.0, 2.0, 3.0}) {
+		t.Fatalf("Expected [1 2 3], got %#v", got)
+	}
+
+	got, err = l.CallFunction("nested")
+	if err != nil {
+		t.Fatalf("nested: %v", err)
+	}
+	want := map[string]any{
+		"name": "ana",
+		"tags": []any{"a", "b"},
+		"meta": map[string]any{"age": 30.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %#v, got %#v", want, got)
+	}
+
+	for _, name := range []string{"mixed", "cyclic"} {
+		if _, err := l.CallFunction(name); !errors.Is(err, ErrorNotAllowedType) {
+			t.Fatalf("%s: expected ErrorNotAllowedType, got %v", name, err)
+		}
+	}
+}
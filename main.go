@@ -3,43 +3,41 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"edev/assets"
 	"edev/config"
 	"edev/db"
+	"edev/jobs"
 	"edev/log"
 	"edev/lua"
+	"edev/migration"
+	"edev/secret"
 	"edev/session"
 	"edev/templates"
 	"edev/user"
-)
-
-type stateEntry struct {
-	Verifier string
-	Expires  time.Time
-}
+	"edev/utils"
 
-var (
-	GitTag = "dev"
-	states = struct {
-		sync.Mutex
-		m map[string]stateEntry
-	}{m: make(map[string]stateEntry)}
+	"github.com/redis/go-redis/v9"
 )
 
+var GitTag = "dev"
+
 func securityHeaders(next http.Handler) http.Handler {
 	csp := strings.Join([]string{
 		"default-src 'self'",
-		"img-src 'self' data: https: *.githubusercontent.com github.com *.twimg.com pbs.twimg.com",
+		"img-src 'self' data: https: *.githubusercontent.com github.com *.twimg.com pbs.twimg.com www.gravatar.com",
 		"style-src 'self' 'unsafe-inline'",
 		"frame-ancestors 'none'",
 	}, "; ")
@@ -49,19 +47,55 @@ func securityHeaders(next http.Handler) http.Handler {
 		w.Header().Set("X-Frame-Options", "DENY")
 		w.Header().Set("Referrer-Policy", "no-referrer")
 		w.Header().Set("Content-Security-Policy", csp)
+		// HSTS is only honoured over HTTPS; on plain http it would be noise.
+		if utils.RequestIsSecure(r, config.Cfg.TrustProxy) {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
 // loggingMiddleware logs method, path, status and duration for each request.
+// Paths matching config.Cfg.AccessLogSkip prefixes (assets, health probes) are
+// demoted to debug so they don't drown out application requests.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		rw := &respWriter{ResponseWriter: w, status: 200}
 		next.ServeHTTP(rw, r)
 		dur := time.Since(start)
-		log.Printf("request method=%s path=%s status=%d dur_ms=%s remote=%s", r.Method, r.URL.Path, rw.status, strconv.FormatInt(dur.Milliseconds(), 10), r.RemoteAddr)
+		logf := log.Printf
+		for _, prefix := range config.Cfg.AccessLogSkip {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				logf = log.Debugf
+				break
+			}
+		}
+		logf("request method=%s path=%s status=%d dur_ms=%s remote=%s", r.Method, r.URL.Path, rw.status, strconv.FormatInt(dur.Milliseconds(), 10), r.RemoteAddr)
+	})
+}
+
+// requireCSRF rejects unsafe requests whose X-CSRF-Token header, or csrf_token
+// form field, does not match the token bound to the caller's session.
+func requireCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		sid, _ := session.GetCookie(r)
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" {
+			// HTML forms cannot set headers; accept the hidden field.
+			token = r.PostFormValue("csrf_token")
+		}
+		if !session.ValidateCSRF(sid, token) {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
@@ -76,54 +110,112 @@ func (w *respWriter) WriteHeader(code int) {
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "no-store")
 	sid, ok := session.GetCookie(r)
 	var u user.User
 	authed := false
 	if ok {
 		if got, ok := session.Get(sid); ok {
 			u, authed = got, true
+			if session.Touch(sid) {
+				session.SetCookie(w, sid)
+			}
 		}
 	}
 	data := struct {
-		Authed bool
-		User   user.User
-	}{Authed: authed, User: u}
+		Authed     bool
+		FirstLogin bool
+		CSRF       string
+		Banner     string
+		User       user.View
+	}{Authed: authed, Banner: maintenanceBanner(), User: user.NewView(u)}
+	if authed {
+		data.FirstLogin = session.TakeFirstLogin(sid)
+		data.CSRF = session.IssueCSRF(sid)
+	}
+
+	// The authed page embeds user data; the anonymous one is the same for
+	// everybody and can be cached briefly by a CDN, unless a banner is up:
+	// clearing it must take effect at once.
+	w.Header().Set("Vary", "Cookie")
+	if !authed && data.Banner == "" && config.Cfg.AnonHomeMaxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(config.Cfg.AnonHomeMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
 
 	err := templates.ExecuteTemplate(w, "index.ghtml", data)
 	if err != nil {
 		log.Printf("template %s execute error: %v", "index.ghtml", err)
-		http.Error(w, "template error", http.StatusInternalServerError)
+		serverError(w, "template error", err)
 	}
 }
 
+// loginPageHandler renders the provider choice page, or lists the providers as
+// JSON for clients asking for application/json (SPAs with their own login UI).
 func loginPageHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "no-store")
-	sid, ok := session.GetCookie(r)
-	if ok {
-		if _, found := session.Get(sid); found {
-			http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
-			return
-		}
+	w.Header().Set("Vary", "Accept")
+	if wantsJSON(r) {
+		writeProvidersJSON(w)
+		return
+	}
+	if session.IsAuthenticated(r) {
+		http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
+		return
+	}
+	if p := safeReturnTo(r.URL.Query().Get("return_to")); p != "" {
+		setReturnTo(w, r, p)
 	}
 
 	data := struct {
-		FakeOAuthEnabled bool
-	}{FakeOAuthEnabled: config.Cfg.FakeOAuthEnabled}
+		Providers []providerButton
+	}{Providers: loginProviders()}
+	if last := lastProvider(r); last != "" {
+		for i := range data.Providers {
+			data.Providers[i].Last = data.Providers[i].Name == last
+		}
+	}
 
 	err := templates.ExecuteTemplate(w, "login.ghtml", data)
 	if err != nil {
 		log.Printf("template %s execute error: %v", "login.ghtml", err)
-		http.Error(w, "template error", http.StatusInternalServerError)
+		serverError(w, "template error", err)
 	}
 }
 
+// healthTimeout keeps /healthz cheap even when the database hangs.
+const healthTimeout = time.Second
+
+// healthHandler answers "ok" while the database answers reads and 503
+// {"status":"degraded"} otherwise, so load balancers can drop the instance.
+// The writer is left to /status: VACUUM or a backup can hold it for minutes
+// while the instance still serves traffic.
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	if err := checkDBRead(ctx); err != nil {
+		log.Warnf("health check: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"degraded"}` + "\n"))
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("ok\n"))
 }
 
+// dbStatsHandler reports pool, WAL and page statistics as JSON.
+func dbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if db.Storage == nil {
+		http.Error(w, "no database", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(db.Storage.Stats()); err != nil {
+		log.Printf("encode db stats: %v", err)
+	}
+}
+
 func fileExists(name string) bool {
 	_, err := os.Stat(name)
 	if err != nil {
@@ -142,6 +234,10 @@ func ifEmpty(v, def string) string {
 	return def
 }
 
+// initLuaTimeout bounds init.lua, so a script stuck in a loop fails startup
+// instead of hanging it.
+const initLuaTimeout = 10 * time.Second
+
 func runLuaFile(name string) {
 	// Create a new Lua state.
 	L := lua.New()
@@ -150,10 +246,33 @@ func runLuaFile(name string) {
 	L.SetGlobal("GitTag", ifEmpty(GitTag, config.Cfg.GitTag))
 	L.SetGlobal("BaseURL", ifEmpty(os.Getenv("BASE_URL"), config.Cfg.BaseURL))
 	L.SetGlobal("Address", ifEmpty(os.Getenv("ADDRESS"), config.Cfg.Addrs))
+	L.SetGlobal("AnonHomeMaxAge", config.Cfg.AnonHomeMaxAge)
+	L.SetGlobal("ProviderOrder", config.Cfg.ProviderOrder)
+	L.SetGlobal("GitHubScopes", config.Cfg.GitHubScopes)
+	L.SetGlobal("GitHubScopesMode", config.Cfg.GitHubScopesMode)
+	L.SetGlobal("XScopes", config.Cfg.XScopes)
+	L.SetGlobal("XScopesMode", config.Cfg.XScopesMode)
+	L.SetGlobal("MaxIdentities", config.Cfg.MaxIdentities)
+	L.SetGlobal("AllowedEmailDomains", config.Cfg.AllowedEmailDomains)
+	L.SetGlobal("AccessLogSkip", config.Cfg.AccessLogSkip)
+	L.SetGlobal("AssetsDir", ifEmpty(os.Getenv("ASSETS_DIR"), config.Cfg.AssetsDir))
+	L.SetGlobal("AvatarContentTypes", config.Cfg.AvatarContentTypes)
+	L.SetGlobal("AvatarHosts", config.Cfg.AvatarHosts)
+	L.SetGlobal("AvatarMaxBytes", config.Cfg.AvatarMaxBytes)
+	L.SetGlobal("AvatarTimeout", config.Cfg.AvatarTimeout)
+	L.SetGlobal("GravatarFallback", config.Cfg.GravatarFallback)
+	L.SetGlobal("CookieSameSite", ifEmpty(os.Getenv("COOKIE_SAMESITE"), config.Cfg.CookieSameSite))
+	L.SetGlobal("DatabaseURL", ifEmpty(os.Getenv("DATABASE_URL"), config.Cfg.DatabaseURL))
+	L.SetGlobal("DBFailFastReads", config.Cfg.DBFailFastReads)
 	L.SetGlobal("GitHubClientID", os.Getenv("GITHUB_CLIENT_ID"))
 	L.SetGlobal("GitHubClientSecret", os.Getenv("GITHUB_CLIENT_SECRET"))
 	L.SetGlobal("XClientID", os.Getenv("X_CLIENT_ID"))
 	L.SetGlobal("XClientSecret", os.Getenv("X_CLIENT_SECRET"))
+	L.SetGlobal("AdminToken", os.Getenv("ADMIN_TOKEN"))
+	L.SetGlobal("TrustProxy", os.Getenv("TRUST_PROXY") == "true")
+	L.SetGlobal("DevMode", os.Getenv("DEV_MODE") == "true")
+	// Comma separated "id:base64key" entries; the first encrypts.
+	L.SetGlobal("TokenKeys", strings.FieldsFunc(os.Getenv("TOKEN_KEYS"), func(r rune) bool { return r == ',' }))
 	L.SetGlobal("FakeOAuthEnabled", os.Getenv("FAKE_OAUTH_ENABLED") == "true")
 	L.SetGlobal("FakeOAuthBaseURL", ifEmpty(
 		os.Getenv("FAKE_OAUTH_BASE_URL"), config.Cfg.FakeOAuthBaseURL))
@@ -161,6 +280,31 @@ func runLuaFile(name string) {
 		os.Getenv("FAKE_OAUTH_CLIENT_ID"), config.Cfg.FakeOAuthClientID))
 	L.SetGlobal("FakeOAuthRedirectPath", ifEmpty(
 		os.Getenv("FAKE_OAUTH_REDIRECT_PATH"), config.Cfg.FakeOAuthRedirect))
+	L.SetGlobal("FakeOAuthTimeout", config.Cfg.FakeOAuthTimeout)
+	L.SetGlobal("GitHubTimeout", config.Cfg.GitHubTimeout)
+	L.SetGlobal("XTimeout", config.Cfg.XTimeout)
+	L.SetGlobal("KeepAlivesEnabled", config.Cfg.KeepAlivesEnabled)
+	L.SetGlobal("KeepAlivePeriod", config.Cfg.KeepAlivePeriod)
+	L.SetGlobal("SessionCleanupInterval", config.Cfg.SessionCleanupInterval)
+	L.SetGlobal("InactivityTimeout", config.Cfg.InactivityTimeout)
+	L.SetGlobal("SlidingExpiration", config.Cfg.SlidingExpiration)
+	L.SetGlobal("AuthRedirectBrowsers", config.Cfg.AuthRedirectBrowsers)
+	L.SetGlobal("SessionCookieName", config.Cfg.SessionCookieName)
+	L.SetGlobal("SessionMaxAge", config.Cfg.SessionMaxAge)
+	L.SetGlobal("SessionStore", ifEmpty(os.Getenv("SESSION_STORE"), config.Cfg.SessionStore))
+	L.SetGlobal("RedisURL", ifEmpty(os.Getenv("REDIS_URL"), config.Cfg.RedisURL))
+	L.SetGlobal("RedisKeyPrefix", config.Cfg.RedisKeyPrefix)
+	L.SetGlobal("SessionIDBytes", config.Cfg.SessionIDBytes)
+	L.SetGlobal("SessionIDEncoding", config.Cfg.SessionIDEncoding)
+	L.SetGlobal("StateCleanupInterval", config.Cfg.StateCleanupInterval)
+	L.SetGlobal("StateTTL", config.Cfg.StateTTL)
+	L.SetGlobal("StateCookieCheck", config.Cfg.StateCookieCheck)
+	L.SetGlobal("LastProviderMaxAge", config.Cfg.LastProviderMaxAge)
+	L.SetGlobal("CallbackMaxInflight", config.Cfg.CallbackMaxInflight)
+	L.SetGlobal("WALCheckpointFrames", config.Cfg.WALCheckpointFrames)
+	L.SetGlobal("WALCheckpointInterval", config.Cfg.WALCheckpointInterval)
+	L.SetGlobal("UserinfoCacheSize", config.Cfg.UserinfoCacheSize)
+	L.SetGlobal("UserinfoCacheTTL", config.Cfg.UserinfoCacheTTL)
 
 	// Read the Lua file.
 	b, err := os.ReadFile(filepath.Clean(name))
@@ -168,27 +312,113 @@ func runLuaFile(name string) {
 		log.Fatal(err)
 	}
 
-	err = L.DoString(string(b))
+	err = L.DoStringTimeout(string(b), initLuaTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	config.Cfg.Addrs = L.MustGetString("Address")
+	if _, _, err := config.ParseAddr(config.Cfg.Addrs); err != nil {
+		log.Fatalf("invalid Address %q: %v", config.Cfg.Addrs, err)
+	}
+	config.Cfg.AccessLogSkip = L.MustGetTable("AccessLogSkip")
+	config.Cfg.ProviderOrder = L.MustGetTable("ProviderOrder")
+	config.Cfg.GitHubScopes = L.MustGetTable("GitHubScopes")
+	config.Cfg.GitHubScopesMode = L.MustGetString("GitHubScopesMode")
+	config.Cfg.XScopes = L.MustGetTable("XScopes")
+	config.Cfg.XScopesMode = L.MustGetString("XScopesMode")
+	for _, mode := range []string{config.Cfg.GitHubScopesMode, config.Cfg.XScopesMode} {
+		if _, err := mergeScopes(nil, nil, mode); err != nil {
+			log.Fatal(err)
+		}
+	}
+	config.Cfg.MaxIdentities = L.MustGetInt("MaxIdentities")
+	config.Cfg.AllowedEmailDomains = L.MustGetTable("AllowedEmailDomains")
+	config.Cfg.AnonHomeMaxAge = L.MustGetDuration("AnonHomeMaxAge")
+	config.Cfg.AssetsDir = L.MustGetString("AssetsDir")
+	config.Cfg.AvatarContentTypes = L.MustGetTable("AvatarContentTypes")
+	config.Cfg.AvatarHosts = L.MustGetTable("AvatarHosts")
+	config.Cfg.AvatarMaxBytes = int64(L.MustGetInt("AvatarMaxBytes"))
+	config.Cfg.AvatarTimeout = L.MustGetDuration("AvatarTimeout")
+	config.Cfg.GravatarFallback = L.MustGetBool("GravatarFallback")
 	config.Cfg.BaseURL = L.MustGetString("BaseURL")
+	config.Cfg.CookieSameSite = L.MustGetString("CookieSameSite")
+	config.Cfg.DatabaseURL = L.MustGetString("DatabaseURL")
+	config.Cfg.DBFailFastReads = L.MustGetBool("DBFailFastReads")
 	config.Cfg.FakeOAuthEnabled = L.MustGetBool("FakeOAuthEnabled")
 	config.Cfg.GitHubClientID = L.MustGetString("GitHubClientID")
 	config.Cfg.GitHubClientSecret = L.MustGetString("GitHubClientSecret")
+	config.Cfg.GitHubTimeout = L.MustGetDuration("GitHubTimeout")
 	config.Cfg.GitTag = L.MustGetString("GitTag")
+	config.Cfg.KeepAlivesEnabled = L.MustGetBool("KeepAlivesEnabled")
+	config.Cfg.KeepAlivePeriod = L.MustGetDuration("KeepAlivePeriod")
+	config.Cfg.SessionCleanupInterval = L.MustGetDuration("SessionCleanupInterval")
+	config.Cfg.InactivityTimeout = L.MustGetDuration("InactivityTimeout")
+	session.SetInactivityTimeout(config.Cfg.InactivityTimeout)
+	config.Cfg.SlidingExpiration = L.MustGetBool("SlidingExpiration")
+	session.EnableSlidingExpiration(config.Cfg.SlidingExpiration)
+	config.Cfg.AuthRedirectBrowsers = L.MustGetBool("AuthRedirectBrowsers")
+	config.Cfg.SessionCookieName = L.MustGetString("SessionCookieName")
+	config.Cfg.SessionMaxAge = L.MustGetDuration("SessionMaxAge")
+	config.Cfg.SessionStore = L.MustGetString("SessionStore")
+	config.Cfg.RedisURL = L.MustGetString("RedisURL")
+	config.Cfg.RedisKeyPrefix = L.MustGetString("RedisKeyPrefix")
+	config.Cfg.SessionIDBytes = L.MustGetInt("SessionIDBytes")
+	config.Cfg.SessionIDEncoding = L.MustGetString("SessionIDEncoding")
+	config.Cfg.StateCleanupInterval = L.MustGetDuration("StateCleanupInterval")
+	config.Cfg.StateTTL = L.MustGetDuration("StateTTL")
+	if err := validateStateConfig(config.Cfg.StateTTL, config.Cfg.StateCleanupInterval); err != nil {
+		log.Fatal(err)
+	}
+	config.Cfg.StateCookieCheck = L.MustGetBool("StateCookieCheck")
+	config.Cfg.LastProviderMaxAge = L.MustGetDuration("LastProviderMaxAge")
+	config.Cfg.CallbackMaxInflight = L.MustGetInt("CallbackMaxInflight")
+	config.Cfg.WALCheckpointFrames = L.MustGetInt("WALCheckpointFrames")
+	config.Cfg.WALCheckpointInterval = L.MustGetDuration("WALCheckpointInterval")
+	config.Cfg.UserinfoCacheSize = L.MustGetInt("UserinfoCacheSize")
+	config.Cfg.UserinfoCacheTTL = L.MustGetDuration("UserinfoCacheTTL")
+	userinfoLRU.Configure(config.Cfg.UserinfoCacheSize, config.Cfg.UserinfoCacheTTL)
 	config.Cfg.XClientID = L.MustGetString("XClientID")
 	config.Cfg.XClientSecret = L.MustGetString("XClientSecret")
+	config.Cfg.AdminToken = L.MustGetString("AdminToken")
+	config.Cfg.TrustProxy = L.MustGetBool("TrustProxy")
+	config.Cfg.DevMode = L.MustGetBool("DevMode")
+	if config.Cfg.DevMode {
+		log.Warn("DevMode is on: 5xx responses include error details and stacks")
+	}
+	config.Cfg.TokenKeys = L.MustGetTable("TokenKeys")
+	if len(config.Cfg.TokenKeys) > 0 {
+		tokenKeys, err = secret.ParseKeys(config.Cfg.TokenKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	config.Cfg.XTimeout = L.MustGetDuration("XTimeout")
 
 	if config.Cfg.FakeOAuthEnabled {
-
-		session.EnableInsecureCookie()
-
 		config.Cfg.FakeOAuthBaseURL = L.MustGetString("FakeOAuthBaseURL")
 		config.Cfg.FakeOAuthClientID = L.MustGetString("FakeOAuthClientID")
 		config.Cfg.FakeOAuthRedirect = L.MustGetString("FakeOAuthRedirectPath")
+		config.Cfg.FakeOAuthTimeout = L.MustGetDuration("FakeOAuthTimeout")
+	}
+
+	if err := session.SetIDFormat(config.Cfg.SessionIDBytes, config.Cfg.SessionIDEncoding); err != nil {
+		log.Fatal(err)
+	}
+
+	mode, err := session.ParseSameSite(config.Cfg.CookieSameSite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Fake OAuth runs over plain http, where Secure cookies would be dropped.
+	err = session.Configure(session.Config{
+		CookieName: config.Cfg.SessionCookieName,
+		MaxAge:     config.Cfg.SessionMaxAge,
+		SameSite:   mode,
+		Secure:     !config.Cfg.FakeOAuthEnabled,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Allow missing real providers if fake OAuth is enabled (for local tests).
@@ -203,29 +433,97 @@ func runLuaFile(name string) {
 
 }
 
-func putState(st, verifier string, ttl time.Duration) {
-	states.Lock()
-	states.m[st] = stateEntry{Verifier: verifier, Expires: time.Now().Add(ttl)}
-	// simple opportunistic cleanup:
-	for k, v := range states.m {
-		if time.Now().After(v.Expires) {
-			delete(states.m, k)
+// providerContext bounds the provider calls of one callback (token exchange
+// and userinfo) by the provider's configured timeout, defaulting to 10s.
+func providerContext(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		d = 10 * time.Second
+	}
+	return context.WithTimeout(parent, d)
+}
+
+type redirectURI struct {
+	Provider string
+	URI      string
+}
+
+// redirectURIs lists the callback URI each enabled provider sends, exactly as
+// it must be registered in the provider's console.
+func redirectURIs() []redirectURI {
+	uris := []redirectURI{
+		{"github", config.AbsURL(githubCallbackPath)},
+		{"x", config.AbsURL(xCallbackPath)},
+	}
+	if config.Cfg.FakeOAuthEnabled {
+		uris = append(uris, redirectURI{"fake", config.AbsURL(config.Cfg.FakeOAuthRedirect)})
+	}
+	return uris
+}
+
+func logRedirectURIs() {
+	for _, u := range redirectURIs() {
+		log.Printf("oauth redirect uri provider=%s uri=%s", u.Provider, u.URI)
+	}
+}
+
+// applySchema runs the pending embedded migrations.
+func applySchema(s *db.SQLite) error {
+	_, err := migration.Up(s)
+	return err
+}
+
+// persistUser records the login in the users/identities tables and returns u
+// enriched with account data (CreatedAt); created reports a brand-new account.
+// A new identity used while r already carries a session is linked to that
+// session's account. Without a database u is returned as is.
+func persistUser(r *http.Request, provider string, u user.User) (user.User, bool, error) {
+	if db.Storage == nil {
+		return u, false, nil
+	}
+	u.AccountID = 0
+	if sid, ok := session.GetCookie(r); ok {
+		if cur, ok := session.Get(sid); ok {
+			u.AccountID = cur.AccountID
 		}
 	}
-	states.Unlock()
+	return user.Upsert(db.Storage, provider, u)
 }
 
-func takeState(st string) (string, bool) {
-	states.Lock()
-	defer func() {
-		delete(states.m, st)
-		states.Unlock()
-	}()
-	ent, ok := states.m[st]
-	if !ok || time.Now().After(ent.Expires) {
-		return "", false
+// openSessionStore builds the session backend selected by SessionStore:
+// "sqlite" (default, single instance), "redis" (shared between instances),
+// "memory" (lost on restart) or "sharded" (like memory, with less lock
+// contention under many concurrent sessions).
+func openSessionStore() (session.Store, error) {
+	switch config.Cfg.SessionStore {
+	case "", "sqlite":
+		return session.NewSQLiteStore(db.Storage)
+	case "redis":
+		opts, err := redis.ParseURL(config.Cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RedisURL: %w", err)
+		}
+		return session.NewRedisStore(redis.NewClient(opts), config.Cfg.RedisKeyPrefix)
+	case "memory":
+		return session.NewMemoryStore(), nil
+	case "sharded":
+		return session.NewShardedStore(0), nil
+	}
+	return nil, fmt.Errorf("unknown SessionStore %q (want sqlite, redis, memory or sharded)", config.Cfg.SessionStore)
+}
+
+// tokenKeys encrypts stored provider tokens; nil (no TokenKeys configured)
+// disables token storage.
+var tokenKeys *secret.Keyring
+
+// saveProviderTokens stores the provider tokens of u's identity, encrypted.
+// Failures are logged only: the login itself already succeeded.
+func saveProviderTokens(provider string, u user.User, tok user.Tokens) {
+	if db.Storage == nil || tokenKeys == nil {
+		return
+	}
+	if err := user.SaveTokens(db.Storage, tokenKeys, provider, u.ID, tok); err != nil {
+		log.Printf("save provider tokens provider=%s: %v", provider, err)
 	}
-	return ent.Verifier, true
 }
 
 // OAuth provider instances (defined in separate files)
@@ -238,96 +536,245 @@ var (
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	if sid, ok := session.GetCookie(r); ok {
 		session.Del(sid)
+		logoutsTotal.Inc()
 	}
-	session.SetCookie(w, "", -1) // clear cookie
+	session.ClearCookie(w)
 	http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
 }
 
 func meHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Cache-Control", "no-store")
 	sid, ok := session.GetCookie(r)
 	if !ok {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	u, ok := session.Get(sid)
+	u, exp, ok := session.GetWithExpiry(sid)
 	if !ok {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if session.Touch(sid) {
+		session.SetCookie(w, sid)
+		exp = time.Now().Add(session.Lifetime())
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(u)
+	_ = json.NewEncoder(w).Encode(struct {
+		user.User
+		ActiveSessions int    `json:"active_sessions"`
+		ExpiresAt      string `json:"expires_at"`
+	}{u, session.CountByAccount(u.AccountID), exp.UTC().Format(time.RFC3339)})
 }
 
-func main() {
-	config.Cfg.GitTag = GitTag
+// whoamiHandler prints the session login as plain text for quick CLI checks.
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	sid, ok := session.GetCookie(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	u, ok := session.Get(sid)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(u.Login + "\n"))
+}
 
-	const initLua = "init.lua"
+// csrfHandler returns the CSRF token bound to the current session so the SPA
+// can send it back in the X-CSRF-Token header on mutating calls.
+func csrfHandler(w http.ResponseWriter, r *http.Request) {
+	sid, ok := session.GetCookie(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	tok := session.IssueCSRF(sid)
+	if tok == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"csrf_token": tok})
+}
 
-	if !fileExists(initLua) {
-		log.Fatal("init.lua not found")
+// checkpointWAL truncates the WAL once it grows past WALCheckpointFrames, so
+// idle periods skip the checkpoint and busy ones get it as often as needed.
+func checkpointWAL(context.Context) error {
+	done, err := db.Storage.CheckpointIfAbove(config.Cfg.WALCheckpointFrames)
+	if err != nil {
+		return fmt.Errorf("wal checkpoint: %w", err)
+	}
+	if done {
+		log.Debugf("wal checkpoint: truncated")
 	}
+	return nil
+}
 
-	runLuaFile(initLua)
+// registerJobs schedules the periodic maintenance tasks on s. The session
+// and state cleanups also run once more when s stops.
+func registerJobs(s *jobs.Scheduler) {
+	s.Every("session-cleanup", config.Cfg.SessionCleanupInterval, func(context.Context) error {
+		session.Cleanup()
+		return nil
+	}, jobs.RunOnStop())
+	s.Every("wal-checkpoint", config.Cfg.WALCheckpointInterval, checkpointWAL)
+	s.Every("state-cleanup", config.Cfg.StateCleanupInterval, func(context.Context) error {
+		cleanupStates()
+		return nil
+	}, jobs.RunOnStop())
+}
 
-	var err error
+// newServer builds the HTTP server with our timeouts and keep-alive policy.
+func newServer(h http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              config.Cfg.Addrs,
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	srv.SetKeepAlivesEnabled(config.Cfg.KeepAlivesEnabled)
+	return srv
+}
 
-	db.Storage, err = db.New()
+// listen opens the TCP listener applying KeepAlivePeriod to accepted
+// connections (0 uses the Go default, negative disables TCP keep-alive probes).
+func listen(addr string) (net.Listener, error) {
+	network, address, err := config.ParseAddr(addr)
 	if err != nil {
-		log.Fatalf("Error on db: %s", err)
+		return nil, err
 	}
+	lc := net.ListenConfig{KeepAlive: config.Cfg.KeepAlivePeriod}
+	return lc.Listen(context.Background(), network, address)
+}
 
+// routes registers every handler on a new ServeMux. Patterns carry the
+// method, so other verbs get 405 from the mux itself.
+func routes() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	fileServer := http.FileServer(assets.FS)
-	mux.Handle("/assets/", http.StripPrefix("/assets/", fileServer))
-	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+	fileServer := http.FileServer(assets.Overlay(config.Cfg.AssetsDir, assets.FS))
+	mux.Handle("GET /assets/", http.StripPrefix("/assets/", fileServer))
+	mux.HandleFunc("GET /favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		// some browsers do not support link rel="icon"
 		// redirect to the one served from /assets/
 		http.Redirect(w, r, "/assets/favicon.ico", http.StatusMovedPermanently)
 	})
-	mux.HandleFunc("/", indexHandler)
-	mux.HandleFunc("/login", loginPageHandler)
-	mux.HandleFunc("/healthz", healthHandler)
+	// "/{$}" matches only the root; anything unmatched gets the mux's 404
+	// (or 405 for a known path) instead of falling through to the index page.
+	// A "/" catch-all would swallow the 405s, so there is none.
+	mux.HandleFunc("GET /{$}", indexHandler)
+	mux.HandleFunc("GET /login", loginPageHandler)
+	mux.HandleFunc("GET /healthz", healthHandler)
+	mux.HandleFunc("GET /status", statusHandler)
+	mux.HandleFunc("GET /version", versionHandler)
+
+	mux.HandleFunc("GET /login/github", gitHubProvider.LoginHandler)
+	mux.HandleFunc("GET /login/x", xProvider.LoginHandler)
+
+	mux.Handle("POST /logout", requireCSRF(http.HandlerFunc(logoutHandler)))
+	mux.Handle("GET /me", requireAuth(http.HandlerFunc(meHandler)))
+	mux.Handle("GET /whoami", requireAuth(http.HandlerFunc(whoamiHandler)))
+	mux.Handle("GET /avatar", requireAuth(http.HandlerFunc(avatarHandler)))
+	mux.Handle("POST /profile", requireAuth(requireCSRF(http.HandlerFunc(profileHandler))))
+	mux.Handle("POST /account/unlink", requireAuth(requireCSRF(http.HandlerFunc(unlinkHandler))))
+	mux.Handle("GET /csrf", requireAuth(http.HandlerFunc(csrfHandler)))
+
+	// Admin endpoints exist only when a token is configured.
+	if config.Cfg.AdminToken != "" {
+		mux.Handle("PUT /admin/maintenance-banner", requireAdmin(http.HandlerFunc(bannerHandler)))
+		mux.Handle("GET /metrics", requireAdmin(http.HandlerFunc(metricsHandler)))
+		mux.Handle("POST /admin/vacuum", requireAdmin(http.HandlerFunc(vacuumHandler)))
+		mux.Handle("GET /admin/integrity", requireAdmin(http.HandlerFunc(integrityHandler)))
+		mux.Handle("GET /debug/dbstats", requireAdmin(http.HandlerFunc(dbStatsHandler)))
+	}
 
-	mux.HandleFunc("/login/github", gitHubProvider.LoginHandler)
-	mux.HandleFunc("/login/x", xProvider.LoginHandler)
+	mux.HandleFunc("GET "+githubCallbackPath, limitCallbacks(gitHubProvider.CallbackHandler))
+	mux.HandleFunc("GET "+xCallbackPath, limitCallbacks(xProvider.CallbackHandler))
 
+	// Registered last so the redirect path can be checked against every
+	// other route.
 	if config.Cfg.FakeOAuthEnabled {
-		mux.HandleFunc("/login/fake", fakeProvider.LoginHandler)
-		mux.HandleFunc(config.Cfg.FakeOAuthRedirect, fakeProvider.CallbackHandler)
+		mux.HandleFunc("GET /login/fake", fakeProvider.LoginHandler)
+		if err := validateFakeRedirect(mux, config.Cfg.FakeOAuthRedirect); err != nil {
+			log.Fatal(err)
+		}
+		mux.HandleFunc("GET "+config.Cfg.FakeOAuthRedirect, limitCallbacks(fakeProvider.CallbackHandler))
 	}
-	mux.HandleFunc("/logout", logoutHandler)
-	mux.HandleFunc("/me", meHandler)
 
-	mux.HandleFunc("/github/oauth/callback", gitHubProvider.CallbackHandler)
-	mux.HandleFunc("/x/oauth/callback", xProvider.CallbackHandler)
+	return mux
+}
 
-	srv := &http.Server{
-		Addr:              config.Cfg.Addrs,
-		Handler:           loggingMiddleware(securityHeaders(mux)),
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      15 * time.Second,
-		IdleTimeout:       60 * time.Second,
+// validateFakeRedirect checks that path is a plain absolute path that no
+// route registered on mux already serves, whatever its method: a path taken
+// only by POST would otherwise look free to a GET probe.
+func validateFakeRedirect(mux *http.ServeMux, path string) error {
+	if path == "" {
+		return errors.New("fake oauth redirect path is empty")
+	}
+	u, err := url.Parse(path)
+	if err != nil || !strings.HasPrefix(path, "/") || u.Path != path ||
+		strings.ContainsAny(path, " \t{}") {
+		return fmt.Errorf("fake oauth redirect path %q must be a plain path starting with /", path)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		req := &http.Request{Method: method, URL: u}
+		if _, pattern := mux.Handler(req); pattern != "" {
+			return fmt.Errorf("fake oauth redirect path %q collides with route %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func main() {
+	config.Cfg.GitTag = GitTag
+
+	const initLua = "init.lua"
+
+	if !fileExists(initLua) {
+		log.Fatal("init.lua not found")
+	}
+
+	runLuaFile(initLua)
+
+	var err error
+
+	db.Storage, err = db.New()
+	if err != nil {
+		log.Fatalf("Error on db: %s", err)
+	}
+	if err := applySchema(db.Storage); err != nil {
+		log.Fatalf("Error applying schema: %s", err)
+	}
+	sessionStore, err := openSessionStore()
+	if err != nil {
+		log.Fatalf("Error on session store: %s", err)
+	}
+	session.SetStore(sessionStore)
+
+	mux := routes()
+
+	logRedirectURIs()
+
+	srv := newServer(loggingMiddleware(securityHeaders(cacheControl(routeCachePolicies(), mux))))
+	ln, err := listen(config.Cfg.Addrs)
+	if err != nil {
+		log.Fatalf("Listen error: %v", err)
 	}
 
 	// Start server in a goroutine to enable graceful shutdown below.
 	go func() {
 		log.Printf("Serving on %s", config.Cfg.Addrs)
-		err := srv.ListenAndServe()
+		err := srv.Serve(ln)
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe error: %v", err)
+			log.Fatalf("Serve error: %v", err)
 		}
 	}()
 
-	// session Cleanup
-	go func() {
-		for {
-			time.Sleep(5 * time.Minute)
-			session.Cleanup()
-		}
-	}()
+	sched := jobs.New(context.Background())
+	registerJobs(sched)
 
 	// Graceful shutdown on Ctrl+C (SIGINT).
 	stop := make(chan os.Signal, 1)
@@ -343,7 +790,9 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Printf("Shutdown error: %v", err)
 	}
+	sched.Stop()
 	if db.Storage != nil {
+		// Close performs the final WAL checkpoint.
 		db.Storage.Close()
 	}
 	log.Println("Server stopped.")
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edev/config"
+	"edev/jobs"
+	"edev/log"
+	"edev/session"
+	"edev/user"
+	"edev/utils"
+)
+
+// helper: create a session for u and return a request carrying its cookie.
+func authedRequest(t *testing.T, method, target string, u user.User) (*http.Request, string) {
+	t.Helper()
+	sid := utils.NewOpaqueID()
+	session.Put(sid, u)
+	t.Cleanup(func() { session.Del(sid) })
+
+	rec := httptest.NewRecorder()
+	session.SetCookie(rec, sid)
+	req := httptest.NewRequest(method, target, nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req, sid
+}
+
+// TestCSRFHandler verifies the token returned by /csrf passes requireCSRF and
+// that a token from a previous session is rejected.
+func TestCSRFHandler(t *testing.T) {
+	u := user.User{ID: "1", Login: "alice"}
+	protected := requireCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	fetch := func(req *http.Request) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		cacheControl(cachePolicies, http.HandlerFunc(csrfHandler)).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 from /csrf, got %d", rec.Code)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Fatalf("expected Cache-Control no-store, got %q", cc)
+		}
+		var body struct {
+			Token string `json:"csrf_token"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if body.Token == "" {
+			t.Fatalf("empty csrf token")
+		}
+		return body.Token
+	}
+
+	req, oldSID := authedRequest(t, http.MethodGet, "/csrf", u)
+	stale := fetch(req)
+	session.Del(oldSID)
+
+	req, _ = authedRequest(t, http.MethodGet, "/csrf", u)
+	tok := fetch(req)
+	if tok == stale {
+		t.Fatalf("expected token to rotate with the session")
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	post.Header.Set("Cookie", req.Header.Get("Cookie"))
+	post.Header.Set("X-CSRF-Token", tok)
+	rec := httptest.NewRecorder()
+	protected.ServeHTTP(rec, post)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected valid token to pass, got %d", rec.Code)
+	}
+
+	post.Header.Set("X-CSRF-Token", stale)
+	rec = httptest.NewRecorder()
+	protected.ServeHTTP(rec, post)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected stale token to be rejected, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	csrfHandler(rec, httptest.NewRequest(http.MethodGet, "/csrf", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without session, got %d", rec.Code)
+	}
+}
+
+// TestRequireCSRFSessions verifies a missing token and a token issued to
+// another live session are rejected, and that only the "csrf_token" form
+// field is read.
+func TestRequireCSRFSessions(t *testing.T) {
+	protected := requireCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	aliceReq, aliceSID := authedRequest(t, http.MethodGet, "/", user.User{ID: "1", Login: "alice"})
+	_, bobSID := authedRequest(t, http.MethodGet, "/", user.User{ID: "2", Login: "bob"})
+	aliceTok := session.IssueCSRF(aliceSID)
+	bobTok := session.IssueCSRF(bobSID)
+
+	for _, tc := range []struct {
+		name string
+		form string
+		want int
+	}{
+		{"missing", "", http.StatusForbidden},
+		{"other session", "csrf_token=" + bobTok, http.StatusForbidden},
+		{"other field name", "csrf=" + aliceTok, http.StatusForbidden},
+		{"valid", "csrf_token=" + aliceTok, http.StatusNoContent},
+	} {
+		post := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(tc.form))
+		post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		post.Header.Set("Cookie", aliceReq.Header.Get("Cookie"))
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, post)
+		if rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+	}
+}
+
+// TestWhoamiHandler verifies the plain text login for an authed session and
+// 401 without one.
+func TestWhoamiHandler(t *testing.T) {
+	req, _ := authedRequest(t, http.MethodGet, "/whoami", user.User{ID: "1", Login: "alice"})
+	rec := httptest.NewRecorder()
+	whoamiHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+	if body := rec.Body.String(); body != "alice\n" {
+		t.Fatalf("expected %q, got %q", "alice\n", body)
+	}
+
+	rec = httptest.NewRecorder()
+	whoamiHandler(rec, httptest.NewRequest(http.MethodGet, "/whoami", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+// TestMeExpiresAt verifies /me reports when the session ends, about one
+// session lifetime after the request.
+func TestMeExpiresAt(t *testing.T) {
+	req, _ := authedRequest(t, http.MethodGet, "/me", user.User{ID: "1", Login: "alice"})
+	rec := httptest.NewRecorder()
+	meHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var body struct {
+		Login     string `json:"login"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	exp, err := time.Parse(time.RFC3339, body.ExpiresAt)
+	if err != nil {
+		t.Fatalf("parse expires_at %q: %v", body.ExpiresAt, err)
+	}
+	want := time.Now().Add(session.Lifetime())
+	if body.Login != "alice" || exp.Before(want.Add(-5*time.Second)) || exp.After(want.Add(5*time.Second)) {
+		t.Fatalf("expected expires_at near %s, got %s (login %q)", want, exp, body.Login)
+	}
+}
+
+// TestLoggingMiddlewareSkip verifies asset requests are demoted to debug while
+// application requests log at info.
+func TestLoggingMiddlewareSkip(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel(log.LevelInfo)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.LevelDebug)
+	}()
+
+	h := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/assets/style.css", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("expected asset request to be suppressed at info, got %q", buf.String())
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(buf.String(), "path=/ ") {
+		t.Fatalf("expected / request to be logged, got %q", buf.String())
+	}
+}
+
+// TestLogRedirectURIs verifies the logged URIs are BaseURL + callback path.
+func TestLogRedirectURIs(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	prevBase, prevFake := config.Cfg.BaseURL, config.Cfg.FakeOAuthEnabled
+	config.Cfg.BaseURL, config.Cfg.FakeOAuthEnabled = "https://example.test/", true
+	defer func() { config.Cfg.BaseURL, config.Cfg.FakeOAuthEnabled = prevBase, prevFake }()
+
+	logRedirectURIs()
+	for _, want := range []string{
+		"provider=github uri=https://example.test/github/oauth/callback",
+		"provider=x uri=https://example.test/x/oauth/callback",
+		"provider=fake uri=https://example.test" + config.Cfg.FakeOAuthRedirect,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected log to contain %q, got %q", want, buf.String())
+		}
+	}
+}
+
+// TestJanitorStopRunsFinalCleanup verifies stopping the maintenance jobs
+// runs one last session and state cleanup pass.
+func TestJanitorStopRunsFinalCleanup(t *testing.T) {
+	st := &cleanupCountingStore{Store: session.NewMemoryStore()}
+	session.SetStore(st)
+	t.Cleanup(func() { session.SetStore(session.NewMemoryStore()) })
+	putState("st-stale", "verifier", -time.Minute)
+
+	s := jobs.New(context.Background())
+	registerJobs(s)
+	s.Stop()
+
+	if n := st.cleanups.Load(); n != 1 {
+		t.Fatalf("expected 1 final session cleanup, got %d", n)
+	}
+	states.Lock()
+	_, ok := states.m["st-stale"]
+	states.Unlock()
+	if ok {
+		t.Fatalf("expected the final state cleanup to drop the expired state")
+	}
+}
+
+// cleanupCountingStore counts Cleanup calls on top of a real store.
+type cleanupCountingStore struct {
+	session.Store
+	cleanups atomic.Int32
+}
+
+func (s *cleanupCountingStore) Cleanup() {
+	s.cleanups.Add(1)
+	s.Store.Cleanup()
+}
+
+// TestKeepAlivesDisabled verifies the server answers with Connection: close
+// when keep-alives are turned off in config.
+func TestKeepAlivesDisabled(t *testing.T) {
+	prev := config.Cfg.KeepAlivesEnabled
+	config.Cfg.KeepAlivesEnabled = false
+	defer func() { config.Cfg.KeepAlivesEnabled = prev }()
+
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := newServer(http.HandlerFunc(healthHandler))
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	if !resp.Close {
+		t.Fatalf("expected Connection: close, got headers %v", resp.Header)
+	}
+}
+
+// TestIndexFirstLogin verifies the onboarding block renders once for a new
+// account and is cleared afterwards.
+func TestIndexFirstLogin(t *testing.T) {
+	req, sid := authedRequest(t, http.MethodGet, "/", user.User{ID: "1", Login: "alice"})
+	session.MarkFirstLogin(sid)
+
+	rec := httptest.NewRecorder()
+	indexHandler(rec, req)
+	if !strings.Contains(rec.Body.String(), `class="card onboarding"`) {
+		t.Fatalf("expected onboarding on first render")
+	}
+
+	rec = httptest.NewRecorder()
+	indexHandler(rec, req)
+	if strings.Contains(rec.Body.String(), `class="card onboarding"`) {
+		t.Fatalf("expected onboarding to be shown only once")
+	}
+}
+
+// TestIndexCachePolicy verifies anonymous visitors get a public max-age while
+// authed ones keep no-store.
+func TestIndexCachePolicy(t *testing.T) {
+	prev := config.Cfg.AnonHomeMaxAge
+	config.Cfg.AnonHomeMaxAge = 30 * time.Second
+	defer func() { config.Cfg.AnonHomeMaxAge = prev }()
+
+	rec := httptest.NewRecorder()
+	indexHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=30" {
+		t.Fatalf("expected public cache for anonymous, got %q", cc)
+	}
+
+	req, _ := authedRequest(t, http.MethodGet, "/", user.User{ID: "1", Login: "alice"})
+	rec = httptest.NewRecorder()
+	indexHandler(rec, req)
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("expected no-store for authed, got %q", cc)
+	}
+}
+
+// TestRoutesRootOnly verifies "/" serves the index, unknown paths 404 and
+// specific routes still reach their handlers.
+func TestRoutesRootOnly(t *testing.T) {
+	mux := routes()
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusOK},
+		{"/x", http.StatusNotFound},
+		{"/me", http.StatusUnauthorized}, // meHandler without a session
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Fatalf("GET %s: expected %d, got %d", tc.path, tc.want, rec.Code)
+		}
+	}
+}
+
+// TestRoutesMethods verifies wrong verbs on method-qualified routes get 405.
+func TestRoutesMethods(t *testing.T) {
+	mux := routes()
+	for _, tc := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/logout"},
+		{http.MethodGet, "/profile"},
+		{http.MethodPost, "/me"},
+		{http.MethodDelete, "/csrf"},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("%s %s: expected 405, got %d", tc.method, tc.path, rec.Code)
+		}
+	}
+}
+
+// TestLogoutFormToken verifies requireCSRF accepts the token from the hidden
+// form field used by the logout button.
+func TestLogoutFormToken(t *testing.T) {
+	_, sid := authedRequest(t, http.MethodGet, "/", user.User{ID: "1", Login: "alice"})
+	tok := session.IssueCSRF(sid)
+
+	rec := httptest.NewRecorder()
+	session.SetCookie(rec, sid)
+	req := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader("csrf_token="+tok))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected logout redirect, got %d", rec.Code)
+	}
+	if _, ok := session.Get(sid); ok {
+		t.Fatalf("expected session to be removed")
+	}
+}
+
+// TestLoginButtonOrder verifies the login buttons follow ProviderOrder.
+func TestLoginButtonOrder(t *testing.T) {
+	prevOrder, prevFake := config.Cfg.ProviderOrder, config.Cfg.FakeOAuthEnabled
+	config.Cfg.ProviderOrder, config.Cfg.FakeOAuthEnabled = []string{"x", "fake", "github"}, true
+	defer func() { config.Cfg.ProviderOrder, config.Cfg.FakeOAuthEnabled = prevOrder, prevFake }()
+
+	rec := httptest.NewRecorder()
+	loginPageHandler(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	body := rec.Body.String()
+	last := -1
+	for _, path := range []string{"/login/x", "/login/fake", "/login/github"} {
+		i := strings.Index(body, `href="`+path+`"`)
+		if i < 0 {
+			t.Fatalf("expected a button for %s", path)
+		}
+		if i < last {
+			t.Fatalf("expected %s after the previous button", path)
+		}
+		last = i
+	}
+}
+
+// TestLoginPage verifies an anonymous GET /login renders login.ghtml, while a
+// signed-in user is sent home instead.
+func TestLoginPage(t *testing.T) {
+	rec := httptest.NewRecorder()
+	loginPageHandler(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "<title>Escolha um provedor</title>") {
+		t.Fatalf("expected the login template, got %d %q", rec.Code, body)
+	}
+	if strings.Contains(body, "Bem-vindo") {
+		t.Fatalf("expected no home page content on /login")
+	}
+
+	req, _ := authedRequest(t, http.MethodGet, "/login", user.User{ID: "1", Login: "ana"})
+	rec = httptest.NewRecorder()
+	loginPageHandler(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != config.Cfg.BaseURL+"/" {
+		t.Fatalf("expected redirect home, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+// TestValidateFakeRedirect verifies empty, malformed and colliding redirect
+// paths are rejected, including paths registered only for POST.
+func TestValidateFakeRedirect(t *testing.T) {
+	mux := routes()
+	for _, path := range []string{"", "fake/callback", "/a?b=c", "/me", "/", "/assets/cb", githubCallbackPath, "/logout", "/profile"} {
+		if err := validateFakeRedirect(mux, path); err == nil {
+			t.Fatalf("expected %q to be rejected", path)
+		}
+	}
+	if err := validateFakeRedirect(mux, "/fake/oauth/callback"); err != nil {
+		t.Fatalf("expected default path to be accepted: %v", err)
+	}
+}
+
+// TestLoginProvidersJSON verifies /login lists the enabled providers and their
+// URLs as JSON when asked for it.
+func TestLoginProvidersJSON(t *testing.T) {
+	prevOrder, prevFake := config.Cfg.ProviderOrder, config.Cfg.FakeOAuthEnabled
+	config.Cfg.ProviderOrder, config.Cfg.FakeOAuthEnabled = []string{"github", "x"}, false
+	defer func() { config.Cfg.ProviderOrder, config.Cfg.FakeOAuthEnabled = prevOrder, prevFake }()
+
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	loginPageHandler(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON, got %q", ct)
+	}
+	var got []struct {
+		Name    string `json:"name"`
+		URL     string `json:"url"`
+		Display string `json:"display"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 2 ||
+		got[0].Name != "github" || got[0].URL != "/login/github" || got[0].Display != "GitHub" ||
+		got[1].Name != "x" || got[1].URL != "/login/x" {
+		t.Fatalf("unexpected providers %+v", got)
+	}
+}
+
+// TestDBStatsEndpoint verifies /debug/dbstats needs the admin token, a plain
+// session is not enough, and returns the pool statistics as JSON.
+func TestDBStatsEndpoint(t *testing.T) {
+	useTestDB(t)
+	prev := config.Cfg.AdminToken
+	config.Cfg.AdminToken = "admin-secret"
+	defer func() { config.Cfg.AdminToken = prev }()
+	h := routes()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/dbstats", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without the token, got %d", rec.Code)
+	}
+
+	req, _ := authedRequest(t, http.MethodGet, "/debug/dbstats", user.User{ID: "1", Login: "alice"})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a signed-in non-admin, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/debug/dbstats", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var st struct {
+		RW       struct{ MaxOpenConnections int } `json:"rw"`
+		PageSize int                              `json:"page_size"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if st.RW.MaxOpenConnections != 1 || st.PageSize <= 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+// TestSecurityHeadersHSTS verifies HSTS is sent only for requests that arrived
+// over HTTPS, including via a trusted proxy.
+func TestSecurityHeadersHSTS(t *testing.T) {
+	prev := config.Cfg.TrustProxy
+	t.Cleanup(func() { config.Cfg.TrustProxy = prev })
+	h := securityHeaders(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	for _, trust := range []bool{false, true} {
+		config.Cfg.TrustProxy = trust
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Strict-Transport-Security") != ""; got != trust {
+			t.Fatalf("TrustProxy=%v: expected HSTS %v, got %v", trust, trust, got)
+		}
+	}
+}
+
+// TestHealthzProbesDB verifies /healthz reports ok on a working database and
+// 503 degraded once the handle is closed.
+func TestHealthzProbesDB(t *testing.T) {
+	s := useTestDB(t)
+
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Fatalf("expected 200 ok, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	s.Close()
+	rec = httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with a closed db, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"status":"degraded"}` {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
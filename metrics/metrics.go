@@ -0,0 +1,179 @@
+// Package metrics provides atomic Counter, Gauge and Histogram primitives and
+// renders every registered metric in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var registry = struct {
+	sync.Mutex
+	m map[string]metric
+}{
+	m: make(map[string]metric),
+}
+
+type metric interface {
+	write(w io.Writer, name string) error
+	kind() string
+	helpText() string
+}
+
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.m[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	registry.m[name] = m
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	help string
+	v    atomic.Uint64
+}
+
+// NewCounter creates and registers a counter. It panics if name is taken.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{help: help}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+func (c *Counter) kind() string     { return "counter" }
+func (c *Counter) helpText() string { return c.help }
+func (c *Counter) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	return err
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	help string
+	v    atomic.Int64
+}
+
+// NewGauge creates and registers a gauge. It panics if name is taken.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{help: help}
+	register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(n int64)  { g.v.Store(n) }
+func (g *Gauge) Add(n int64)  { g.v.Add(n) }
+func (g *Gauge) Inc()         { g.v.Add(1) }
+func (g *Gauge) Dec()         { g.v.Add(-1) }
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+func (g *Gauge) kind() string     { return "gauge" }
+func (g *Gauge) helpText() string { return g.help }
+func (g *Gauge) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, g.Value())
+	return err
+}
+
+// Histogram counts observations into buckets with fixed upper bounds.
+type Histogram struct {
+	help    string
+	bounds  []float64       // sorted upper bounds; +Inf is implicit
+	buckets []atomic.Uint64 // per-bucket (non-cumulative) counts, len(bounds)+1
+	count   atomic.Uint64
+	sumBits atomic.Uint64 // float64 bits of the sum
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper
+// bounds. It panics if name is taken.
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	h := &Histogram{help: help, bounds: b, buckets: make([]atomic.Uint64, len(b)+1)}
+	register(name, h)
+	return h
+}
+
+// Observe records v in the first bucket whose upper bound is >= v.
+func (h *Histogram) Observe(v float64) {
+	h.buckets[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if h.sumBits.CompareAndSwap(old, sum) {
+			return
+		}
+	}
+}
+
+// Buckets returns the cumulative count for each bound, followed by the +Inf
+// bucket (the total count).
+func (h *Histogram) Buckets() []uint64 {
+	out := make([]uint64, len(h.buckets))
+	var acc uint64
+	for i := range h.buckets {
+		acc += h.buckets[i].Load()
+		out[i] = acc
+	}
+	return out
+}
+
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+func (h *Histogram) Sum() float64  { return math.Float64frombits(h.sumBits.Load()) }
+
+func (h *Histogram) kind() string     { return "histogram" }
+func (h *Histogram) helpText() string { return h.help }
+func (h *Histogram) write(w io.Writer, name string) error {
+	for i, n := range h.Buckets() {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, n); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n",
+		name, strconv.FormatFloat(h.Sum(), 'g', -1, 64), name, h.Count())
+	return err
+}
+
+// Write renders all registered metrics, sorted by name, in the Prometheus
+// text exposition format.
+func Write(w io.Writer) error {
+	registry.Lock()
+	ms := make(map[string]metric, len(registry.m))
+	names := make([]string, 0, len(registry.m))
+	for name, m := range registry.m {
+		ms[name] = m
+		names = append(names, name)
+	}
+	registry.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		m := ms[name]
+		if h := m.helpText(); h != "" {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, h); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind()); err != nil {
+			return err
+		}
+		if err := m.write(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestCounterConcurrent verifies concurrent increments add up to the total.
+func TestCounterConcurrent(t *testing.T) {
+	c := NewCounter("test_concurrent_total", "")
+	g := NewGauge("test_concurrent_gauge", "")
+	const workers, perWorker = 50, 1000
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for range perWorker {
+				c.Inc()
+				g.Inc()
+			}
+		})
+	}
+	wg.Wait()
+	if got := c.Value(); got != workers*perWorker {
+		t.Fatalf("expected counter %d, got %d", workers*perWorker, got)
+	}
+	if got := g.Value(); got != workers*perWorker {
+		t.Fatalf("expected gauge %d, got %d", workers*perWorker, got)
+	}
+}
+
+// TestHistogramBuckets verifies observations land in the first bucket whose
+// bound is >= the value and that buckets are reported cumulatively.
+func TestHistogramBuckets(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "Test latency.", []float64{5, 1, 10})
+	for _, v := range []float64{0.5, 1, 3, 7, 20} {
+		h.Observe(v)
+	}
+	want := []uint64{2, 3, 4, 5}
+	got := h.Buckets()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected buckets %v, got %v", want, got)
+		}
+	}
+	if h.Count() != 5 || h.Sum() != 31.5 {
+		t.Fatalf("expected count 5 sum 31.5, got %d %v", h.Count(), h.Sum())
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 5`,
+		"test_latency_seconds_count 5",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("expected output to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
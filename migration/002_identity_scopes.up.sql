@@ -0,0 +1,3 @@
+-- Scopes actually granted by the provider (space separated), which may be
+-- fewer than requested.
+ALTER TABLE identities ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+ALTER TABLE identities DROP COLUMN token_expires_at;
+ALTER TABLE identities DROP COLUMN refresh_token;
+ALTER TABLE identities DROP COLUMN access_token;
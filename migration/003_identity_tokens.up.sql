@@ -0,0 +1,5 @@
+-- Provider tokens, encrypted by the application (key-id prefixed AES-GCM).
+-- Empty when token storage is disabled.
+ALTER TABLE identities ADD COLUMN access_token TEXT NOT NULL DEFAULT '';
+ALTER TABLE identities ADD COLUMN refresh_token TEXT NOT NULL DEFAULT '';
+ALTER TABLE identities ADD COLUMN token_expires_at INTEGER NOT NULL DEFAULT 0;
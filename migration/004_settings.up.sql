@@ -0,0 +1,6 @@
+-- Runtime settings changed without a deploy (e.g. maintenance_banner).
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,13 @@
+-- Server-side sessions kept by session.SQLiteStore.
+CREATE TABLE sessions (
+    sid TEXT PRIMARY KEY,
+    user_json TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    csrf TEXT NOT NULL DEFAULT '',
+    first_login INTEGER NOT NULL DEFAULT 0,
+    last_seen INTEGER NOT NULL DEFAULT 0,
+    -- Client that created the session.
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_sessions_expires_at ON sessions(expires_at);
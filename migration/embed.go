@@ -0,0 +1,7 @@
+// Package migration embeds the SQL schema files so the binary can apply them.
+package migration
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
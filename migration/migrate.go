@@ -0,0 +1,93 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"edev/db"
+)
+
+var upFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.up\.sql$`)
+
+// Migration is one embedded up script.
+type Migration struct {
+	Version int
+	Name    string
+	File    string
+}
+
+// List returns the embedded up migrations ordered by version.
+func List() ([]Migration, error) {
+	entries, err := fs.ReadDir(FS, ".")
+	if err != nil {
+		return nil, err
+	}
+	var out []Migration
+	for _, e := range entries {
+		m := upFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		v, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", e.Name(), err)
+		}
+		out = append(out, Migration{Version: v, Name: m[2], File: e.Name()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Load reads the embedded up scripts as db.Migrations, each with its
+// matching .down.sql script when one exists.
+func Load() ([]db.Migration, error) {
+	ms, err := List()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]db.Migration, 0, len(ms))
+	for _, m := range ms {
+		b, err := FS.ReadFile(m.File)
+		if err != nil {
+			return nil, err
+		}
+		down, err := FS.ReadFile(strings.TrimSuffix(m.File, ".up.sql") + ".down.sql")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		out = append(out, db.Migration{Version: m.Version, Name: m.Name, Up: string(b), Down: string(down)})
+	}
+	return out, nil
+}
+
+// Up applies every embedded migration not yet recorded in schema_migrations,
+// each in its own transaction, and returns the versions it applied.
+func Up(s *db.SQLite) ([]int, error) {
+	ms, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := s.Pending(ms)
+	if err != nil {
+		return nil, err
+	}
+	var applied []int
+	for _, m := range pending {
+		if err := s.Migrate([]db.Migration{m}); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m.Version)
+	}
+	return applied, nil
+}
+
+// Down rolls the database back to toVersion using the down scripts recorded
+// when each migration was applied.
+func Down(s *db.SQLite, toVersion int) error {
+	return db.Rollback(s, toVersion)
+}
@@ -0,0 +1,78 @@
+package migration
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"edev/db"
+	"edev/log"
+)
+
+// TestUpLogsVersion verifies applying a migration logs its version once and a
+// second run applies nothing.
+func TestUpLogsVersion(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetLevel(log.LevelInfo)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.LevelDebug)
+	}()
+
+	s, err := db.NewWithPath(db.MemoryPath)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer s.Close()
+
+	applied, err := Up(s)
+	if err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if len(applied) == 0 || applied[0] != 1 {
+		t.Fatalf("expected migration 1 to be applied, got %v", applied)
+	}
+	if !strings.Contains(buf.String(), "migration applied version=1 name=base_system") {
+		t.Fatalf("expected version in log, got %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "sql:\n") {
+		t.Fatalf("expected full SQL only at debug level")
+	}
+
+	applied, err = Up(s)
+	if err != nil {
+		t.Fatalf("second up: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("expected nothing to apply, got %v", applied)
+	}
+}
+
+// TestDownUndoesEmbedded verifies every embedded migration can be rolled back
+// and applied again.
+func TestDownUndoesEmbedded(t *testing.T) {
+	s, err := db.NewWithPath(db.MemoryPath)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := Up(s); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if err := Down(s, 0); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name IN ('users', 'identities', 'settings', 'sessions')`).Scan(&n); err != nil {
+		t.Fatalf("count tables: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected schema tables dropped, %d left", n)
+	}
+	if applied, err := Up(s); err != nil || len(applied) == 0 {
+		t.Fatalf("expected migrations to reapply, got %v err=%v", applied, err)
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 
 	"edev/config"
 	"edev/log"
@@ -20,13 +21,13 @@ type FakeProvider struct{}
 func (FakeProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	state := utils.NewOpaqueID()
 	verifier, challenge := utils.MakePKCE()
-	putState(state, verifier, 5*time.Minute)
+	putState(state, verifier, config.Cfg.StateTTL)
 	redir := config.Cfg.FakeOAuthBaseURL + "/oauth/authorize?response_type=code&client_id=" +
 		url.QueryEscape(config.Cfg.FakeOAuthClientID) +
-		"&redirect_uri=" + url.QueryEscape(config.Cfg.BaseURL+config.Cfg.FakeOAuthRedirect) +
+		"&redirect_uri=" + url.QueryEscape(config.AbsURL(config.Cfg.FakeOAuthRedirect)) +
 		"&scope=profile+email&state=" + url.QueryEscape(state) +
 		"&code_challenge=" + url.QueryEscape(challenge) + "&code_challenge_method=S256"
-	http.Redirect(w, r, redir, http.StatusFound)
+	redirectToProvider(w, r, redir, state)
 }
 
 func (FakeProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
@@ -35,9 +36,9 @@ func (FakeProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing state", http.StatusBadRequest)
 		return
 	}
-	verifier, ok := takeState(recvState)
-	if !ok {
-		http.Error(w, "invalid state", http.StatusBadRequest)
+	verifier, err := takeStateFor(w, r, recvState)
+	if err != nil {
+		writeStateError(w, err)
 		return
 	}
 	code := r.URL.Query().Get("code")
@@ -45,13 +46,18 @@ func (FakeProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing code", http.StatusBadRequest)
 		return
 	}
+	ctx, cancel := providerContext(r.Context(), config.Cfg.FakeOAuthTimeout)
+	defer cancel()
+
 	form := url.Values{}
 	form.Set("grant_type", "authorization_code")
 	form.Set("code", code)
-	form.Set("redirect_uri", config.Cfg.BaseURL+config.Cfg.FakeOAuthRedirect)
+	form.Set("redirect_uri", config.AbsURL(config.Cfg.FakeOAuthRedirect))
 	form.Set("client_id", config.Cfg.FakeOAuthClientID)
 	form.Set("code_verifier", verifier)
-	resp, err := http.Post(config.Cfg.FakeOAuthBaseURL+"/oauth/token", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, config.Cfg.FakeOAuthBaseURL+"/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		http.Error(w, "token exchange failed", http.StatusBadGateway)
 		return
@@ -76,30 +82,54 @@ func (FakeProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "empty access_token", http.StatusBadGateway)
 		return
 	}
-	// userinfo
-	req, _ := http.NewRequest("GET", config.Cfg.FakeOAuthBaseURL+"/oauth/userinfo", nil)
-	req.Header.Set("Authorization", "Bearer "+tokResp.AccessToken)
-	uiResp, err := http.DefaultClient.Do(req)
+	u, err := fetchUserinfo(ctx, "fake:"+tokResp.AccessToken, func(ctx context.Context) (user.User, error) {
+		return fetchFakeUser(ctx, tokResp.AccessToken)
+	})
 	if err != nil {
-		http.Error(w, "userinfo failed", http.StatusBadGateway)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !emailAllowed(u.Email) {
+		writeNotPermitted(w, "fake", u.Email)
 		return
 	}
+	u, created, err := persistUser(r, "fake", u)
+	if err != nil {
+		writePersistError(w, err)
+		return
+	}
+	saveProviderTokens("fake", u, user.Tokens{Access: tokResp.AccessToken})
+
+	oldSID, _ := session.GetCookie(r)
+	sid := session.RotateWithMeta(oldSID, u, clientIP(r), r.UserAgent())
+	if created {
+		session.MarkFirstLogin(sid)
+	}
+	session.SetCookie(w, sid)
+	loginsTotal.Inc()
+	setLastProvider(w, r, "fake")
+	redirectAfterLogin(w, r)
+}
+
+// fetchFakeUser calls the fake server's userinfo endpoint with accessToken.
+func fetchFakeUser(ctx context.Context, accessToken string) (user.User, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", config.Cfg.FakeOAuthBaseURL+"/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	uiResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return user.User{}, errors.New("userinfo failed")
+	}
 	defer func() {
 		if cerr := uiResp.Body.Close(); cerr != nil {
 			log.Printf("close userinfo body: %v", cerr)
 		}
 	}()
 	if uiResp.StatusCode != http.StatusOK {
-		http.Error(w, "userinfo status", http.StatusBadGateway)
-		return
+		return user.User{}, errors.New("userinfo status")
 	}
-	var raw map[string]string
-	if err := json.NewDecoder(uiResp.Body).Decode(&raw); err != nil {
-		http.Error(w, "decode userinfo", http.StatusBadGateway)
-		return
+	var fu fakeUser
+	if err := json.NewDecoder(uiResp.Body).Decode(&fu); err != nil {
+		return user.User{}, errors.New("decode userinfo")
 	}
-	sid := utils.NewOpaqueID()
-	session.Put(sid, user.User{ID: raw["id"], Login: raw["username"], Name: raw["name"], AvatarURL: raw["avatar_url"]})
-	session.SetCookie(w, sid, 8*time.Hour)
-	http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
+	return profileToUser(fu.toProfile()), nil
 }
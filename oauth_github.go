@@ -3,10 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
+	"slices"
 
 	"edev/config"
 	"edev/log"
@@ -22,14 +23,21 @@ type OAuthProvider interface {
 	CallbackHandler(w http.ResponseWriter, r *http.Request)
 }
 
+const githubCallbackPath = "/github/oauth/callback"
+
+// githubAPIURL is the REST API base; a variable so tests can point it at a stub.
+var githubAPIURL = "https://api.github.com"
+
+var githubDefaultScopes = []string{"read:user"}
+
 type GitHubProvider struct{}
 
 func (GitHubProvider) config() *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     config.Cfg.GitHubClientID,
 		ClientSecret: config.Cfg.GitHubClientSecret,
-		RedirectURL:  config.Cfg.BaseURL + "/github/oauth/callback",
-		Scopes:       []string{"read:user"},
+		RedirectURL:  config.AbsURL(githubCallbackPath),
+		Scopes:       configuredScopes(githubDefaultScopes, config.Cfg.GitHubScopes, config.Cfg.GitHubScopesMode),
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://github.com/login/oauth/authorize",
 			TokenURL: "https://github.com/login/oauth/access_token",
@@ -40,7 +48,7 @@ func (GitHubProvider) config() *oauth2.Config {
 func (p GitHubProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	state := utils.NewOpaqueID()
 	verifier, challenge := utils.MakePKCE()
-	putState(state, verifier, 10*time.Minute)
+	putState(state, verifier, config.Cfg.StateTTL)
 
 	oc := p.config()
 	authURL := oc.AuthCodeURL(
@@ -48,7 +56,7 @@ func (p GitHubProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		oauth2.SetAuthURLParam("code_challenge", challenge),
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
 	)
-	http.Redirect(w, r, authURL, http.StatusFound)
+	redirectToProvider(w, r, authURL, state)
 }
 
 func (p GitHubProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
@@ -57,9 +65,9 @@ func (p GitHubProvider) CallbackHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "missing state", http.StatusBadRequest)
 		return
 	}
-	verifier, ok := takeState(recvState)
-	if !ok {
-		http.Error(w, "invalid/expired state", http.StatusBadRequest)
+	verifier, err := takeStateFor(w, r, recvState)
+	if err != nil {
+		writeStateError(w, err)
 		return
 	}
 	code := r.URL.Query().Get("code")
@@ -68,7 +76,7 @@ func (p GitHubProvider) CallbackHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := providerContext(r.Context(), config.Cfg.GitHubTimeout)
 	defer cancel()
 	oc := p.config()
 
@@ -79,14 +87,50 @@ func (p GitHubProvider) CallbackHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	client := oc.Client(ctx, tok)
-	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.github.com/user", nil)
+	u, err := fetchUserinfo(ctx, "github:"+tok.AccessToken, func(ctx context.Context) (user.User, error) {
+		return p.fetchUser(ctx, client)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if sc := tokenScopes(tok); sc != nil {
+		u.Scopes = sc
+	}
+
+	if !emailAllowed(u.Email) {
+		writeNotPermitted(w, "github", u.Email)
+		return
+	}
+	u, created, err := persistUser(r, "github", u)
+	if err != nil {
+		writePersistError(w, err)
+		return
+	}
+	saveProviderTokens("github", u, user.Tokens{Access: tok.AccessToken, Refresh: tok.RefreshToken, Expiry: tok.Expiry})
+
+	oldSID, _ := session.GetCookie(r)
+	sid := session.RotateWithMeta(oldSID, u, clientIP(r), r.UserAgent())
+	if created {
+		session.MarkFirstLogin(sid)
+	}
+	session.SetCookie(w, sid)
+	loginsTotal.Inc()
+	setLastProvider(w, r, "github")
+
+	redirectAfterLogin(w, r)
+}
+
+// fetchUser loads the authenticated GitHub user using the token-bearing client.
+func (GitHubProvider) fetchUser(ctx context.Context, client *http.Client) (user.User, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", githubAPIURL+"/user", nil)
 	req.Header.Set("Accept", "application/vnd.github+json")
 	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, "github /user failed: "+err.Error(), http.StatusBadGateway)
-		return
+		return user.User{}, fmt.Errorf("github /user failed: %w", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -95,43 +139,77 @@ func (p GitHubProvider) CallbackHandler(w http.ResponseWriter, r *http.Request)
 	}()
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		http.Error(w,
-			fmt.Sprintf(
-				"user endpoint status %d: %s",
-				resp.StatusCode,
-				string(b)),
-			http.StatusBadGateway)
-		return
+		return user.User{}, fmt.Errorf(
+			"user endpoint status %d: %s",
+			resp.StatusCode,
+			string(b))
 	}
 
-	var gu struct {
-		ID        int64  `json:"id"`
-		Login     string `json:"login"`
-		Name      string `json:"name"`
-		AvatarURL string `json:"avatar_url"`
-	}
+	var gu githubUser
 	err = json.NewDecoder(resp.Body).Decode(&gu)
 	if err != nil {
-		http.Error(w, "decode user failed", http.StatusBadGateway)
-		return
+		return user.User{}, errors.New("decode user failed")
 	}
 
 	if gu.ID == 0 || gu.Login == "" {
-		http.Error(w, "invalid user data", http.StatusBadGateway)
-		return
+		return user.User{}, errors.New("invalid user data")
 	}
 
 	log.Printf("logged in user: ID=%d, Login=%s, Name=%s, AvatarURL=%s",
 		gu.ID, gu.Login, gu.Name, gu.AvatarURL)
 
-	sid := utils.NewOpaqueID()
-	session.Put(sid, user.User{
-		ID:        fmt.Sprintf("%d", gu.ID),
-		Login:     gu.Login,
-		Name:      gu.Name,
-		AvatarURL: gu.AvatarURL,
-	})
-	session.SetCookie(w, sid, 8*time.Hour)
+	// A private email is left out of /user; /user/emails has it, but only
+	// answers tokens granted user:email (or the broader user scope).
+	scopes := parseScopes(resp.Header.Get("X-OAuth-Scopes"))
+	if gu.Email == "" {
+		if slices.Contains(scopes, "user:email") || slices.Contains(scopes, "user") {
+			email, err := fetchGitHubPrimaryEmail(ctx, client)
+			if err != nil {
+				log.Printf("github /user/emails: %v", err)
+			}
+			gu.Email = email
+		} else {
+			log.Debugf("github: no public email and no user:email scope (granted %q); skipping /user/emails", scopes)
+		}
+	}
+
+	u := profileToUser(gu.toProfile())
+	u.Scopes = scopes
+	return u, nil
+}
+
+// fetchGitHubPrimaryEmail returns the user's primary verified address from
+// /user/emails, or "" when there is none.
+func fetchGitHubPrimaryEmail(ctx context.Context, client *http.Client) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", githubAPIURL+"/user/emails", nil)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Error closing response body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
 
-	http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&emails); err != nil {
+		return "", errors.New("decode emails failed")
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", nil
 }
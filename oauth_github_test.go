@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"edev/config"
+
+	"golang.org/x/oauth2"
+)
+
+// TestProviderTimeout verifies a configured short timeout makes a slow
+// userinfo endpoint fail with a deadline error.
+func TestProviderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	prevURL, prevTimeout := githubAPIURL, config.Cfg.GitHubTimeout
+	githubAPIURL, config.Cfg.GitHubTimeout = srv.URL, 50*time.Millisecond
+	defer func() { githubAPIURL, config.Cfg.GitHubTimeout = prevURL, prevTimeout }()
+
+	ctx, cancel := providerContext(context.Background(), config.Cfg.GitHubTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := gitHubProvider.fetchUser(ctx, srv.Client())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected fetch to abort near the timeout, took %s", d)
+	}
+}
+
+// TestGrantedScopesRecorded verifies partial scopes reported by GitHub are
+// stored with the identity.
+func TestGrantedScopesRecorded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-OAuth-Scopes", "read:user")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":7,"login":"scoped"}`))
+	}))
+	defer srv.Close()
+	prev := githubAPIURL
+	githubAPIURL = srv.URL
+	defer func() { githubAPIURL = prev }()
+
+	s := useTestDB(t)
+	u, err := gitHubProvider.fetchUser(context.Background(), srv.Client())
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if _, _, err := persistUser(httptest.NewRequest(http.MethodGet, "/", nil), "github", u); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	var scopes string
+	if err := s.QueryRow(`SELECT scopes FROM identities WHERE provider = 'github' AND provider_uid = '7'`).Scan(&scopes); err != nil {
+		t.Fatalf("read scopes: %v", err)
+	}
+	if scopes != "read:user" {
+		t.Fatalf("expected scopes %q, got %q", "read:user", scopes)
+	}
+
+	tok := (&oauth2.Token{AccessToken: "t"}).WithExtra(map[string]any{"scope": "read:user,user:email"})
+	if got := tokenScopes(tok); len(got) != 2 || got[1] != "user:email" {
+		t.Fatalf("expected token scopes parsed, got %v", got)
+	}
+}
+
+// TestLoginJSONMode verifies ?json=1 returns a well-formed authorize URL
+// instead of redirecting, and that its state is stored.
+func TestLoginJSONMode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	gitHubProvider.LoginHandler(rec, httptest.NewRequest(http.MethodGet, "/login/github?json=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var body struct {
+		AuthorizeURL string `json:"authorize_url"`
+		State        string `json:"state"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	u, err := url.Parse(body.AuthorizeURL)
+	if err != nil || u.Host != "github.com" {
+		t.Fatalf("expected a github authorize URL, got %q", body.AuthorizeURL)
+	}
+	q := u.Query()
+	if q.Get("state") != body.State || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("unexpected authorize query %v", q)
+	}
+	if _, err := takeState(body.State); err != nil {
+		t.Fatalf("expected state to be stored: %v", err)
+	}
+}
+
+// TestGitHubEmailsNeedScope verifies /user/emails is only called when the
+// token was granted user:email, and that its primary verified address is used.
+func TestGitHubEmailsNeedScope(t *testing.T) {
+	for _, tc := range []struct {
+		scopes    string
+		wantCall  bool
+		wantEmail string
+	}{
+		{"read:user", false, ""},
+		{"read:user, user:email", true, "octo@example.com"},
+	} {
+		emailsCalled := false
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/user":
+				w.Header().Set("X-OAuth-Scopes", tc.scopes)
+				_, _ = w.Write([]byte(`{"id":9,"login":"octo","email":null}`))
+			case "/user/emails":
+				emailsCalled = true
+				_, _ = w.Write([]byte(`[{"email":"old@example.com","primary":false,"verified":true},` +
+					`{"email":"Octo@Example.com","primary":true,"verified":true}]`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		prev := githubAPIURL
+		githubAPIURL = srv.URL
+
+		u, err := gitHubProvider.fetchUser(context.Background(), srv.Client())
+		githubAPIURL = prev
+		srv.Close()
+		if err != nil {
+			t.Fatalf("scopes %q: fetch: %v", tc.scopes, err)
+		}
+		if emailsCalled != tc.wantCall {
+			t.Fatalf("scopes %q: /user/emails called=%v, want %v", tc.scopes, emailsCalled, tc.wantCall)
+		}
+		if u.Email != tc.wantEmail {
+			t.Fatalf("scopes %q: expected email %q, got %q", tc.scopes, tc.wantEmail, u.Email)
+		}
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
 
 	"edev/config"
 	"edev/log"
@@ -17,14 +17,21 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const xCallbackPath = "/x/oauth/callback"
+
+// xAPIURL is the X API base; a variable so tests can point it at a stub.
+var xAPIURL = "https://api.x.com"
+
+var xDefaultScopes = []string{"tweet.read", "users.read"}
+
 type XProvider struct{}
 
 func (XProvider) config() *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     config.Cfg.XClientID,
 		ClientSecret: config.Cfg.XClientSecret,
-		RedirectURL:  config.Cfg.BaseURL + "/x/oauth/callback",
-		Scopes:       []string{"tweet.read", "users.read"},
+		RedirectURL:  config.AbsURL(xCallbackPath),
+		Scopes:       configuredScopes(xDefaultScopes, config.Cfg.XScopes, config.Cfg.XScopesMode),
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://twitter.com/i/oauth2/authorize",
 			TokenURL: "https://api.twitter.com/2/oauth2/token",
@@ -35,7 +42,7 @@ func (XProvider) config() *oauth2.Config {
 func (p XProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	state := utils.NewOpaqueID()
 	verifier, challenge := utils.MakePKCE()
-	putState(state, verifier, 10*time.Minute)
+	putState(state, verifier, config.Cfg.StateTTL)
 
 	oc := p.config()
 	authURL := oc.AuthCodeURL(
@@ -43,7 +50,7 @@ func (p XProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		oauth2.SetAuthURLParam("code_challenge", challenge),
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
 	)
-	http.Redirect(w, r, authURL, http.StatusFound)
+	redirectToProvider(w, r, authURL, state)
 }
 
 func (p XProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
@@ -52,9 +59,9 @@ func (p XProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing state", http.StatusBadRequest)
 		return
 	}
-	verifier, ok := takeState(recvState)
-	if !ok {
-		http.Error(w, "invalid/expired state", http.StatusBadRequest)
+	verifier, err := takeStateFor(w, r, recvState)
+	if err != nil {
+		writeStateError(w, err)
 		return
 	}
 	code := r.URL.Query().Get("code")
@@ -63,7 +70,7 @@ func (p XProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := providerContext(r.Context(), config.Cfg.XTimeout)
 	defer cancel()
 	oc := p.config()
 
@@ -74,18 +81,53 @@ func (p XProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := oc.Client(ctx, tok)
+	u, err := fetchUserinfo(ctx, "x:"+tok.AccessToken, func(ctx context.Context) (user.User, error) {
+		return p.fetchUser(ctx, client)
+	})
+	if err != nil {
+		writeXError(w, err)
+		return
+	}
+
+	u.Scopes = tokenScopes(tok)
+
+	if !emailAllowed(u.Email) {
+		writeNotPermitted(w, "x", u.Email)
+		return
+	}
+	u, created, err := persistUser(r, "x", u)
+	if err != nil {
+		writePersistError(w, err)
+		return
+	}
+	saveProviderTokens("x", u, user.Tokens{Access: tok.AccessToken, Refresh: tok.RefreshToken, Expiry: tok.Expiry})
+
+	oldSID, _ := session.GetCookie(r)
+	sid := session.RotateWithMeta(oldSID, u, clientIP(r), r.UserAgent())
+	if created {
+		session.MarkFirstLogin(sid)
+	}
+	session.SetCookie(w, sid)
+	loginsTotal.Inc()
+	setLastProvider(w, r, "x")
+
+	redirectAfterLogin(w, r)
+}
+
+// fetchUser loads the authenticated X user from API v2, falling back to
+// v1.1 verify_credentials when v2 answers 403.
+func (XProvider) fetchUser(ctx context.Context, client *http.Client) (user.User, error) {
 	req, _ := http.NewRequestWithContext(
 		ctx,
 		http.MethodGet,
-		"https://api.x.com/2/users/me?user.fields=profile_image_url",
+		xAPIURL+"/2/users/me?user.fields=profile_image_url",
 		nil,
 	)
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, "x /2/users/me failed: "+err.Error(), http.StatusBadGateway)
-		return
+		return user.User{}, fmt.Errorf("x /2/users/me failed: %w", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -96,13 +138,12 @@ func (p XProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	if resp.StatusCode == http.StatusForbidden {
 		log.Printf("API v2 returned 403, trying fallback to API v1.1")
 
-		req, _ = http.NewRequestWithContext(ctx, "GET", "https://api.x.com/1.1/account/verify_credentials.json", nil)
+		req, _ = http.NewRequestWithContext(ctx, "GET", xAPIURL+"/1.1/account/verify_credentials.json", nil)
 		req.Header.Set("Accept", "application/json")
 
 		resp, err = client.Do(req)
 		if err != nil {
-			http.Error(w, "x verify_credentials failed: "+err.Error(), http.StatusBadGateway)
-			return
+			return user.User{}, fmt.Errorf("x verify_credentials failed: %w", err)
 		}
 		defer func() {
 			if err := resp.Body.Close(); err != nil {
@@ -112,80 +153,86 @@ func (p XProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 		if resp.StatusCode != http.StatusOK {
 			b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-			http.Error(w,
-				fmt.Sprintf("verify_credentials status %d: %s", resp.StatusCode, string(b)),
-				http.StatusBadGateway)
-			return
+			if xerr := mapXAPIError("verify_credentials", resp.StatusCode, b); xerr != nil {
+				return user.User{}, xerr
+			}
+			return user.User{}, fmt.Errorf("verify_credentials status %d: %s", resp.StatusCode, string(b))
 		}
 
-		var xuLegacy struct {
-			ID              string `json:"id_str"`
-			ScreenName      string `json:"screen_name"`
-			Name            string `json:"name"`
-			ProfileImageURL string `json:"profile_image_url_https"`
-		}
+		var xuLegacy xLegacyUser
 		if err := json.NewDecoder(resp.Body).Decode(&xuLegacy); err != nil {
-			http.Error(w, "decode user failed", http.StatusBadGateway)
-			return
+			return user.User{}, errors.New("decode user failed")
 		}
 
 		if xuLegacy.ID == "" || xuLegacy.ScreenName == "" {
-			http.Error(w, "invalid user data", http.StatusBadGateway)
-			return
+			return user.User{}, errors.New("invalid user data")
 		}
 
 		log.Printf("logged in X user (API v1.1): ID=%s, Username=%s, Name=%s, AvatarURL=%s",
 			xuLegacy.ID, xuLegacy.ScreenName, xuLegacy.Name, xuLegacy.ProfileImageURL)
 
-		sid := utils.NewOpaqueID()
-		session.Put(sid, user.User{
-			ID:        xuLegacy.ID,
-			Login:     xuLegacy.ScreenName,
-			Name:      xuLegacy.Name,
-			AvatarURL: xuLegacy.ProfileImageURL,
-		})
-		session.SetCookie(w, sid, 8*time.Hour)
-		http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
-		return
+		return profileToUser(xuLegacy.toProfile()), nil
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		http.Error(w,
-			fmt.Sprintf("users/me status %d: %s", resp.StatusCode, string(b)),
-			http.StatusBadGateway)
-		return
+		if xerr := mapXAPIError("users/me", resp.StatusCode, b); xerr != nil {
+			return user.User{}, xerr
+		}
+		return user.User{}, fmt.Errorf("users/me status %d: %s", resp.StatusCode, string(b))
 	}
 
 	var xu struct {
-		Data struct {
-			ID              string `json:"id"`
-			Username        string `json:"username"`
-			Name            string `json:"name"`
-			ProfileImageURL string `json:"profile_image_url"`
-		} `json:"data"`
+		Data xUser `json:"data"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&xu); err != nil {
-		http.Error(w, "decode user failed", http.StatusBadGateway)
-		return
+		return user.User{}, errors.New("decode user failed")
 	}
 
 	if xu.Data.ID == "" || xu.Data.Username == "" {
-		http.Error(w, "invalid user data", http.StatusBadGateway)
-		return
+		return user.User{}, errors.New("invalid user data")
 	}
 
 	log.Printf("logged in X user: ID=%s, Username=%s, Name=%s, AvatarURL=%s",
 		xu.Data.ID, xu.Data.Username, xu.Data.Name, xu.Data.ProfileImageURL)
 
-	sid := utils.NewOpaqueID()
-	session.Put(sid, user.User{
-		ID:        xu.Data.ID,
-		Login:     xu.Data.Username,
-		Name:      xu.Data.Name,
-		AvatarURL: xu.Data.ProfileImageURL,
-	})
-	session.SetCookie(w, sid, 8*time.Hour)
+	return profileToUser(xu.Data.toProfile()), nil
+}
+
+// xAPIError is a known X API failure with a message meant for the user.
+// The raw upstream body stays in the log only.
+type xAPIError struct {
+	Status  int    // status code answered to the browser
+	Message string // user-facing message
+	Detail  string // upstream endpoint, status and body
+}
 
-	http.Redirect(w, r, config.Cfg.BaseURL+"/", http.StatusFound)
+func (e *xAPIError) Error() string { return e.Detail }
+
+// writeXError answers a failed userinfo fetch: known X failures get their
+// mapped status and message, anything else a generic 502 with the error.
+func writeXError(w http.ResponseWriter, err error) {
+	var xerr *xAPIError
+	if errors.As(err, &xerr) {
+		http.Error(w, xerr.Message, xerr.Status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// mapXAPIError maps known X API status codes to user-facing errors and logs
+// them. It returns nil for unknown statuses, which keep the generic 502 path.
+func mapXAPIError(endpoint string, status int, body []byte) *xAPIError {
+	e := &xAPIError{Detail: fmt.Sprintf("%s status %d: %s", endpoint, status, body)}
+	switch status {
+	case http.StatusTooManyRequests:
+		e.Status, e.Message = http.StatusTooManyRequests, "X is rate limiting logins, please try again later"
+		log.Warnf("x api rate limited: %s", e.Detail)
+	case http.StatusUnauthorized:
+		e.Status, e.Message = http.StatusUnauthorized, "X authorization was rejected, please re-authorize"
+		log.Warnf("x api unauthorized: %s", e.Detail)
+	default:
+		return nil
+	}
+	return e
 }
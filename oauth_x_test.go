@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestXAPIErrorMapping verifies 429 and 401 from X reach the user as mapped
+// messages and unknown statuses keep the generic 502.
+func TestXAPIErrorMapping(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		wantCode int
+		wantMsg  string
+	}{
+		{http.StatusTooManyRequests, http.StatusTooManyRequests, "please try again later"},
+		{http.StatusUnauthorized, http.StatusUnauthorized, "please re-authorize"},
+		{http.StatusInternalServerError, http.StatusBadGateway, "users/me status 500"},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"title":"upstream"}`, tc.status)
+		}))
+		prev := xAPIURL
+		xAPIURL = srv.URL
+
+		_, err := xProvider.fetchUser(context.Background(), srv.Client())
+		xAPIURL = prev
+		srv.Close()
+		if err == nil {
+			t.Fatalf("status %d: expected an error", tc.status)
+		}
+
+		rec := httptest.NewRecorder()
+		writeXError(rec, err)
+		if rec.Code != tc.wantCode {
+			t.Fatalf("status %d: expected %d, got %d", tc.status, tc.wantCode, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), tc.wantMsg) {
+			t.Fatalf("status %d: expected message %q, got %q", tc.status, tc.wantMsg, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"edev/session"
+	"edev/utils"
+)
+
+const maxNameLen = 100
+
+// profileHandler updates the display name of the current session user.
+// Accepts a form field or a JSON body with "name".
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	sid, ok := session.GetCookie(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	u, ok := session.Get(sid)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var in struct {
+		Name string `json:"name"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&in); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	} else {
+		// PostFormValue, not FormValue: a name in the query string must not count.
+		in.Name = r.PostFormValue("name")
+	}
+
+	in.Name = strings.TrimSpace(in.Name)
+	verr := &ValidationError{}
+	switch {
+	case in.Name == "":
+		verr.Add("name", "required")
+	case utf8.RuneCountInString(in.Name) > maxNameLen:
+		verr.Add("name", "too long")
+	case utils.HasControl(in.Name):
+		verr.Add("name", "invalid characters")
+	}
+	if !verr.Empty() {
+		writeValidationError(w, r, verr)
+		return
+	}
+
+	u.Name = in.Name
+	if !session.Update(sid, u) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(u)
+}
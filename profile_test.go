@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"edev/session"
+	"edev/user"
+)
+
+// TestProfileValidation verifies an over-length name yields 422 with a JSON
+// field error and a valid one updates the session.
+func TestProfileValidation(t *testing.T) {
+	req, sid := authedRequest(t, http.MethodPost, "/profile", user.User{ID: "1", Login: "alice"})
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/profile", strings.NewReader(body))
+		r.Header.Set("Cookie", req.Header.Get("Cookie"))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		profileHandler(rec, r)
+		return rec
+	}
+
+	rec := post(`{"name":"` + strings.Repeat("a", maxNameLen+1) + `"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rec.Code)
+	}
+	var body struct {
+		Errors map[string]string `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body.Errors["name"] != "too long" {
+		t.Fatalf("expected name error, got %v", body.Errors)
+	}
+
+	rec = post(`{"name":"Alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if u, _ := session.Get(sid); u.Name != "Alice" {
+		t.Fatalf("expected session name updated, got %q", u.Name)
+	}
+}
+
+// TestProfileIgnoresQuery verifies a name passed in the query string instead
+// of the form body is not applied.
+func TestProfileIgnoresQuery(t *testing.T) {
+	req, sid := authedRequest(t, http.MethodPost, "/profile?name=Mallory", user.User{ID: "1", Login: "alice"})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	profileHandler(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a query-only name, got %d", rec.Code)
+	}
+	if u, _ := session.Get(sid); u.Name == "Mallory" {
+		t.Fatalf("expected query string name to be ignored")
+	}
+}
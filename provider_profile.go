@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"edev/config"
+	"edev/user"
+	"edev/utils"
+)
+
+// placeholderAvatar is shown when a user has no avatar; Gravatar also falls
+// back to it for addresses without an image.
+const placeholderAvatar = "/assets/favicon-96x96.png"
+
+// ProviderProfile is the provider-neutral shape of a userinfo response. Each
+// provider decodes its own payload and converts it with toProfile; the single
+// profileToUser mapping then applies the shared rules.
+type ProviderProfile struct {
+	Provider  string
+	ID        string
+	Login     string
+	Name      string
+	Email     string
+	AvatarURL string
+}
+
+// profileToUser maps p to a user.User: fields are trimmed and the email is
+// normalized (a malformed one is dropped, since it is optional). A name with
+// control characters and a non-http(s) avatar URL are dropped too; templates
+// fall back to the login. With GravatarFallback, a missing avatar is derived
+// from the email.
+func profileToUser(p ProviderProfile) user.User {
+	email, _ := utils.NormalizeEmail(p.Email)
+	name := strings.TrimSpace(p.Name)
+	if utils.HasControl(name) {
+		name = ""
+	}
+	avatar := utils.SafeImageURL(p.AvatarURL)
+	if avatar == "" && email != "" && config.Cfg.GravatarFallback {
+		avatar = gravatarURL(email)
+	}
+	return user.User{
+		ID:        strings.TrimSpace(p.ID),
+		Login:     strings.TrimSpace(p.Login),
+		Name:      name,
+		Email:     email,
+		AvatarURL: avatar,
+	}
+}
+
+// gravatarURL returns the Gravatar image for a normalized email, falling
+// back to placeholderAvatar when the address has none.
+func gravatarURL(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	q := url.Values{"s": {"96"}, "d": {config.AbsURL(placeholderAvatar)}}
+	return "https://" + gravatarHost + "/avatar/" + hex.EncodeToString(sum[:]) + "?" + q.Encode()
+}
+
+// githubUser is the subset of GitHub's /user response we use.
+type githubUser struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+func (g githubUser) toProfile() ProviderProfile {
+	return ProviderProfile{
+		Provider:  "github",
+		ID:        strconv.FormatInt(g.ID, 10),
+		Login:     g.Login,
+		Name:      g.Name,
+		Email:     g.Email,
+		AvatarURL: g.AvatarURL,
+	}
+}
+
+// xUser is the data object of X API v2 /2/users/me.
+type xUser struct {
+	ID              string `json:"id"`
+	Username        string `json:"username"`
+	Name            string `json:"name"`
+	ProfileImageURL string `json:"profile_image_url"`
+}
+
+func (x xUser) toProfile() ProviderProfile {
+	return ProviderProfile{
+		Provider:  "x",
+		ID:        x.ID,
+		Login:     x.Username,
+		Name:      x.Name,
+		AvatarURL: x.ProfileImageURL,
+	}
+}
+
+// xLegacyUser is the X API v1.1 verify_credentials response.
+type xLegacyUser struct {
+	ID              string `json:"id_str"`
+	ScreenName      string `json:"screen_name"`
+	Name            string `json:"name"`
+	ProfileImageURL string `json:"profile_image_url_https"`
+}
+
+func (x xLegacyUser) toProfile() ProviderProfile {
+	return ProviderProfile{
+		Provider:  "x",
+		ID:        x.ID,
+		Login:     x.ScreenName,
+		Name:      x.Name,
+		AvatarURL: x.ProfileImageURL,
+	}
+}
+
+// fakeUser is the fake provider's userinfo response.
+type fakeUser struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+func (f fakeUser) toProfile() ProviderProfile {
+	return ProviderProfile{
+		Provider:  "fake",
+		ID:        f.ID,
+		Login:     f.Username,
+		Name:      f.Name,
+		Email:     f.Email,
+		AvatarURL: f.AvatarURL,
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"edev/config"
+	"edev/user"
+)
+
+// TestProfileToUser verifies a GitHub and an X profile for the same person map
+// to equivalent users through the shared mapping.
+func TestProfileToUser(t *testing.T) {
+	var gu githubUser
+	if err := json.Unmarshal([]byte(`{"id":42,"login":"octo","name":" Octo Cat ","email":"Octo@Example.com","avatar_url":"https://a.test/o.png"}`), &gu); err != nil {
+		t.Fatalf("decode github: %v", err)
+	}
+	var xu xUser
+	if err := json.Unmarshal([]byte(`{"id":"42","username":"octo","name":"Octo Cat","profile_image_url":"https://a.test/o.png"}`), &xu); err != nil {
+		t.Fatalf("decode x: %v", err)
+	}
+
+	want := user.User{ID: "42", Login: "octo", Name: "Octo Cat", AvatarURL: "https://a.test/o.png"}
+	got := profileToUser(gu.toProfile())
+	if got.Email != "octo@example.com" {
+		t.Fatalf("expected normalized email, got %q", got.Email)
+	}
+	got.Email = ""
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("github: expected %+v, got %+v", want, got)
+	}
+	if got := profileToUser(xu.toProfile()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("x: expected %+v, got %+v", want, got)
+	}
+}
+
+// TestProfileToUserRejectsUnsafe verifies a name with control characters and a
+// non-http(s) avatar URL are dropped at capture time.
+func TestProfileToUserRejectsUnsafe(t *testing.T) {
+	u := profileToUser(ProviderProfile{
+		ID:        "1",
+		Login:     "mallory",
+		Name:      "Mal\x00lory\n<b>",
+		AvatarURL: "javascript:alert(1)",
+	})
+	if u.Name != "" || u.AvatarURL != "" {
+		t.Fatalf("expected unsafe name and avatar dropped, got %+v", u)
+	}
+	if u := profileToUser(ProviderProfile{ID: "1", Name: "Ana <b>"}); u.Name != "Ana <b>" {
+		t.Fatalf("expected printable name kept for template escaping, got %q", u.Name)
+	}
+}
+
+// TestProfileToUserGravatarFallback verifies an empty provider avatar with an
+// email becomes the Gravatar URL only when GravatarFallback is on.
+func TestProfileToUserGravatarFallback(t *testing.T) {
+	prev := config.Cfg.GravatarFallback
+	t.Cleanup(func() { config.Cfg.GravatarFallback = prev })
+
+	p := ProviderProfile{ID: "1", Login: "ana", Email: " Ana@Example.com "}
+
+	config.Cfg.GravatarFallback = false
+	if u := profileToUser(p); u.AvatarURL != "" {
+		t.Fatalf("expected no avatar when disabled, got %q", u.AvatarURL)
+	}
+
+	config.Cfg.GravatarFallback = true
+	u := profileToUser(p)
+	// sha256 of the trimmed, lower-cased address.
+	const want = "https://www.gravatar.com/avatar/8e43ca37701228e74983efdbd0cff5c16b3b1e5d4e29a7c05626d4d25a018e11"
+	if !strings.HasPrefix(u.AvatarURL, want+"?") {
+		t.Fatalf("expected %s?..., got %q", want, u.AvatarURL)
+	}
+	if !strings.Contains(u.AvatarURL, "d="+url.QueryEscape(config.AbsURL(placeholderAvatar))) {
+		t.Fatalf("expected placeholder as gravatar default, got %q", u.AvatarURL)
+	}
+
+	// A provider avatar always wins; no email means no fallback.
+	p.AvatarURL = "https://a.test/o.png"
+	if u := profileToUser(p); u.AvatarURL != p.AvatarURL {
+		t.Fatalf("expected provider avatar kept, got %q", u.AvatarURL)
+	}
+	if u := profileToUser(ProviderProfile{ID: "2"}); u.AvatarURL != "" {
+		t.Fatalf("expected no avatar without email, got %q", u.AvatarURL)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"edev/config"
+
+	"golang.org/x/oauth2"
+)
+
+// providerButton describes a login option rendered on /login.
+type providerButton struct {
+	Name      string // provider key, also used by the template to pick the icon
+	Display   string // short provider name
+	Label     string
+	LoginPath string
+	Class     string
+	Last      bool // the provider this browser signed in with last time
+}
+
+// loginButtons holds the metadata of every provider that can be shown,
+// filled by registerProvider.
+var loginButtons = make(map[string]providerButton)
+
+func init() {
+	registerProvider(providerButton{Name: "github", Display: "GitHub", Label: "Entrar com GitHub", LoginPath: "/login/github", Class: "btn-gh"})
+	registerProvider(providerButton{Name: "x", Display: "X", Label: "Entrar com X (Twitter)", LoginPath: "/login/x", Class: "btn-x"})
+	registerProvider(providerButton{Name: "fake", Display: "Fake OAuth", Label: "Login Fake OAuth", LoginPath: "/login/fake", Class: "btn-dev"})
+}
+
+// registerProvider adds b to loginButtons and panics when its name or login
+// path is taken, so a misconfigured provider fails at startup instead of
+// silently replacing another.
+func registerProvider(b providerButton) {
+	if err := addProvider(loginButtons, b); err != nil {
+		panic(err)
+	}
+}
+
+// addProvider is the non-panicking form of registerProvider for registry m.
+func addProvider(m map[string]providerButton, b providerButton) error {
+	if b.Name == "" {
+		return errors.New("providers: empty provider name")
+	}
+	if _, ok := m[b.Name]; ok {
+		return fmt.Errorf("providers: duplicate provider %q", b.Name)
+	}
+	for _, o := range m {
+		if o.LoginPath == b.LoginPath {
+			return fmt.Errorf("providers: %q and %q share login path %s", o.Name, b.Name, b.LoginPath)
+		}
+	}
+	m[b.Name] = b
+	return nil
+}
+
+// loginProviders returns the buttons in ProviderOrder. Unknown names are
+// skipped, and the fake provider is only listed when it is enabled (at the end
+// unless ProviderOrder places it).
+func loginProviders() []providerButton {
+	out := make([]providerButton, 0, len(loginButtons))
+	seen := make(map[string]bool, len(loginButtons))
+	add := func(name string) {
+		b, ok := loginButtons[name]
+		if !ok || seen[name] || (name == "fake" && !config.Cfg.FakeOAuthEnabled) {
+			return
+		}
+		seen[name] = true
+		out = append(out, b)
+	}
+	for _, name := range config.Cfg.ProviderOrder {
+		add(name)
+	}
+	add("fake")
+	return out
+}
+
+// writeProvidersJSON answers with the enabled providers in display order.
+func writeProvidersJSON(w http.ResponseWriter) {
+	type provider struct {
+		Name    string `json:"name"`
+		URL     string `json:"url"`
+		Display string `json:"display"`
+	}
+	buttons := loginProviders()
+	out := make([]provider, 0, len(buttons))
+	for _, b := range buttons {
+		out = append(out, provider{Name: b.Name, URL: b.LoginPath, Display: b.Display})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// parseScopes splits a scope list as providers send it: space separated
+// (OAuth 2 token responses) or comma separated (GitHub's X-OAuth-Scopes).
+func parseScopes(s string) []string {
+	f := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(f) == 0 {
+		return nil
+	}
+	return f
+}
+
+// tokenScopes returns the scopes granted in the token response, or nil when
+// the provider did not report them.
+func tokenScopes(tok *oauth2.Token) []string {
+	s, _ := tok.Extra("scope").(string)
+	return parseScopes(s)
+}
+
+// redirectToProvider sends the browser to the provider's authorize URL. SPAs
+// that run the OAuth dance themselves ask with Accept: application/json or
+// ?json=1 and get {authorize_url, state} instead of a 302; the state and
+// PKCE verifier (and the state cookie) are stored the same way in both modes.
+func redirectToProvider(w http.ResponseWriter, r *http.Request, authURL, state string) {
+	setStateCookie(w, r, state)
+	if !wantsJSON(r) && r.URL.Query().Get("json") != "1" {
+		http.Redirect(w, r, authURL, http.StatusFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		AuthorizeURL string `json:"authorize_url"`
+		State        string `json:"state"`
+	}{authURL, state})
+}
+
+// mergeScopes combines a provider's default scopes with the configured ones:
+// "append" (or "") adds configured to defaults, "replace" uses configured
+// alone (defaults when none are configured). Duplicates are dropped.
+func mergeScopes(defaults, configured []string, mode string) ([]string, error) {
+	var in []string
+	switch mode {
+	case "", "append":
+		in = append(append(in, defaults...), configured...)
+	case "replace":
+		in = configured
+		if len(in) == 0 {
+			in = defaults
+		}
+	default:
+		return nil, fmt.Errorf("invalid scopes mode %q (want append or replace)", mode)
+	}
+	out := make([]string, 0, len(in))
+	seen := make(map[string]bool, len(in))
+	for _, s := range in {
+		if s != "" && !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// configuredScopes is mergeScopes for an already validated mode (checked at
+// startup); an invalid one falls back to the defaults.
+func configuredScopes(defaults, configured []string, mode string) []string {
+	out, err := mergeScopes(defaults, configured, mode)
+	if err != nil {
+		return defaults
+	}
+	return out
+}
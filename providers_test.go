@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestMergeScopes verifies append adds configured scopes to the defaults and
+// replace uses only the configured ones.
+func TestMergeScopes(t *testing.T) {
+	defaults := []string{"read:user"}
+	for _, tc := range []struct {
+		mode       string
+		configured []string
+		want       []string
+	}{
+		{"append", []string{"user:email", "read:user"}, []string{"read:user", "user:email"}},
+		{"replace", []string{"user:email"}, []string{"user:email"}},
+		{"replace", nil, []string{"read:user"}},
+	} {
+		got, err := mergeScopes(defaults, tc.configured, tc.mode)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.mode, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s %v: expected %v, got %v", tc.mode, tc.configured, tc.want, got)
+		}
+	}
+	if _, err := mergeScopes(defaults, nil, "merge"); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
+
+// TestRegisterProviderDuplicate verifies a second provider under a taken name
+// or login path is rejected, and that registerProvider panics on it.
+func TestRegisterProviderDuplicate(t *testing.T) {
+	m := make(map[string]providerButton)
+	if err := addProvider(m, providerButton{Name: "gitlab", LoginPath: "/login/gitlab"}); err != nil {
+		t.Fatalf("first registration: %v", err)
+	}
+	if err := addProvider(m, providerButton{Name: "gitlab", LoginPath: "/login/gitlab2"}); err == nil {
+		t.Fatalf("expected duplicate name to be rejected")
+	}
+	if err := addProvider(m, providerButton{Name: "gl", LoginPath: "/login/gitlab"}); err == nil {
+		t.Fatalf("expected duplicate login path to be rejected")
+	}
+	if got := m["gitlab"].LoginPath; got != "/login/gitlab" || len(m) != 1 {
+		t.Fatalf("expected the first registration to stay, got %v", m)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected registerProvider to panic on a duplicate")
+		}
+	}()
+	registerProvider(loginButtons["github"])
+}
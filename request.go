@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"edev/config"
+)
+
+// clientIP returns the address of the client behind r. X-Forwarded-For is
+// only honoured when TrustProxy is set, since any client can send it; then
+// the last entry of the last header line, the one added by our proxy, is
+// used. Otherwise it is the host part of RemoteAddr.
+func clientIP(r *http.Request) string {
+	if config.Cfg.TrustProxy {
+		if vals := r.Header.Values("X-Forwarded-For"); len(vals) > 0 {
+			xff := vals[len(vals)-1]
+			last := xff[strings.LastIndex(xff, ",")+1:]
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"edev/config"
+)
+
+// TestClientIP verifies X-Forwarded-For is ignored unless TrustProxy is set,
+// that the proxy-added entry wins when it is, even across header lines, and
+// that the port is stripped.
+func TestClientIP(t *testing.T) {
+	prev := config.Cfg.TrustProxy
+	t.Cleanup(func() { config.Cfg.TrustProxy = prev })
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:5555"
+	if ip := clientIP(req); ip != "192.0.2.1" {
+		t.Fatalf("expected RemoteAddr host, got %q", ip)
+	}
+	req.Header.Set("X-Forwarded-For", " 10.0.0.1 , 203.0.113.7 ")
+
+	config.Cfg.TrustProxy = false
+	if ip := clientIP(req); ip != "192.0.2.1" {
+		t.Fatalf("expected X-Forwarded-For to be ignored without TrustProxy, got %q", ip)
+	}
+	config.Cfg.TrustProxy = true
+	if ip := clientIP(req); ip != "203.0.113.7" {
+		t.Fatalf("expected proxy-appended address, got %q", ip)
+	}
+
+	// A proxy that adds its own header line instead of appending must still
+	// win over the line sent by the client.
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Add("X-Forwarded-For", "10.0.0.1")
+	req.Header.Add("X-Forwarded-For", "203.0.113.9")
+	if ip := clientIP(req); ip != "203.0.113.9" {
+		t.Fatalf("expected the last header line, got %q", ip)
+	}
+}
@@ -23,8 +23,46 @@ local function getEnv(name, default)
 end
 
 Address = ":3210"
+DatabaseURL = getEnv("DATABASE_URL", "edev.db")
 GitHubClientID = getEnv("GITHUB_CLIENT_ID", "")
 GitHubClientSecret = getEnv("GITHUB_CLIENT_SECRET", "")
+ProviderOrder = { "github", "x" }
+
+-- Provider token encryption keys ("id:base64 of 32 bytes"), newest first.
+-- Leave empty to not store provider tokens. Set from TOKEN_KEYS by default.
+-- TokenKeys = { "k2:...", "k1:..." }
+
+-- Behind a TLS-terminating proxy, trust its X-Forwarded-Proto header so HTTPS
+-- requests get HSTS and Secure cookies, and its X-Forwarded-For header for the
+-- client IP. Set from TRUST_PROXY by default.
+-- TrustProxy = true
+
+-- Provider callbacks must return to the browser that started the login (a
+-- cookie bound to the OAuth state); turn off only for flows that cannot keep
+-- cookies.
+-- StateCookieCheck = false
+
+-- How long the login page highlights the provider last used in this browser
+-- (a cookie holding only the provider name); 0 disables.
+-- LastProviderMaxAge = "8760h"
+
+-- Provider callbacks one client IP may have in flight (429 beyond); 0 disables.
+-- CallbackMaxInflight = 4
+
+-- Fail reads with 503 when every database read connection is busy, instead
+-- of waiting for one to free up.
+-- DBFailFastReads = true
+
+-- Only let users whose email is in these domains sign in; empty allows all.
+-- AllowedEmailDomains = { "company.com" }
+
+-- Use the email's Gravatar when a provider sends no avatar (third-party host).
+-- GravatarFallback = true
+
+-- Hosts the /avatar proxy may fetch from, over https only, and how long it
+-- waits for them. Gravatar is allowed on top when GravatarFallback is on.
+-- AvatarHosts = { "avatars.githubusercontent.com", "pbs.twimg.com", "abs.twimg.com" }
+-- AvatarTimeout = "10s"
 
 print("Version: " .. GitTag)
 print("BaseURL: " .. BaseURL)
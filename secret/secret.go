@@ -0,0 +1,109 @@
+// Package secret encrypts small values (provider tokens) for storage at rest
+// with AES-256-GCM. Ciphertexts are prefixed with the ID of the key that
+// produced them, so keys can be rotated: new values use the primary key and
+// older ones still decrypt while their key stays in the keyring.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the required key length in bytes (AES-256).
+const KeySize = 32
+
+var (
+	ErrUnknownKey = errors.New("secret: unknown key id")
+	ErrMalformed  = errors.New("secret: malformed ciphertext")
+)
+
+// Keyring holds the keys by ID; primary encrypts new values.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseKeys builds a Keyring from "id:base64key" entries. The first entry is
+// the primary key. Keys must decode (standard or URL base64) to KeySize bytes.
+func ParseKeys(entries []string) (*Keyring, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("secret: no keys")
+	}
+	kr := &Keyring{aeads: make(map[string]cipher.AEAD, len(entries))}
+	for i, e := range entries {
+		id, enc, ok := strings.Cut(e, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("secret: key %d: want id:base64key", i)
+		}
+		if _, dup := kr.aeads[id]; dup {
+			return nil, fmt.Errorf("secret: duplicate key id %q", id)
+		}
+		key, err := decodeKey(enc)
+		if err != nil {
+			return nil, fmt.Errorf("secret: key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[id] = aead
+		if i == 0 {
+			kr.primary = id
+		}
+	}
+	return kr, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			if len(b) != KeySize {
+				return nil, fmt.Errorf("want %d bytes, got %d", KeySize, len(b))
+			}
+			return b, nil
+		}
+	}
+	return nil, errors.New("invalid base64")
+}
+
+// Encrypt seals plaintext with the primary key and returns "id:base64".
+func (kr *Keyring) Encrypt(plaintext string) (string, error) {
+	aead := kr.aeads[kr.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(kr.primary))
+	return kr.primary + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt with any key in the ring.
+func (kr *Keyring) Decrypt(ciphertext string) (string, error) {
+	id, enc, ok := strings.Cut(ciphertext, ":")
+	if !ok {
+		return "", ErrMalformed
+	}
+	aead, ok := kr.aeads[id]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	b, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", ErrMalformed
+	}
+	nonce, sealed := b[:aead.NonceSize()], b[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return "", ErrMalformed
+	}
+	return string(plain), nil
+}
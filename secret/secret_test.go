@@ -0,0 +1,49 @@
+package secret
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// helper: an "id:key" entry with a key made of b repeated.
+func entry(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), KeySize)))
+}
+
+// TestRotation verifies values sealed with an old primary still open after a
+// new key is put in front, and new values carry the new key id.
+func TestRotation(t *testing.T) {
+	old, err := ParseKeys([]string{entry("k1", 'a')})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	c1, err := old.Encrypt("token")
+	if err != nil || !strings.HasPrefix(c1, "k1:") {
+		t.Fatalf("encrypt: %q %v", c1, err)
+	}
+
+	kr, err := ParseKeys([]string{entry("k2", 'b'), entry("k1", 'a')})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if p, err := kr.Decrypt(c1); err != nil || p != "token" {
+		t.Fatalf("decrypt old: %q %v", p, err)
+	}
+	c2, _ := kr.Encrypt("token")
+	if !strings.HasPrefix(c2, "k2:") {
+		t.Fatalf("expected primary key id, got %q", c2)
+	}
+	if _, err := old.Decrypt(c2); err != ErrUnknownKey {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+	if _, err := kr.Decrypt(c2[:len(c2)-2] + "AA"); err != ErrMalformed {
+		t.Fatalf("expected tampered value rejected, got %v", err)
+	}
+
+	for _, bad := range [][]string{nil, {"nokey"}, {"k:short"}, {entry("k", 'a'), entry("k", 'b')}} {
+		if _, err := ParseKeys(bad); err == nil {
+			t.Fatalf("%v: expected error", bad)
+		}
+	}
+}
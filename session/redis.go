@@ -0,0 +1,241 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"edev/log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps sessions in Redis so several app instances can share them.
+// Each session is a JSON value under prefix+sid, written with SETEX so Redis
+// drops it when it expires; Cleanup has nothing left to do. The session ids of
+// each local account are also kept in a set under prefix+"account:"+id, whose
+// TTL follows its longest-lived session, for CountByAccount. Errors are
+// logged and reported to callers as a missing session.
+type RedisStore struct {
+	c       *redis.Client
+	prefix  string
+	timeout time.Duration
+}
+
+// NewRedisStore returns a Store on c using prefix for its keys. It pings the
+// server so a wrong address fails at startup rather than on the first login.
+func NewRedisStore(c *redis.Client, prefix string) (*RedisStore, error) {
+	st := &RedisStore{c: c, prefix: prefix, timeout: 2 * time.Second}
+	ctx, cancel := st.ctx()
+	defer cancel()
+	if err := c.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("redis session store: %w", err)
+	}
+	return st, nil
+}
+
+func (st *RedisStore) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), st.timeout)
+}
+
+// accountKey is the set holding the session ids of accountID.
+func (st *RedisStore) accountKey(accountID int64) string {
+	return st.prefix + "account:" + strconv.FormatInt(accountID, 10)
+}
+
+// indexAccount queues adding sid to the set of accountID on p, stretching the
+// set TTL to cover the session. Sessions without an account are not indexed.
+func (st *RedisStore) indexAccount(ctx context.Context, p redis.Pipeliner, accountID int64, sid string, ttl time.Duration) {
+	if accountID == 0 {
+		return
+	}
+	key := st.accountKey(accountID)
+	p.SAdd(ctx, key, sid)
+	p.ExpireNX(ctx, key, ttl)
+	p.ExpireGT(ctx, key, ttl)
+}
+
+// updateRetries bounds how often Update retries when another writer changes
+// the key between its read and its write.
+const updateRetries = 5
+
+func (st *RedisStore) Put(sid string, r Record) {
+	ttl := time.Until(time.Unix(r.ExpiresAt, 0))
+	if ttl <= 0 {
+		st.Del(sid)
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("session put: %v", err)
+		return
+	}
+	ctx, cancel := st.ctx()
+	defer cancel()
+	_, err = st.c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.SetEx(ctx, st.prefix+sid, b, ttl)
+		st.indexAccount(ctx, p, r.User.AccountID, sid, ttl)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("session put: %v", err)
+	}
+}
+
+func (st *RedisStore) Get(sid string) (Record, bool) {
+	ctx, cancel := st.ctx()
+	defer cancel()
+	r, ok, err := decodeRecord(st.c.Get(ctx, st.prefix+sid).Bytes())
+	if err != nil {
+		log.Errorf("session get: %v", err)
+	}
+	return r, ok
+}
+
+// decodeRecord turns the reply of a GET into a live record. A missing key is
+// not an error.
+func decodeRecord(b []byte, err error) (Record, bool, error) {
+	if errors.Is(err, redis.Nil) {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Record{}, false, err
+	}
+	if r.ExpiresAt < time.Now().Unix() {
+		return Record{}, false, nil
+	}
+	return r, true, nil
+}
+
+// Update uses WATCH/MULTI so a concurrent write to the same key, from any
+// instance, makes it retry instead of being overwritten. A record moved to
+// another account is indexed under it; the stale entry is dropped by
+// CountByAccount.
+func (st *RedisStore) Update(sid string, fn func(r *Record) bool) bool {
+	ctx, cancel := st.ctx()
+	defer cancel()
+	key := st.prefix + sid
+	found := false
+	txf := func(tx *redis.Tx) error {
+		r, ok, err := decodeRecord(tx.Get(ctx, key).Bytes())
+		found = ok
+		if err != nil || !ok || !fn(&r) {
+			return err
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if ttl := time.Until(time.Unix(r.ExpiresAt, 0)); ttl > 0 {
+				p.SetEx(ctx, key, b, ttl)
+				st.indexAccount(ctx, p, r.User.AccountID, sid, ttl)
+			} else {
+				p.Del(ctx, key)
+			}
+			return nil
+		})
+		return err
+	}
+	for range updateRetries {
+		err := st.c.Watch(ctx, txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("session update: %v", err)
+			return false
+		}
+		return found
+	}
+	log.Errorf("session update: key changed concurrently %d times", updateRetries)
+	return false
+}
+
+// Touch rewrites the record so both ExpiresAt and the key TTL move.
+func (st *RedisStore) Touch(sid string, expiresAt int64) bool {
+	return st.Update(sid, func(r *Record) bool {
+		r.ExpiresAt = expiresAt
+		return true
+	})
+}
+
+// Del also removes sid from its account set, read from the deleted record.
+func (st *RedisStore) Del(sid string) {
+	ctx, cancel := st.ctx()
+	defer cancel()
+	b, err := st.c.GetDel(ctx, st.prefix+sid).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return
+	}
+	if err != nil {
+		log.Errorf("session del: %v", err)
+		return
+	}
+	var r Record
+	if json.Unmarshal(b, &r) != nil || r.User.AccountID == 0 {
+		return
+	}
+	if err := st.c.SRem(ctx, st.accountKey(r.User.AccountID), sid).Err(); err != nil {
+		log.Errorf("session del: %v", err)
+	}
+}
+
+// CountByAccount reads the sessions listed in the account set and counts those
+// still belonging to accountID and not expired at now. Entries whose session
+// is gone or was moved to another account are removed from the set.
+func (st *RedisStore) CountByAccount(accountID int64, now int64) int {
+	ctx, cancel := st.ctx()
+	defer cancel()
+	key := st.accountKey(accountID)
+	sids, err := st.c.SMembers(ctx, key).Result()
+	if err != nil || len(sids) == 0 {
+		if err != nil {
+			log.Errorf("session count: %v", err)
+		}
+		return 0
+	}
+	keys := make([]string, len(sids))
+	for i, sid := range sids {
+		keys[i] = st.prefix + sid
+	}
+	vals, err := st.c.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Errorf("session count: %v", err)
+		return 0
+	}
+	n := 0
+	var stale []any
+	for i, v := range vals {
+		var r Record
+		if s, ok := v.(string); !ok || json.Unmarshal([]byte(s), &r) != nil || r.User.AccountID != accountID {
+			stale = append(stale, sids[i])
+			continue
+		}
+		if r.ExpiresAt >= now {
+			n++
+		}
+	}
+	if len(stale) > 0 {
+		if err := st.c.SRem(ctx, key, stale...).Err(); err != nil {
+			log.Errorf("session count: %v", err)
+		}
+	}
+	return n
+}
+
+// Ping checks the Redis server answers within ctx.
+func (st *RedisStore) Ping(ctx context.Context) error {
+	return st.c.Ping(ctx).Err()
+}
+
+// Cleanup is a no-op: keys carry their own TTL. Idle sessions are still
+// rejected by Get and expire with their TTL.
+func (st *RedisStore) Cleanup() {}
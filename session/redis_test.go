@@ -0,0 +1,145 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"edev/user"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// helper: install a RedisStore backed by a fresh miniredis server.
+func useRedisStore(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = c.Close() })
+	st, err := NewRedisStore(c, "test:sess:")
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	SetStore(st)
+	t.Cleanup(func() { SetStore(newMemoryStore()) })
+	return mr
+}
+
+// TestRedisStoreRoundTrip verifies a session and its CSRF token are stored
+// under the prefix with a TTL matching the session lifetime.
+func TestRedisStoreRoundTrip(t *testing.T) {
+	mr := useRedisStore(t)
+
+	PutWithMeta("sid-1", user.User{ID: "1", Login: "alice"}, "203.0.113.7", "curl/8")
+	tok := IssueCSRF("sid-1")
+
+	if !mr.Exists("test:sess:sid-1") {
+		t.Fatalf("expected prefixed key, got %v", mr.Keys())
+	}
+	if ttl := mr.TTL("test:sess:sid-1"); ttl <= 0 || ttl > Lifetime() {
+		t.Fatalf("expected TTL within the session lifetime, got %s", ttl)
+	}
+	u, ok := Get("sid-1")
+	if !ok || u.Login != "alice" || !ValidateCSRF("sid-1", tok) {
+		t.Fatalf("expected session round-trip, got %+v ok=%v", u, ok)
+	}
+	if m, _ := GetMeta("sid-1"); m.IP != "203.0.113.7" {
+		t.Fatalf("expected meta round-trip, got %+v", m)
+	}
+
+	Del("sid-1")
+	if _, ok := Get("sid-1"); ok {
+		t.Fatalf("expected deleted session to be gone")
+	}
+}
+
+// TestRedisStoreTTLExpiry verifies Redis drops a session once its TTL passes.
+func TestRedisStoreTTLExpiry(t *testing.T) {
+	mr := useRedisStore(t)
+
+	Put("sid-1", user.User{ID: "1"})
+	mr.FastForward(Lifetime() + time.Second)
+	if _, ok := Get("sid-1"); ok {
+		t.Fatalf("expected session to expire with its TTL")
+	}
+}
+
+// TestRedisStoreUnavailable verifies a dead server is reported at startup.
+func TestRedisStoreUnavailable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	c := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer func() { _ = c.Close() }()
+	if _, err := NewRedisStore(c, "x:"); err == nil {
+		t.Fatalf("expected connection error")
+	}
+}
+
+// TestRedisStorePing verifies Ping follows the server going away.
+func TestRedisStorePing(t *testing.T) {
+	mr := useRedisStore(t)
+	if err := Ping(t.Context()); err != nil {
+		t.Fatalf("expected ping ok, got %v", err)
+	}
+	mr.Close()
+	if err := Ping(t.Context()); err == nil {
+		t.Fatalf("expected ping error after the server stopped")
+	}
+}
+
+// TestRedisStoreUpdateConcurrent verifies concurrent read-modify-write calls
+// on one session agree on a single CSRF token.
+func TestRedisStoreUpdateConcurrent(t *testing.T) {
+	useRedisStore(t)
+	Put("sid-1", user.User{ID: "1"})
+	assertSingleCSRF(t, "sid-1")
+}
+
+// TestRedisStoreTouchExtendsTTL verifies Touch moves the key TTL along with
+// the recorded expiry.
+func TestRedisStoreTouchExtendsTTL(t *testing.T) {
+	mr := useRedisStore(t)
+
+	Put("sid-1", user.User{ID: "1"})
+	mr.FastForward(Lifetime() / 2)
+	if !Touch("sid-1") {
+		t.Fatalf("expected Touch to find the session")
+	}
+	if ttl := mr.TTL("test:sess:sid-1"); ttl <= Lifetime()/2+time.Second {
+		t.Fatalf("expected Touch to extend the TTL, got %s", ttl)
+	}
+}
+
+// TestRedisStoreCountByAccount verifies live sessions are counted per account
+// and that deleted or expired ones stop counting.
+func TestRedisStoreCountByAccount(t *testing.T) {
+	mr := useRedisStore(t)
+
+	Put("sid-1", user.User{ID: "1", AccountID: 10})
+	Put("sid-2", user.User{ID: "2", AccountID: 10})
+	Put("sid-3", user.User{ID: "3", AccountID: 20})
+	Put("sid-4", user.User{ID: "4"})
+	if n := CountByAccount(10); n != 2 {
+		t.Fatalf("expected 2 sessions for account 10, got %d", n)
+	}
+	if n := CountByAccount(20); n != 1 {
+		t.Fatalf("expected 1 session for account 20, got %d", n)
+	}
+	if ttl := mr.TTL("test:sess:account:10"); ttl <= 0 || ttl > Lifetime() {
+		t.Fatalf("expected the account set to expire with its sessions, got %s", ttl)
+	}
+
+	Del("sid-1")
+	if n := CountByAccount(10); n != 1 {
+		t.Fatalf("expected 1 session after Del, got %d", n)
+	}
+	if ok, _ := mr.SIsMember("test:sess:account:10", "sid-1"); ok {
+		t.Fatalf("expected Del to drop the session from the account set")
+	}
+
+	mr.FastForward(Lifetime() + time.Second)
+	if n := CountByAccount(10); n != 0 {
+		t.Fatalf("expected no sessions once expired, got %d", n)
+	}
+}
@@ -1,110 +1,506 @@
 package session
 
 /*
-In-memory session store (opaque SID -> user.User).
+Session store (opaque SID -> user.User). Sessions live in memory unless a
+persistent Store is installed with SetStore.
 */
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 
 	"edev/user"
+	"edev/utils"
 )
 
-type session struct {
-	User      user.User
-	ExpiresAt int64
+// Record is the data kept for one session.
+type Record struct {
+	User       user.User
+	ExpiresAt  int64
+	CSRF       string
+	FirstLogin bool
+	LastSeen   int64 // unix seconds of the last Get, within lastSeenInterval
+	IP         string
+	UserAgent  string
+}
+
+// SessionMeta describes the client that created a session.
+type SessionMeta struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
 }
 
 var (
-	sessions = struct {
-		sync.RWMutex
-		m map[string]session
-	}{
-		m: make(map[string]session),
-	}
+	store Store = newMemoryStore()
+
+	// inactivityTimeout logs a session out after this long without access;
+	// 0 disables it.
+	inactivityTimeout time.Duration
 
-	MaxSessionAge = int64(3600 * 3) // 3 hours in seconds
+	// slidingExpiration lets Touch extend ExpiresAt on access.
+	slidingExpiration = true
 )
 
-func Put(sid string, u user.User) {
-	s := session{
+// SetStore replaces the session store. Call it at startup, before serving;
+// sessions held by the previous store are not migrated.
+func SetStore(s Store) {
+	store = s
+}
+
+// SetInactivityTimeout sets how long a session may stay unused before Get
+// treats it as expired, regardless of ExpiresAt. 0 disables the check.
+func SetInactivityTimeout(d time.Duration) { inactivityTimeout = d }
+
+// EnableSlidingExpiration toggles Touch. When disabled a session expires
+// MaxAge after login no matter how active it is.
+func EnableSlidingExpiration(enable bool) { slidingExpiration = enable }
+
+// idleSince returns the LastSeen value below which a session counts as idle,
+// or 0 when the inactivity check is disabled.
+func idleSince(now int64) int64 {
+	if inactivityTimeout <= 0 {
+		return 0
+	}
+	return now - int64(inactivityTimeout/time.Second)
+}
+
+// idle reports whether r has been unused longer than inactivityTimeout.
+func idle(r Record, now int64) bool {
+	return inactivityTimeout > 0 && r.LastSeen < idleSince(now)
+}
+
+// newRecord returns a fresh record for u created by the client in meta.
+func newRecord(u user.User, meta SessionMeta) Record {
+	now := time.Now().Unix()
+	return Record{
 		User:      u,
-		ExpiresAt: time.Now().Unix() + MaxSessionAge,
+		ExpiresAt: now + maxAge(),
+		LastSeen:  now,
+		IP:        meta.IP,
+		UserAgent: meta.UserAgent,
 	}
-	sessions.Lock()
-	sessions.m[sid] = s
-	sessions.Unlock()
 }
 
+func Put(sid string, u user.User) {
+	PutWithMeta(sid, u, "", "")
+}
+
+// PutWithMeta stores a session for u recording the client IP and User-Agent.
+func PutWithMeta(sid string, u user.User, ip, ua string) {
+	store.Put(sid, newRecord(u, SessionMeta{IP: ip, UserAgent: ua}))
+}
+
+// GetMeta returns the client data recorded when sid was created.
+func GetMeta(sid string) (SessionMeta, bool) {
+	r, ok := store.Get(sid)
+	if !ok {
+		return SessionMeta{}, false
+	}
+	return SessionMeta{IP: r.IP, UserAgent: r.UserAgent}, true
+}
+
+// Rotate replaces oldSID (if any) with a fresh session for u and returns the
+// new SID. Called after login so a SID planted before authentication never
+// becomes an authenticated one.
+func Rotate(oldSID string, u user.User) (newSID string) {
+	return RotateWithMeta(oldSID, u, "", "")
+}
+
+// RotateWithMeta is Rotate recording the client IP and User-Agent on the new
+// session.
+func RotateWithMeta(oldSID string, u user.User, ip, ua string) (newSID string) {
+	newSID = NewID()
+	if oldSID != "" {
+		store.Del(oldSID)
+	}
+	store.Put(newSID, newRecord(u, SessionMeta{IP: ip, UserAgent: ua}))
+	return newSID
+}
+
+// Get returns the session user and refreshes its LastSeen when it is older
+// than lastSeenInterval. A session idle past the inactivity timeout is
+// reported as missing.
 func Get(sid string) (user.User, bool) {
-	sessions.RLock()
-	s, ok := sessions.m[sid]
-	sessions.RUnlock()
-	return s.User, ok
+	u, _, ok := GetWithExpiry(sid)
+	return u, ok
+}
+
+// GetWithExpiry is Get also returning when the session expires, so clients
+// can re-authenticate before that. Expired sessions report false.
+func GetWithExpiry(sid string) (user.User, time.Time, bool) {
+	now := time.Now().Unix()
+	r, ok := store.Get(sid)
+	if !ok || idle(r, now) {
+		return user.User{}, time.Time{}, false
+	}
+	// Most requests only read; LastSeen is written back once it is stale
+	// enough to matter for the inactivity check.
+	if now-r.LastSeen >= lastSeenInterval() {
+		ok = store.Update(sid, func(rec *Record) bool {
+			if rec.LastSeen >= now {
+				return false
+			}
+			rec.LastSeen = now
+			return true
+		})
+		if !ok {
+			return user.User{}, time.Time{}, false
+		}
+	}
+	return r.User, time.Unix(r.ExpiresAt, 0), true
+}
+
+// lastSeenInterval is how many seconds LastSeen may lag behind before Get
+// rewrites it: a minute, or a tenth of the inactivity timeout when shorter.
+func lastSeenInterval() int64 {
+	d := time.Minute
+	if t := inactivityTimeout / 10; t > 0 && t < d {
+		d = t
+	}
+	return int64(d / time.Second)
+}
+
+// modify applies fn to the record of sid and stores the result when fn
+// returns true. Reports whether the session exists.
+func modify(sid string, fn func(r *Record) bool) bool {
+	return store.Update(sid, fn)
+}
+
+// Update replaces the user of an existing session, keeping its expiry and
+// CSRF token. Returns false when the session does not exist.
+func Update(sid string, u user.User) bool {
+	return modify(sid, func(r *Record) bool {
+		r.User = u
+		return true
+	})
+}
+
+// Touch pushes the expiry of sid to MaxAge from now. Returns false when
+// the session is missing or already expired, or when sliding expiration is
+// disabled.
+func Touch(sid string) bool {
+	if !slidingExpiration {
+		return false
+	}
+	return store.Touch(sid, time.Now().Unix()+maxAge())
+}
+
+// MarkFirstLogin flags sid as the session that created the account, so the
+// next page render can show onboarding.
+func MarkFirstLogin(sid string) {
+	modify(sid, func(r *Record) bool {
+		r.FirstLogin = true
+		return true
+	})
+}
+
+// TakeFirstLogin reports whether sid carries the first login flag and clears
+// it, so onboarding is shown only once.
+func TakeFirstLogin(sid string) bool {
+	taken := false
+	modify(sid, func(r *Record) bool {
+		taken = r.FirstLogin
+		r.FirstLogin = false
+		return taken
+	})
+	return taken
 }
 
 func Del(sid string) {
-	sessions.Lock()
-	delete(sessions.m, sid)
-	sessions.Unlock()
+	store.Del(sid)
+}
+
+// IssueCSRF returns the CSRF token bound to sid, creating it on first use.
+// The token lives and dies with the session, so a new login yields a new token.
+// Returns "" when the session does not exist.
+func IssueCSRF(sid string) string {
+	token := ""
+	modify(sid, func(r *Record) bool {
+		if r.CSRF != "" {
+			token = r.CSRF
+			return false
+		}
+		r.CSRF = utils.NewOpaqueID()
+		token = r.CSRF
+		return true
+	})
+	return token
 }
 
+// ValidateCSRF reports whether token matches the one issued for sid.
+func ValidateCSRF(sid, token string) bool {
+	if sid == "" || token == "" {
+		return false
+	}
+	r, ok := store.Get(sid)
+	if !ok || r.CSRF == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.CSRF), []byte(token)) == 1
+}
+
+// accountCounter is implemented by stores that can count sessions per
+// account.
+type accountCounter interface {
+	CountByAccount(accountID int64, now int64) int
+}
+
+// CountByAccount returns how many live (unexpired) sessions belong to the
+// local account accountID, whichever provider each was opened with. Sessions
+// without an account (accountID 0) and stores that cannot count report 0.
+func CountByAccount(accountID int64) int {
+	c, ok := store.(accountCounter)
+	if !ok || accountID == 0 {
+		return 0
+	}
+	return c.CountByAccount(accountID, time.Now().Unix())
+}
+
+// pinger is implemented by stores backed by an external service.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping reports whether the store is reachable. In-process stores always are.
+func Ping(ctx context.Context) error {
+	p, ok := store.(pinger)
+	if !ok {
+		return nil
+	}
+	return p.Ping(ctx)
+}
+
+// Cleanup removes expired and idle sessions from the store.
 func Cleanup() {
-	if len(sessions.m) == 0 {
-		return
+	store.Cleanup()
+}
+
+// ErrNotExportable is returned by Export and Import when the installed store
+// is persistent and needs no hand-over.
+var ErrNotExportable = errors.New("session store does not support export")
+
+// Export serializes the live sessions so a wrapper can hand them over to a new
+// process during a binary upgrade. The snapshot contains session secrets and
+// must be handled like the cookie values themselves.
+func Export() ([]byte, error) {
+	m, ok := store.(*memoryStore)
+	if !ok {
+		return nil, ErrNotExportable
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return json.Marshal(m.m)
+}
+
+// Import restores sessions from a snapshot produced by Export, skipping
+// entries that expired in the meantime. Existing sessions are kept.
+func Import(b []byte) error {
+	if _, ok := store.(*memoryStore); !ok {
+		return ErrNotExportable
+	}
+	var m map[string]Record
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
 	}
 	now := time.Now().Unix()
-	sessions.Lock()
-	for sid, s := range sessions.m {
-		if s.ExpiresAt < now {
-			delete(sessions.m, sid)
+	for sid, r := range m {
+		if r.ExpiresAt < now {
+			continue
 		}
+		if r.LastSeen == 0 { // snapshot from before LastSeen existed
+			r.LastSeen = now
+		}
+		store.Put(sid, r)
 	}
-	sessions.Unlock()
+	return nil
+}
+
+// ===== Session IDs =====
+
+// MinIDBytes is the smallest accepted SID size (128 bits of entropy).
+const MinIDBytes = 16
+
+var (
+	idBytes    = 32
+	idEncoding = "base64url"
+)
+
+// SetIDFormat configures NewID: n random bytes encoded as "base64url"
+// (default) or "hex". n below MinIDBytes is rejected.
+func SetIDFormat(n int, encoding string) error {
+	if n < MinIDBytes {
+		return fmt.Errorf("session id length %d below minimum %d bytes", n, MinIDBytes)
+	}
+	switch encoding {
+	case "", "base64url":
+		encoding = "base64url"
+	case "hex":
+	default:
+		return fmt.Errorf("invalid session id encoding %q (want base64url or hex)", encoding)
+	}
+	idBytes, idEncoding = n, encoding
+	return nil
+}
+
+// NewID returns a random session ID in the configured format.
+func NewID() string {
+	b := make([]byte, idBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	if idEncoding == "hex" {
+		return hex.EncodeToString(b)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
 // ===== Cookie helpers =====
 
 // Cookie helpers
 // In secure (default) mode we use the __Host- prefix which requires Secure=true, Path=/ and no Domain.
-// When insecureCookie is enabled (local dev over http) we must NOT use the __Host- prefix because
+// When Secure is off (local dev over http) we must NOT use the __Host- prefix because
 // browsers will silently reject a cookie whose name starts with __Host- if Secure is false.
 const (
 	secureSessCookieName   = "__Host-sid"
 	insecureSessCookieName = "sid"
 )
 
-var insecureCookie bool
+// Config controls the session cookie and lifetime.
+type Config struct {
+	// CookieName overrides the default name (__Host-sid when Secure, sid
+	// otherwise). Prefixed names (__Host-, __Secure-) require Secure.
+	CookieName string
+	// MaxAge is the lifetime of both the cookie and the server-side session.
+	MaxAge   time.Duration
+	SameSite http.SameSite
+	Secure   bool
+}
+
+var defaultConfig = Config{
+	MaxAge:   3 * time.Hour,
+	SameSite: http.SameSiteLaxMode,
+	Secure:   true,
+}
+
+var cfg = defaultConfig
+
+// Configure replaces the cookie settings. A zero MaxAge keeps the current one.
+func Configure(c Config) error {
+	if c.MaxAge == 0 {
+		c.MaxAge = cfg.MaxAge
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("session max age %s must be positive", c.MaxAge)
+	}
+	if c.SameSite == 0 {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	if !c.Secure {
+		if c.SameSite == http.SameSiteNoneMode {
+			return errors.New("SameSite=None requires Secure cookies (disable insecure cookie mode)")
+		}
+		if strings.HasPrefix(c.CookieName, "__Host-") || strings.HasPrefix(c.CookieName, "__Secure-") {
+			return fmt.Errorf("cookie name %q requires Secure cookies", c.CookieName)
+		}
+	}
+	cfg = c
+	return nil
+}
+
+// Lifetime returns the configured session lifetime (Config.MaxAge).
+func Lifetime() time.Duration { return cfg.MaxAge }
+
+// maxAge returns the session lifetime in seconds.
+func maxAge() int64 { return int64(cfg.MaxAge / time.Second) }
+
+// cookieName returns the configured cookie name or the default for the
+// current Secure mode.
+func cookieName() string {
+	switch {
+	case cfg.CookieName != "":
+		return cfg.CookieName
+	case cfg.Secure:
+		return secureSessCookieName
+	}
+	return insecureSessCookieName
+}
 
 // EnableInsecureCookie enables non-Secure cookies (DEV/TEST only). Not for production use.
-func EnableInsecureCookie() { insecureCookie = true }
+func EnableInsecureCookie() { cfg.Secure = false }
+
+// SetSameSite selects the SameSite mode of the session cookie. Lax (default)
+// works for the top-level GET redirect back from the providers; None is only
+// needed for cross-site flows (POST callbacks, iframes) and browsers drop it
+// unless the cookie is Secure, so it is rejected in insecure (dev) mode.
+func SetSameSite(mode http.SameSite) error {
+	if mode == http.SameSiteNoneMode && !cfg.Secure {
+		return errors.New("SameSite=None requires Secure cookies (disable insecure cookie mode)")
+	}
+	cfg.SameSite = mode
+	return nil
+}
 
-func SetCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
-	secure := !insecureCookie
-	name := secureSessCookieName
-	if !secure {
-		name = insecureSessCookieName
+// ParseSameSite maps "lax", "strict" or "none" to an http.SameSite value.
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch s {
+	case "lax", "":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
+	return 0, fmt.Errorf("invalid SameSite mode %q (want lax, strict or none)", s)
+}
+
+// SetCookie sets the session cookie to value for the configured MaxAge.
+func SetCookie(w http.ResponseWriter, value string) {
+	writeCookie(w, value, cfg.MaxAge)
+}
+
+// ClearCookie removes the session cookie (Max-Age=0).
+func ClearCookie(w http.ResponseWriter) {
+	writeCookie(w, "", -time.Second)
+}
+
+func writeCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	c := &http.Cookie{
+		Name:     cookieName(),
 		Value:    value,
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   secure,
-		SameSite: http.SameSiteLaxMode,
+		Secure:   cfg.Secure,
+		SameSite: cfg.SameSite,
 		MaxAge:   int(maxAge.Seconds()),
-		Expires:  time.Now().Add(maxAge),
-	})
+	}
+	if maxAge > 0 {
+		c.Expires = time.Now().Add(maxAge)
+	}
+	http.SetCookie(w, c)
 }
 
-func GetCookie(r *http.Request) (string, bool) {
-	name := secureSessCookieName
-	if insecureCookie {
-		name = insecureSessCookieName
+// IsAuthenticated reports whether r carries the cookie of a live session,
+// without copying the session user.
+func IsAuthenticated(r *http.Request) bool {
+	sid, ok := GetCookie(r)
+	if !ok {
+		return false
 	}
-	c, err := r.Cookie(name)
+	rec, ok := store.Get(sid)
+	return ok && !idle(rec, time.Now().Unix())
+}
+
+func GetCookie(r *http.Request) (string, bool) {
+	c, err := r.Cookie(cookieName())
 	if err != nil {
 		return "", false
 	}
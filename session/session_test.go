@@ -0,0 +1,350 @@
+package session
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"edev/user"
+)
+
+// helper: drop every session so tests start from a clean store.
+func reset(t *testing.T) {
+	t.Helper()
+	store = newMemoryStore()
+}
+
+// helper: change the stored record of sid in place, bypassing expiry checks.
+func edit(t *testing.T, sid string, fn func(r *Record)) {
+	t.Helper()
+	ms := store.(*memoryStore)
+	ms.Lock()
+	r := ms.m[sid]
+	fn(&r)
+	ms.m[sid] = r
+	ms.Unlock()
+}
+
+// TestExportImport verifies a snapshot restores live sessions and skips
+// expired ones.
+func TestExportImport(t *testing.T) {
+	reset(t)
+	Put("live", user.User{ID: "1", Login: "alice"})
+	Put("old", user.User{ID: "2", Login: "bob"})
+	edit(t, "old", func(r *Record) { r.ExpiresAt = time.Now().Add(-time.Minute).Unix() })
+
+	b, err := Export()
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	reset(t)
+	if _, ok := Get("live"); ok {
+		t.Fatalf("expected empty store after reset")
+	}
+
+	if err := Import(b); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	u, ok := Get("live")
+	if !ok || u.Login != "alice" {
+		t.Fatalf("expected live session restored, got %+v ok=%v", u, ok)
+	}
+	if _, ok := Get("old"); ok {
+		t.Fatalf("expected expired session to be skipped")
+	}
+}
+
+// TestSameSite verifies each configured mode shows up in Set-Cookie and that
+// None is refused for insecure cookies.
+func TestSameSite(t *testing.T) {
+	defer func() { cfg = defaultConfig }()
+
+	for _, tc := range []struct {
+		mode string
+		want string
+	}{
+		{"lax", "SameSite=Lax"},
+		{"strict", "SameSite=Strict"},
+		{"none", "SameSite=None"},
+	} {
+		mode, err := ParseSameSite(tc.mode)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tc.mode, err)
+		}
+		if err := SetSameSite(mode); err != nil {
+			t.Fatalf("set %q: %v", tc.mode, err)
+		}
+		rec := httptest.NewRecorder()
+		SetCookie(rec, "sid-value")
+		h := rec.Header().Get("Set-Cookie")
+		if !strings.Contains(h, tc.want) || !strings.Contains(h, "Secure") ||
+			!strings.HasPrefix(h, secureSessCookieName+"=") {
+			t.Fatalf("mode %s: unexpected Set-Cookie %q", tc.mode, h)
+		}
+	}
+
+	if _, err := ParseSameSite("bogus"); err == nil {
+		t.Fatalf("expected error for invalid mode")
+	}
+
+	cfg.Secure = false
+	if err := SetSameSite(http.SameSiteNoneMode); err == nil {
+		t.Fatalf("expected SameSite=None to be rejected for insecure cookies")
+	}
+}
+
+// TestCountByAccount verifies only the account's live sessions are counted,
+// across providers, and that provider IDs shared by different accounts do
+// not mix.
+func TestCountByAccount(t *testing.T) {
+	reset(t)
+	Put("a1", user.User{ID: "1", Login: "alice", AccountID: 10})
+	Put("a2", user.User{ID: "77", Login: "alice_x", AccountID: 10})
+	Put("a3", user.User{ID: "1", Login: "alice", AccountID: 10})
+	Put("b1", user.User{ID: "1", Login: "bob_x", AccountID: 20})
+	edit(t, "a3", func(r *Record) { r.ExpiresAt = time.Now().Add(-time.Minute).Unix() })
+
+	if n := CountByAccount(10); n != 2 {
+		t.Fatalf("expected 2 sessions for alice, got %d", n)
+	}
+	if n := CountByAccount(20); n != 1 {
+		t.Fatalf("expected 1 session for bob, got %d", n)
+	}
+	if n := CountByAccount(30); n != 0 {
+		t.Fatalf("expected 0 sessions for unknown account, got %d", n)
+	}
+	if n := CountByAccount(0); n != 0 {
+		t.Fatalf("expected sessions without an account not to be counted, got %d", n)
+	}
+}
+
+// TestIsAuthenticated verifies a request with a live session cookie is authed
+// and one without (or with an unknown sid) is not.
+func TestIsAuthenticated(t *testing.T) {
+	reset(t)
+	Put("live", user.User{ID: "1", Login: "alice"})
+
+	withCookie := func(sid string) *http.Request {
+		rec := httptest.NewRecorder()
+		SetCookie(rec, sid)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	if !IsAuthenticated(withCookie("live")) {
+		t.Fatalf("expected request with live session to be authenticated")
+	}
+	if IsAuthenticated(withCookie("unknown")) {
+		t.Fatalf("expected unknown sid not to be authenticated")
+	}
+	if IsAuthenticated(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Fatalf("expected request without cookie not to be authenticated")
+	}
+}
+
+// TestIDFormat verifies configured lengths and encodings decode to the
+// expected number of bytes, and that short lengths are rejected.
+func TestIDFormat(t *testing.T) {
+	defer func() { _ = SetIDFormat(32, "base64url") }()
+
+	if err := SetIDFormat(24, "base64url"); err != nil {
+		t.Fatalf("set format: %v", err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(NewID())
+	if err != nil || len(b) != 24 {
+		t.Fatalf("expected 24 decoded bytes, got %d (%v)", len(b), err)
+	}
+
+	if err := SetIDFormat(16, "hex"); err != nil {
+		t.Fatalf("set format: %v", err)
+	}
+	b, err = hex.DecodeString(NewID())
+	if err != nil || len(b) != 16 {
+		t.Fatalf("expected 16 decoded bytes, got %d (%v)", len(b), err)
+	}
+
+	if err := SetIDFormat(8, "hex"); err == nil {
+		t.Fatalf("expected length below minimum to be rejected")
+	}
+	if err := SetIDFormat(32, "base32"); err == nil {
+		t.Fatalf("expected unknown encoding to be rejected")
+	}
+}
+
+// TestInactivityTimeout verifies a session idle past the window is treated as
+// expired while a recently used one is not.
+func TestInactivityTimeout(t *testing.T) {
+	reset(t)
+	SetInactivityTimeout(30 * time.Minute)
+	defer SetInactivityTimeout(0)
+
+	Put("active", user.User{ID: "1", Login: "alice"})
+	Put("idle", user.User{ID: "2", Login: "bob"})
+	edit(t, "idle", func(r *Record) { r.LastSeen = time.Now().Add(-31 * time.Minute).Unix() })
+
+	if _, ok := Get("active"); !ok {
+		t.Fatalf("expected recently used session to be valid")
+	}
+	if _, ok := Get("idle"); ok {
+		t.Fatalf("expected idle session to be expired")
+	}
+}
+
+// TestLastSeenThrottled verifies Get only writes LastSeen back once it is
+// older than lastSeenInterval.
+func TestLastSeenThrottled(t *testing.T) {
+	reset(t)
+	SetInactivityTimeout(30 * time.Minute)
+	defer SetInactivityTimeout(0)
+
+	Put("sid", user.User{ID: "1"})
+	recent := time.Now().Add(-10 * time.Second).Unix()
+	edit(t, "sid", func(r *Record) { r.LastSeen = recent })
+	Get("sid")
+	if r, _ := store.Get("sid"); r.LastSeen != recent {
+		t.Fatalf("expected fresh LastSeen to be left alone, got %d want %d", r.LastSeen, recent)
+	}
+
+	stale := time.Now().Add(-2 * time.Minute).Unix()
+	edit(t, "sid", func(r *Record) { r.LastSeen = stale })
+	Get("sid")
+	if r, _ := store.Get("sid"); r.LastSeen <= stale {
+		t.Fatalf("expected stale LastSeen to be refreshed, got %d", r.LastSeen)
+	}
+}
+
+// TestTouch verifies a near-expiry session is extended by Touch and an
+// already-expired one is not revived.
+func TestTouch(t *testing.T) {
+	reset(t)
+	Put("near", user.User{ID: "1", Login: "alice"})
+	Put("gone", user.User{ID: "2", Login: "bob"})
+	now := time.Now().Unix()
+	edit(t, "near", func(r *Record) { r.ExpiresAt = now + 5 })
+	edit(t, "gone", func(r *Record) { r.ExpiresAt = now - 5 })
+
+	if _, ok := Get("near"); !ok || !Touch("near") {
+		t.Fatalf("expected near-expiry session to be touched")
+	}
+	if r, _ := store.Get("near"); r.ExpiresAt < now+maxAge() {
+		t.Fatalf("expected expiry pushed to %d, got %d", now+maxAge(), r.ExpiresAt)
+	}
+
+	if _, ok := Get("gone"); ok || Touch("gone") {
+		t.Fatalf("expected expired session not to be revived")
+	}
+
+	EnableSlidingExpiration(false)
+	defer EnableSlidingExpiration(true)
+	edit(t, "near", func(r *Record) { r.ExpiresAt = now + 5 })
+	if Touch("near") {
+		t.Fatalf("expected Touch to be a no-op when sliding expiration is disabled")
+	}
+}
+
+// TestRotate verifies the old SID is gone after rotation and the new one
+// resolves to the user.
+func TestRotate(t *testing.T) {
+	reset(t)
+	Put("pre-auth", user.User{})
+
+	sid := Rotate("pre-auth", user.User{ID: "1", Login: "alice"})
+	if sid == "" || sid == "pre-auth" {
+		t.Fatalf("expected a fresh sid, got %q", sid)
+	}
+	if _, ok := Get("pre-auth"); ok {
+		t.Fatalf("expected old sid to be deleted")
+	}
+	if u, ok := Get(sid); !ok || u.Login != "alice" {
+		t.Fatalf("expected new sid to resolve to alice, got %+v ok=%v", u, ok)
+	}
+
+	if sid2 := Rotate("", user.User{ID: "2"}); sid2 == "" {
+		t.Fatalf("expected rotation without a previous sid to create one")
+	}
+}
+
+// TestMetaRoundTrip verifies the IP and User-Agent given at creation come back
+// from GetMeta, and that Put records none.
+func TestMetaRoundTrip(t *testing.T) {
+	reset(t)
+	PutWithMeta("with", user.User{ID: "1"}, "203.0.113.7", "Mozilla/5.0")
+	Put("without", user.User{ID: "2"})
+	sid := RotateWithMeta("with", user.User{ID: "1"}, "198.51.100.1", "curl/8")
+
+	if _, ok := GetMeta("with"); ok {
+		t.Fatalf("expected rotated sid to be gone")
+	}
+	if m, ok := GetMeta(sid); !ok || m != (SessionMeta{IP: "198.51.100.1", UserAgent: "curl/8"}) {
+		t.Fatalf("unexpected meta %+v ok=%v", m, ok)
+	}
+	if m, ok := GetMeta("without"); !ok || m != (SessionMeta{}) {
+		t.Fatalf("expected empty meta, got %+v ok=%v", m, ok)
+	}
+}
+
+// TestCookieAttributes verifies the cookie written in secure and insecure
+// modes, including a custom name and lifetime, and that invalid combinations
+// are rejected.
+func TestCookieAttributes(t *testing.T) {
+	defer func() { cfg = defaultConfig }()
+
+	for _, tc := range []struct {
+		name   string
+		conf   Config
+		want   string
+		secure bool
+	}{
+		{"secure default", Config{Secure: true, MaxAge: time.Hour}, "__Host-sid", true},
+		{"insecure default", Config{MaxAge: time.Hour}, "sid", false},
+		{"custom name", Config{CookieName: "edev_sid", Secure: true, MaxAge: time.Hour}, "edev_sid", true},
+	} {
+		if err := Configure(tc.conf); err != nil {
+			t.Fatalf("%s: configure: %v", tc.name, err)
+		}
+		rec := httptest.NewRecorder()
+		SetCookie(rec, "v")
+		c := rec.Result().Cookies()[0]
+		if c.Name != tc.want || c.Secure != tc.secure || !c.HttpOnly || c.Path != "/" ||
+			c.MaxAge != 3600 || c.SameSite != http.SameSiteLaxMode {
+			t.Fatalf("%s: unexpected cookie %+v", tc.name, c)
+		}
+
+		rec = httptest.NewRecorder()
+		ClearCookie(rec)
+		if c := rec.Result().Cookies()[0]; c.Name != tc.want || c.MaxAge >= 0 {
+			t.Fatalf("%s: expected clearing cookie, got %+v", tc.name, c)
+		}
+	}
+
+	if err := Configure(Config{CookieName: "__Host-x"}); err == nil {
+		t.Fatalf("expected __Host- name to require Secure")
+	}
+	if err := Configure(Config{SameSite: http.SameSiteNoneMode}); err == nil {
+		t.Fatalf("expected SameSite=None to require Secure")
+	}
+}
+
+// TestGetWithExpiry verifies the expiry of a live session is returned and an
+// expired session reports false.
+func TestGetWithExpiry(t *testing.T) {
+	reset(t)
+	Put("live", user.User{ID: "1"})
+	Put("old", user.User{ID: "2"})
+	edit(t, "old", func(r *Record) { r.ExpiresAt = time.Now().Add(-time.Second).Unix() })
+
+	_, exp, ok := GetWithExpiry("live")
+	if d := time.Until(exp); !ok || d < Lifetime()-5*time.Second || d > Lifetime() {
+		t.Fatalf("expected expiry about %s ahead, got %s ok=%v", Lifetime(), d, ok)
+	}
+	if _, exp, ok := GetWithExpiry("old"); ok || !exp.IsZero() {
+		t.Fatalf("expected expired session to report false, got %s %v", exp, ok)
+	}
+}
@@ -0,0 +1,62 @@
+package session
+
+// defaultShards is used by NewShardedStore when n is not positive.
+const defaultShards = 32
+
+// shardedStore spreads records over several memoryStores keyed by SID hash,
+// so concurrent requests for different sessions rarely share a lock.
+type shardedStore struct {
+	shards []*memoryStore
+}
+
+// NewShardedStore returns an in-process Store split into n shards
+// (defaultShards when n <= 0). Like NewMemoryStore, sessions are lost on
+// restart.
+func NewShardedStore(n int) Store { return newShardedStore(n) }
+
+func newShardedStore(n int) *shardedStore {
+	if n <= 0 {
+		n = defaultShards
+	}
+	s := &shardedStore{shards: make([]*memoryStore, n)}
+	for i := range s.shards {
+		s.shards[i] = newMemoryStore()
+	}
+	return s
+}
+
+func (s *shardedStore) shard(sid string) *memoryStore {
+	// FNV-1a, inlined to keep the hot path free of allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(sid); i++ {
+		h ^= uint32(sid[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+func (s *shardedStore) Put(sid string, r Record)      { s.shard(sid).Put(sid, r) }
+func (s *shardedStore) Get(sid string) (Record, bool) { return s.shard(sid).Get(sid) }
+func (s *shardedStore) Del(sid string)                { s.shard(sid).Del(sid) }
+
+func (s *shardedStore) Update(sid string, fn func(r *Record) bool) bool {
+	return s.shard(sid).Update(sid, fn)
+}
+
+func (s *shardedStore) Touch(sid string, expiresAt int64) bool {
+	return s.shard(sid).Touch(sid, expiresAt)
+}
+
+func (s *shardedStore) Cleanup() {
+	for _, sh := range s.shards {
+		sh.Cleanup()
+	}
+}
+
+func (s *shardedStore) CountByAccount(accountID int64, now int64) int {
+	n := 0
+	for _, sh := range s.shards {
+		n += sh.CountByAccount(accountID, now)
+	}
+	return n
+}
@@ -0,0 +1,159 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"edev/db"
+	"edev/log"
+)
+
+// SQLiteStore persists sessions in a sessions table so they survive restarts.
+// Errors are logged and reported to callers as a missing session.
+type SQLiteStore struct {
+	s *db.SQLite
+}
+
+// NewSQLiteStore returns a Store backed by the sessions table, which the
+// embedded migrations create. It fails when the table is missing so a
+// skipped migration shows up at startup rather than on the first login.
+func NewSQLiteStore(s *db.SQLite) (*SQLiteStore, error) {
+	err := s.Exec(`SELECT sid, user_json, expires_at, csrf, first_login, last_seen, ip, user_agent
+		FROM sessions LIMIT 0`)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite session store: %w", err)
+	}
+	return &SQLiteStore{s: s}, nil
+}
+
+// Ping checks the sessions table can be read within ctx.
+func (st *SQLiteStore) Ping(ctx context.Context) error {
+	var n int
+	return st.s.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions WHERE expires_at < 0`).Scan(&n)
+}
+
+// execer and rowQuerier let Put and Get run on the store or inside the
+// transaction opened by Update.
+type execer interface {
+	Exec(query string, args ...any) error
+}
+
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *db.Row
+}
+
+func (st *SQLiteStore) Put(sid string, r Record) {
+	if err := putRecord(st.s, sid, r); err != nil {
+		log.Errorf("session put: %v", err)
+	}
+}
+
+func putRecord(ex execer, sid string, r Record) error {
+	b, err := json.Marshal(r.User)
+	if err != nil {
+		return err
+	}
+	return ex.Exec(`INSERT INTO sessions (sid, user_json, expires_at, csrf, first_login, last_seen, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(sid) DO UPDATE SET
+			user_json = excluded.user_json,
+			expires_at = excluded.expires_at,
+			csrf = excluded.csrf,
+			first_login = excluded.first_login,
+			last_seen = excluded.last_seen,
+			ip = excluded.ip,
+			user_agent = excluded.user_agent`,
+		sid, string(b), r.ExpiresAt, r.CSRF, r.FirstLogin, r.LastSeen, r.IP, r.UserAgent)
+}
+
+func (st *SQLiteStore) Get(sid string) (Record, bool) {
+	r, ok, err := getRecord(st.s, sid)
+	if err != nil {
+		log.Errorf("session get: %v", err)
+	}
+	return r, ok
+}
+
+// getRecord loads the live record of sid. A missing session is not an error.
+func getRecord(q rowQuerier, sid string) (Record, bool, error) {
+	var (
+		r        Record
+		userJSON string
+	)
+	err := q.QueryRow(`SELECT user_json, expires_at, csrf, first_login, last_seen, ip, user_agent
+		FROM sessions WHERE sid = ? AND expires_at >= ?`, sid, time.Now().Unix()).
+		Scan(&userJSON, &r.ExpiresAt, &r.CSRF, &r.FirstLogin, &r.LastSeen, &r.IP, &r.UserAgent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	if err := json.Unmarshal([]byte(userJSON), &r.User); err != nil {
+		return Record{}, false, err
+	}
+	return r, true, nil
+}
+
+// Update reads and rewrites the row inside one immediate transaction, so
+// concurrent updates of the same SID (from this or another process) cannot
+// interleave.
+func (st *SQLiteStore) Update(sid string, fn func(r *Record) bool) bool {
+	tx, err := st.s.BeginTransaction()
+	if err != nil {
+		log.Errorf("session update: %v", err)
+		return false
+	}
+	r, ok, err := getRecord(tx, sid)
+	if err == nil && ok && fn(&r) {
+		err = putRecord(tx, sid, r)
+	}
+	if err != nil {
+		log.Errorf("session update: %v", err)
+		_ = tx.Rollback()
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Errorf("session update: %v", err)
+		return false
+	}
+	return ok
+}
+
+func (st *SQLiteStore) Touch(sid string, expiresAt int64) bool {
+	return st.Update(sid, func(r *Record) bool {
+		r.ExpiresAt = expiresAt
+		return true
+	})
+}
+
+func (st *SQLiteStore) Del(sid string) {
+	if err := st.s.Exec(`DELETE FROM sessions WHERE sid = ?`, sid); err != nil {
+		log.Errorf("session del: %v", err)
+	}
+}
+
+// Cleanup removes expired and idle sessions in a single DELETE.
+func (st *SQLiteStore) Cleanup() {
+	now := time.Now().Unix()
+	err := st.s.Exec(`DELETE FROM sessions WHERE expires_at < ? OR last_seen < ?`,
+		now, idleSince(now))
+	if err != nil {
+		log.Errorf("session cleanup: %v", err)
+	}
+}
+
+func (st *SQLiteStore) CountByAccount(accountID int64, now int64) int {
+	var n int
+	err := st.s.QueryRow(`SELECT COUNT(*) FROM sessions
+		WHERE json_extract(user_json, '$.account_id') = ? AND expires_at >= ?`, accountID, now).Scan(&n)
+	if err != nil {
+		log.Errorf("session count: %v", err)
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,113 @@
+package session
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"edev/db"
+	"edev/migration"
+	"edev/user"
+)
+
+// helper: open a migrated SQLite session store at path and install it,
+// restoring the memory store when the test ends.
+func openSQLiteStore(t *testing.T, path string) *db.SQLite {
+	t.Helper()
+	s, err := db.NewWithPath(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if _, err := migration.Up(s); err != nil {
+		s.Close()
+		t.Fatalf("migrate: %v", err)
+	}
+	st, err := NewSQLiteStore(s)
+	if err != nil {
+		s.Close()
+		t.Fatalf("new store: %v", err)
+	}
+	SetStore(st)
+	t.Cleanup(func() { SetStore(newMemoryStore()) })
+	return s
+}
+
+// TestSQLiteStoreSurvivesReopen verifies a session written before closing the
+// database is still valid after reopening it.
+func TestSQLiteStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+
+	s := openSQLiteStore(t, path)
+	PutWithMeta("sid-1", user.User{ID: "1", Login: "alice", AccountID: 5}, "203.0.113.7", "Mozilla/5.0")
+	MarkFirstLogin("sid-1")
+	token := IssueCSRF("sid-1")
+	s.Close()
+
+	s = openSQLiteStore(t, path)
+	defer s.Close()
+	u, ok := Get("sid-1")
+	if !ok || u.Login != "alice" {
+		t.Fatalf("expected session to survive reopen, got %+v ok=%v", u, ok)
+	}
+	if !ValidateCSRF("sid-1", token) {
+		t.Fatalf("expected CSRF token to survive reopen")
+	}
+	if !TakeFirstLogin("sid-1") {
+		t.Fatalf("expected first login flag to survive reopen")
+	}
+	if m, _ := GetMeta("sid-1"); m.IP != "203.0.113.7" || m.UserAgent != "Mozilla/5.0" {
+		t.Fatalf("expected client meta to survive reopen, got %+v", m)
+	}
+	if n := CountByAccount(5); n != 1 {
+		t.Fatalf("expected 1 session for alice, got %d", n)
+	}
+}
+
+// TestSQLiteStoreExpiry verifies Get ignores expired rows and Cleanup deletes
+// them.
+func TestSQLiteStoreExpiry(t *testing.T) {
+	s := openSQLiteStore(t, filepath.Join(t.TempDir(), "sessions.db"))
+	defer s.Close()
+
+	now := time.Now().Unix()
+	store.Put("live", Record{User: user.User{ID: "1"}, ExpiresAt: now + 60, LastSeen: now})
+	store.Put("old", Record{User: user.User{ID: "2"}, ExpiresAt: now - 60, LastSeen: now})
+
+	if _, ok := Get("old"); ok {
+		t.Fatalf("expected expired session to be missing")
+	}
+	Cleanup()
+
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 row after cleanup, got %d", n)
+	}
+	if _, ok := Get("live"); !ok {
+		t.Fatalf("expected live session to remain")
+	}
+}
+
+// TestSQLiteStoreUpdateConcurrent verifies concurrent read-modify-write calls
+// on one session agree on a single CSRF token.
+func TestSQLiteStoreUpdateConcurrent(t *testing.T) {
+	s := openSQLiteStore(t, filepath.Join(t.TempDir(), "sessions.db"))
+	defer s.Close()
+	Put("sid-1", user.User{ID: "1"})
+	assertSingleCSRF(t, "sid-1")
+}
+
+// TestNewSQLiteStoreNeedsSchema verifies the store refuses a database the
+// migrations have not run on.
+func TestNewSQLiteStoreNeedsSchema(t *testing.T) {
+	s, err := db.NewWithPath(db.MemoryPath)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer s.Close()
+	if _, err := NewSQLiteStore(s); err == nil {
+		t.Fatalf("expected an error without the sessions table")
+	}
+}
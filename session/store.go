@@ -0,0 +1,105 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps session records by SID. Get must not return records whose
+// ExpiresAt has passed; Cleanup drops expired and idle records.
+//
+// Update applies fn to the live record of sid and stores the result when fn
+// returns true, atomically with respect to other writers of that SID. It
+// reports whether the session exists. fn may run more than once when the
+// store retries on contention, so it must not have side effects beyond
+// setting its own results.
+//
+// Touch moves the expiry of a live session to expiresAt and reports whether
+// the session exists.
+type Store interface {
+	Put(sid string, r Record)
+	Get(sid string) (Record, bool)
+	Update(sid string, fn func(r *Record) bool) bool
+	Touch(sid string, expiresAt int64) bool
+	Del(sid string)
+	Cleanup()
+}
+
+// memoryStore is the default Store; sessions are lost on restart.
+type memoryStore struct {
+	sync.RWMutex
+	m map[string]Record
+}
+
+// NewMemoryStore returns an in-process Store; sessions are lost on restart
+// and not shared between instances.
+func NewMemoryStore() Store { return newMemoryStore() }
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{m: make(map[string]Record)}
+}
+
+func (s *memoryStore) Put(sid string, r Record) {
+	s.Lock()
+	s.m[sid] = r
+	s.Unlock()
+}
+
+func (s *memoryStore) Get(sid string) (Record, bool) {
+	s.RLock()
+	r, ok := s.m[sid]
+	s.RUnlock()
+	if !ok || r.ExpiresAt < time.Now().Unix() {
+		return Record{}, false
+	}
+	return r, true
+}
+
+func (s *memoryStore) Update(sid string, fn func(r *Record) bool) bool {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.m[sid]
+	if !ok || r.ExpiresAt < time.Now().Unix() {
+		return false
+	}
+	if fn(&r) {
+		s.m[sid] = r
+	}
+	return true
+}
+
+func (s *memoryStore) Touch(sid string, expiresAt int64) bool {
+	return s.Update(sid, func(r *Record) bool {
+		r.ExpiresAt = expiresAt
+		return true
+	})
+}
+
+func (s *memoryStore) Del(sid string) {
+	s.Lock()
+	delete(s.m, sid)
+	s.Unlock()
+}
+
+func (s *memoryStore) Cleanup() {
+	now := time.Now().Unix()
+	s.Lock()
+	for sid, r := range s.m {
+		if r.ExpiresAt < now || idle(r, now) {
+			delete(s.m, sid)
+		}
+	}
+	s.Unlock()
+}
+
+func (s *memoryStore) CountByAccount(accountID int64, now int64) int {
+	n := 0
+	s.RLock()
+	for _, r := range s.m {
+		if r.User.AccountID == accountID && r.ExpiresAt >= now {
+			n++
+		}
+	}
+	s.RUnlock()
+	return n
+}
@@ -0,0 +1,211 @@
+package session
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edev/user"
+)
+
+// inProcessStores lists the in-process Store implementations that must
+// behave identically.
+var inProcessStores = []struct {
+	name string
+	new  func() Store
+}{
+	{"memory", func() Store { return newMemoryStore() }},
+	{"sharded", func() Store { return newShardedStore(8) }},
+}
+
+// TestStoreContract verifies every in-process store honours Put, Get, Update,
+// Touch, Del, expiry, Cleanup and CountByAccount the same way.
+func TestStoreContract(t *testing.T) {
+	for _, tc := range inProcessStores {
+		t.Run(tc.name, func(t *testing.T) {
+			st := tc.new()
+			now := time.Now().Unix()
+
+			for i := range 20 {
+				st.Put("live-"+strconv.Itoa(i), Record{User: user.User{ID: "1", AccountID: 1}, ExpiresAt: now + 60, LastSeen: now})
+			}
+			st.Put("old", Record{User: user.User{ID: "1", AccountID: 1}, ExpiresAt: now - 60, LastSeen: now})
+			st.Put("other", Record{User: user.User{ID: "1", AccountID: 2}, ExpiresAt: now + 60, LastSeen: now})
+
+			if r, ok := st.Get("live-3"); !ok || r.User.ID != "1" {
+				t.Fatalf("expected live-3, got %+v ok=%v", r, ok)
+			}
+			if _, ok := st.Get("old"); ok {
+				t.Fatalf("expected expired record to be hidden")
+			}
+			if _, ok := st.Get("missing"); ok {
+				t.Fatalf("expected missing record to be absent")
+			}
+
+			if !st.Update("live-4", func(r *Record) bool { r.CSRF = "tok"; return true }) {
+				t.Fatalf("expected update of live-4 to find it")
+			}
+			if r, _ := st.Get("live-4"); r.CSRF != "tok" {
+				t.Fatalf("expected update to be stored, got %+v", r)
+			}
+			st.Update("live-4", func(r *Record) bool { r.CSRF = "ignored"; return false })
+			if r, _ := st.Get("live-4"); r.CSRF != "tok" {
+				t.Fatalf("expected update returning false not to be stored, got %+v", r)
+			}
+			if st.Update("old", func(*Record) bool { t.Fatalf("fn called for expired record"); return false }) {
+				t.Fatalf("expected update of expired record to report missing")
+			}
+
+			if !st.Touch("live-5", now+600) {
+				t.Fatalf("expected touch of live-5 to find it")
+			}
+			if r, _ := st.Get("live-5"); r.ExpiresAt != now+600 {
+				t.Fatalf("expected touch to move the expiry, got %d", r.ExpiresAt)
+			}
+			if st.Touch("old", now+600) {
+				t.Fatalf("expected touch not to revive an expired record")
+			}
+
+			uc, ok := st.(accountCounter)
+			if !ok {
+				t.Fatalf("expected %s store to count sessions by account", tc.name)
+			}
+			if n := uc.CountByAccount(1, now); n != 20 {
+				t.Fatalf("expected 20 live sessions for account 1, got %d", n)
+			}
+
+			st.Del("live-3")
+			if _, ok := st.Get("live-3"); ok {
+				t.Fatalf("expected deleted record to be gone")
+			}
+
+			st.Cleanup()
+			if n := uc.CountByAccount(1, now-120); n != 19 {
+				t.Fatalf("expected cleanup to drop only the expired record, got %d left", n)
+			}
+		})
+	}
+}
+
+// TestUpdateConcurrent verifies concurrent read-modify-write calls on one
+// session agree on a single CSRF token without a package-level lock.
+func TestUpdateConcurrent(t *testing.T) {
+	for _, tc := range inProcessStores {
+		t.Run(tc.name, func(t *testing.T) {
+			SetStore(tc.new())
+			t.Cleanup(func() { SetStore(newMemoryStore()) })
+			Put("sid-1", user.User{ID: "1"})
+			assertSingleCSRF(t, "sid-1")
+		})
+	}
+}
+
+// TestShardedStoreSessionAPI verifies the package-level session functions
+// work unchanged on top of the sharded store.
+func TestShardedStoreSessionAPI(t *testing.T) {
+	SetStore(NewShardedStore(0))
+	t.Cleanup(func() { SetStore(newMemoryStore()) })
+
+	Put("sid-1", user.User{ID: "1", Login: "alice"})
+	tok := IssueCSRF("sid-1")
+	if !ValidateCSRF("sid-1", tok) {
+		t.Fatalf("expected CSRF token to validate")
+	}
+	sid := Rotate("sid-1", user.User{ID: "1", Login: "alice"})
+	if _, ok := Get("sid-1"); ok {
+		t.Fatalf("expected old SID to be gone after rotate")
+	}
+	if u, ok := Get(sid); !ok || u.Login != "alice" {
+		t.Fatalf("expected rotated session, got %+v ok=%v", u, ok)
+	}
+}
+
+// helper: issue the CSRF token of sid from many goroutines at once and fail
+// unless they all got the same one.
+func assertSingleCSRF(t *testing.T, sid string) {
+	t.Helper()
+	const n = 16
+	tokens := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() { tokens[i] = IssueCSRF(sid) })
+	}
+	wg.Wait()
+	for _, tok := range tokens {
+		if tok == "" || tok != tokens[0] {
+			t.Fatalf("expected one CSRF token, got %q", tokens)
+		}
+	}
+}
+
+// BenchmarkStoreParallel compares the single-map and sharded stores under
+// concurrent traffic: mostly Gets with one Put in eight, over a fixed pool of
+// live sessions.
+func BenchmarkStoreParallel(b *testing.B) {
+	const sessions = 10000
+	sids := make([]string, sessions)
+	for i := range sids {
+		sids[i] = "sid-" + strconv.Itoa(i)
+	}
+	for _, tc := range inProcessStores {
+		b.Run(tc.name, func(b *testing.B) {
+			st := tc.new()
+			rec := Record{User: user.User{ID: "1"}, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+			for _, sid := range sids {
+				st.Put(sid, rec)
+			}
+			var seed atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seed.Add(7919)
+				for pb.Next() {
+					i++
+					sid := sids[i%sessions]
+					if i%8 == 0 {
+						st.Put(sid, rec)
+					} else {
+						st.Get(sid)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSessionGetParallel measures Get and Put through the package API,
+// so any lock held above the store shows up here.
+func BenchmarkSessionGetParallel(b *testing.B) {
+	const sessions = 10000
+	sids := make([]string, sessions)
+	for i := range sids {
+		sids[i] = "sid-" + strconv.Itoa(i)
+	}
+	u := user.User{ID: "1"}
+	for _, tc := range inProcessStores {
+		b.Run(tc.name, func(b *testing.B) {
+			SetStore(tc.new())
+			b.Cleanup(func() { SetStore(newMemoryStore()) })
+			for _, sid := range sids {
+				Put(sid, u)
+			}
+			var seed atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seed.Add(7919)
+				for pb.Next() {
+					i++
+					sid := sids[i%sessions]
+					if i%8 == 0 {
+						Put(sid, u)
+					} else {
+						Get(sid)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Package settings is a small key/value store in the settings table for
+// values operators change at runtime, without a deploy.
+package settings
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"edev/db"
+)
+
+// MaintenanceBanner is the text shown on top of the pages; empty hides it.
+const MaintenanceBanner = "maintenance_banner"
+
+// Get returns the value of key, or "" when it is not set.
+func Get(s *db.SQLite, key string) (string, error) {
+	var v string
+	err := s.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get setting %s: %w", key, err)
+	}
+	return v, nil
+}
+
+// Set stores value under key. An empty value deletes the key.
+func Set(s *db.SQLite, key, value string) error {
+	var err error
+	if value == "" {
+		err = s.Exec(`DELETE FROM settings WHERE key = ?`, key)
+	} else {
+		err = s.Exec(`INSERT INTO settings (key, value) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP`,
+			key, value)
+	}
+	if err != nil {
+		return fmt.Errorf("set setting %s: %w", key, err)
+	}
+	return nil
+}
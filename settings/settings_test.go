@@ -0,0 +1,35 @@
+package settings
+
+import (
+	"testing"
+
+	"edev/db"
+	"edev/migration"
+)
+
+// TestSetGet verifies values round-trip, are overwritten, and that setting
+// an empty value removes the key.
+func TestSetGet(t *testing.T) {
+	s, err := db.NewWithPath(db.MemoryPath)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer s.Close()
+	if _, err := migration.Up(s); err != nil {
+		t.Fatalf("apply schema: %v", err)
+	}
+
+	for _, v := range []string{"first", "second", ""} {
+		if err := Set(s, MaintenanceBanner, v); err != nil {
+			t.Fatalf("set %q: %v", v, err)
+		}
+		got, err := Get(s, MaintenanceBanner)
+		if err != nil || got != v {
+			t.Fatalf("expected %q, got %q (%v)", v, got, err)
+		}
+	}
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM settings`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("expected cleared key to be deleted, got %d rows (%v)", n, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"edev/config"
+	"edev/log"
+	"edev/templates"
+	"edev/utils"
+)
+
+// OAuth state store: state -> PKCE verifier, kept in memory between the
+// login redirect and the provider callback.
+
+type stateEntry struct {
+	Verifier string
+	Expires  time.Time
+}
+
+// usedStateTTL is how long consumed states are remembered to tell a replayed
+// callback apart from a genuinely expired one.
+const usedStateTTL = 10 * time.Minute
+
+// stateCookie double-submits the OAuth state: the login handler stores it in
+// the browser that started the login, and the callback only proceeds when the
+// state it receives matches. This stops login CSRF, where a victim is made to
+// complete a login the attacker started. Only the latest login per browser is
+// honored; an older tab gets errStateCookie.
+const stateCookie = "oauth_state"
+
+var (
+	errStateInvalid = errors.New("invalid/expired state")
+	errStateReused  = errors.New("state already used")
+	// errStateLost means no states are held at all, which happens when the
+	// server restarted between the login redirect and the callback.
+	errStateLost = errors.New("login session expired")
+	// errStateCookie means the callback came to a browser that did not start
+	// this login (or started a newer one since).
+	errStateCookie = errors.New("state does not match this browser")
+
+	states = struct {
+		sync.Mutex
+		m    map[string]stateEntry
+		used map[string]time.Time // consumed state -> forget after
+	}{
+		m:    make(map[string]stateEntry),
+		used: make(map[string]time.Time),
+	}
+)
+
+// validateStateConfig rejects a state TTL or cleanup interval that is not
+// positive: states would expire at once, or the janitor would never run.
+func validateStateConfig(ttl, cleanupInterval time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("StateTTL %s must be positive", ttl)
+	}
+	if cleanupInterval <= 0 {
+		return fmt.Errorf("StateCleanupInterval %s must be positive", cleanupInterval)
+	}
+	return nil
+}
+
+func putState(st, verifier string, ttl time.Duration) {
+	states.Lock()
+	states.m[st] = stateEntry{Verifier: verifier, Expires: time.Now().Add(ttl)}
+	states.Unlock()
+}
+
+// cleanupStates prunes expired states and replay markers. It runs as a
+// periodic job so putState stays O(1).
+func cleanupStates() {
+	now := time.Now()
+	states.Lock()
+	for k, v := range states.m {
+		if now.After(v.Expires) {
+			delete(states.m, k)
+		}
+	}
+	for k, exp := range states.used {
+		if now.After(exp) {
+			delete(states.used, k)
+		}
+	}
+	states.Unlock()
+}
+
+// takeState consumes st and returns its verifier. A state that was already
+// consumed yields errStateReused (logged as a possible replay); unknown or
+// expired states yield errStateInvalid, or errStateLost when the store is
+// empty.
+func takeState(st string) (string, error) {
+	states.Lock()
+	defer states.Unlock()
+	if exp, ok := states.used[st]; ok && time.Now().Before(exp) {
+		log.Warnf("oauth state reused, possible replay")
+		return "", errStateReused
+	}
+	ent, ok := states.m[st]
+	if !ok && len(states.m) == 0 {
+		return "", errStateLost
+	}
+	delete(states.m, st)
+	if !ok || time.Now().After(ent.Expires) {
+		return "", errStateInvalid
+	}
+	states.used[st] = time.Now().Add(usedStateTTL)
+	return ent.Verifier, nil
+}
+
+// setStateCookie binds st to the browser for takeStateFor. It is a no-op
+// when StateCookieCheck is off.
+func setStateCookie(w http.ResponseWriter, r *http.Request, st string) {
+	if !config.Cfg.StateCookieCheck {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    st,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Cfg.BaseURL, "https://") || utils.RequestIsSecure(r, config.Cfg.TrustProxy),
+		SameSite: http.SameSiteLaxMode, // sent on the provider's top-level redirect back
+		MaxAge:   int(config.Cfg.StateTTL.Seconds()),
+	})
+}
+
+// takeStateFor is takeState for a callback request: with StateCookieCheck
+// on, st must also match the browser's stateCookie, which is then cleared. A
+// mismatch leaves st in the store and yields errStateCookie.
+func takeStateFor(w http.ResponseWriter, r *http.Request, st string) (string, error) {
+	if config.Cfg.StateCookieCheck {
+		c, err := r.Cookie(stateCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(st)) != 1 {
+			log.Warnf("oauth state cookie missing or mismatched, possible login CSRF")
+			return "", errStateCookie
+		}
+		http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/", MaxAge: -1})
+	}
+	return takeState(st)
+}
+
+// writeStateError reports a takeState failure. A lost state gets a friendly
+// page with a retry link; tampered or replayed states get a plain 400.
+func writeStateError(w http.ResponseWriter, err error) {
+	if !errors.Is(err, errStateLost) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	data := struct{ RetryURL string }{"/login"}
+	if err := templates.ExecuteTemplate(w, "expired.ghtml", data); err != nil {
+		log.Printf("template %s execute error: %v", "expired.ghtml", err)
+	}
+}
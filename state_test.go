@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edev/jobs"
+)
+
+// helper: build a callback request for state st from the browser that
+// started the login, i.e. carrying the matching state cookie.
+func callbackRequest(target, st string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.AddCookie(&http.Cookie{Name: stateCookie, Value: st})
+	return req
+}
+
+// TestStateReplay verifies a second callback with the same state gets the
+// replay-specific response instead of the generic invalid/expired one.
+func TestStateReplay(t *testing.T) {
+	putState("st-replay", "verifier", time.Minute)
+
+	call := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := callbackRequest(githubCallbackPath+"?state=st-replay", "st-replay")
+		gitHubProvider.CallbackHandler(rec, req)
+		return rec
+	}
+
+	// First use consumes the state (and fails later for lack of a code).
+	if rec := call(); strings.Contains(rec.Body.String(), "state") {
+		t.Fatalf("expected first use to pass state validation, got %q", rec.Body.String())
+	}
+
+	rec := call()
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errStateReused.Error()) {
+		t.Fatalf("expected replay response, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	putState("st-other", "verifier", time.Minute)
+	if _, err := takeState("st-unknown"); err != errStateInvalid {
+		t.Fatalf("expected errStateInvalid for unknown state, got %v", err)
+	}
+}
+
+// TestStateJanitor verifies the cleanup job prunes an expired state after its
+// interval.
+func TestStateJanitor(t *testing.T) {
+	putState("st-expired", "verifier", -time.Second)
+
+	s := jobs.New(context.Background())
+	defer s.Stop()
+	s.Every("state-cleanup", 10*time.Millisecond, func(context.Context) error {
+		cleanupStates()
+		return nil
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		states.Lock()
+		_, ok := states.m["st-expired"]
+		states.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected expired state to be pruned by the cleanup job")
+}
+
+// TestStateLostAfterRestart verifies a callback arriving when no states exist
+// at all (as after a restart) gets the friendly retry page, not the tampered
+// state error.
+func TestStateLostAfterRestart(t *testing.T) {
+	states.Lock()
+	saved := states.m
+	states.m = make(map[string]stateEntry)
+	states.Unlock()
+	defer func() {
+		states.Lock()
+		states.m = saved
+		states.Unlock()
+	}()
+
+	rec := httptest.NewRecorder()
+	req := callbackRequest(githubCallbackPath+"?state=st-lost&code=c", "st-lost")
+	gitHubProvider.CallbackHandler(rec, req)
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected HTML 400, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, `href="/login"`) || strings.Contains(body, errStateInvalid.Error()) {
+		t.Fatalf("expected retry link without tampered-state error, got %q", body)
+	}
+}
+
+// helper: fill the state store with n live entries and restore it afterwards.
+func prefillStates(b *testing.B, n int) {
+	b.Helper()
+	states.Lock()
+	saved := states.m
+	states.m = make(map[string]stateEntry, n)
+	exp := time.Now().Add(time.Hour)
+	for i := range n {
+		states.m["prefill-"+strconv.Itoa(i)] = stateEntry{Verifier: "v", Expires: exp}
+	}
+	states.Unlock()
+	b.Cleanup(func() {
+		states.Lock()
+		states.m = saved
+		states.Unlock()
+	})
+}
+
+// putStateSweeping is the former putState, which pruned expired entries while
+// holding the lock. Kept only as the benchmark baseline.
+func putStateSweeping(st, verifier string, ttl time.Duration) {
+	now := time.Now()
+	states.Lock()
+	for k, v := range states.m {
+		if now.After(v.Expires) {
+			delete(states.m, k)
+		}
+	}
+	states.m[st] = stateEntry{Verifier: verifier, Expires: now.Add(ttl)}
+	states.Unlock()
+}
+
+// BenchmarkPutState compares concurrent logins with the inline sweep (before)
+// and with the O(1) insert plus background cleanup job (after).
+func BenchmarkPutState(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		put  func(st, verifier string, ttl time.Duration)
+	}{
+		{"sweep", putStateSweeping},
+		{"insert", putState},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			prefillStates(b, 10000)
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					bc.put("bench-"+strconv.FormatInt(n.Add(1), 10), "v", time.Minute)
+				}
+			})
+		})
+	}
+}
+
+// TestStateCookieRequired verifies a callback whose state is not bound to the
+// browser by the state cookie is rejected (login CSRF) without consuming the
+// state, and that the login handler sets the cookie.
+func TestStateCookieRequired(t *testing.T) {
+	rec := httptest.NewRecorder()
+	gitHubProvider.LoginHandler(rec, httptest.NewRequest(http.MethodGet, "/login/github", nil))
+	var st string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == stateCookie {
+			st = c.Value
+		}
+	}
+	if st == "" {
+		t.Fatalf("expected the login handler to set %s", stateCookie)
+	}
+
+	for name, req := range map[string]*http.Request{
+		"missing":  httptest.NewRequest(http.MethodGet, githubCallbackPath+"?state="+st, nil),
+		"mismatch": callbackRequest(githubCallbackPath+"?state="+st, "attacker-state"),
+	} {
+		rec := httptest.NewRecorder()
+		gitHubProvider.CallbackHandler(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errStateCookie.Error()) {
+			t.Fatalf("%s cookie: expected 400 %q, got %d %q", name, errStateCookie, rec.Code, rec.Body.String())
+		}
+	}
+
+	if _, err := takeStateFor(httptest.NewRecorder(), callbackRequest("/", st), st); err != nil {
+		t.Fatalf("expected the state to survive rejected callbacks, got %v", err)
+	}
+}
+
+// TestValidateStateConfig verifies non-positive state durations are rejected.
+func TestValidateStateConfig(t *testing.T) {
+	for _, tc := range []struct {
+		ttl, interval time.Duration
+		ok            bool
+	}{
+		{10 * time.Minute, time.Minute, true},
+		{0, time.Minute, false},
+		{-time.Second, time.Minute, false},
+		{10 * time.Minute, 0, false},
+		{10 * time.Minute, -time.Minute, false},
+	} {
+		err := validateStateConfig(tc.ttl, tc.interval)
+		if (err == nil) != tc.ok {
+			t.Fatalf("validateStateConfig(%s, %s) = %v, want ok=%v", tc.ttl, tc.interval, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"edev/config"
+	"edev/db"
+	"edev/log"
+	"edev/migration"
+	"edev/session"
+)
+
+// statusTimeout bounds each component check so a hung dependency can't stall
+// the status page.
+const statusTimeout = 2 * time.Second
+
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+)
+
+// componentStatus is one entry of the /status report.
+type componentStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// statusReport is the /status body: the overall status is degraded when any
+// component is.
+type statusReport struct {
+	Status     string                     `json:"status"`
+	Version    string                     `json:"version"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// checkStatus runs every component check. The public report (detailed
+// false) only says whether the database and session store are ok; failures
+// are logged. The detailed one, for admins, adds error messages, the session
+// backend and the configured providers, of which only the fake provider,
+// running locally, is probed.
+func checkStatus(ctx context.Context, detailed bool) statusReport {
+	rep := statusReport{
+		Status:     statusOK,
+		Version:    config.Cfg.GitTag,
+		Components: make(map[string]componentStatus),
+	}
+	set := func(name string, err error, okMsg string) {
+		c := componentStatus{Status: statusOK, Message: okMsg}
+		if err != nil {
+			log.Warnf("status: %s: %v", name, err)
+			c = componentStatus{Status: statusDegraded, Message: err.Error()}
+			rep.Status = statusDegraded
+		}
+		if !detailed {
+			c.Message = ""
+		}
+		rep.Components[name] = c
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	set("db", checkDB(dctx), "")
+	cancel()
+	sctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	set("sessions", session.Ping(sctx), config.Cfg.SessionStore)
+	cancel()
+
+	if !detailed {
+		return rep
+	}
+	if config.Cfg.GitHubClientID != "" {
+		set("provider:github", nil, "configured")
+	}
+	if config.Cfg.XClientID != "" {
+		set("provider:x", nil, "configured")
+	}
+	if config.Cfg.FakeOAuthEnabled {
+		set("provider:fake", checkFakeProvider(ctx), "reachable")
+	}
+	return rep
+}
+
+// checkDB pings both database pools within ctx.
+func checkDB(ctx context.Context) error {
+	if db.Storage == nil {
+		return errors.New("no database")
+	}
+	return db.Storage.Ping(ctx)
+}
+
+// checkDBRead probes only the read pool; see db.SQLite.PingRead.
+func checkDBRead(ctx context.Context) error {
+	if db.Storage == nil {
+		return errors.New("no database")
+	}
+	return db.Storage.PingRead(ctx)
+}
+
+// checkFakeProvider probes the fake OAuth server's health endpoint.
+func checkFakeProvider(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, config.Cfg.FakeOAuthBaseURL+"/healthz", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("close fake healthz body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthz status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// versionReport is the /version body. SchemaVersion is the highest migration
+// applied to the database (null when it can't be read) and SchemaExpected the
+// highest one embedded in this binary; after a deploy they should match.
+type versionReport struct {
+	Version        string `json:"version"`
+	SchemaVersion  *int   `json:"schema_version"`
+	SchemaExpected int    `json:"schema_expected"`
+}
+
+// versionHandler reports the build tag and the database schema version.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	rep := versionReport{Version: config.Cfg.GitTag}
+	if ms, err := migration.List(); err != nil {
+		log.Printf("version: list migrations: %v", err)
+	} else if len(ms) > 0 {
+		rep.SchemaExpected = ms[len(ms)-1].Version
+	}
+	if db.Storage != nil {
+		if v, err := db.Storage.CurrentVersion(); err != nil {
+			log.Printf("version: schema version: %v", err)
+		} else {
+			rep.SchemaVersion = &v
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		log.Printf("encode version: %v", err)
+	}
+}
+
+// statusHandler serves the component report as JSON, with details only for
+// requests carrying the admin token.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(checkStatus(r.Context(), isAdmin(r))); err != nil {
+		log.Printf("encode status: %v", err)
+	}
+}
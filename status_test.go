@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"edev/config"
+	"edev/db"
+	"edev/migration"
+)
+
+// TestStatusHealthyDB verifies /status reports the db component as ok on a
+// working database and degraded without one.
+func TestStatusHealthyDB(t *testing.T) {
+	useTestDB(t)
+
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var rep statusReport
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if c, ok := rep.Components["db"]; !ok || c.Status != statusOK {
+		t.Fatalf("expected db ok, got %+v", rep.Components)
+	}
+	if c := rep.Components["sessions"]; c.Status != statusOK {
+		t.Fatalf("expected sessions ok, got %+v", c)
+	}
+	if rep.Status != statusOK {
+		t.Fatalf("expected overall ok, got %q", rep.Status)
+	}
+
+	prev := db.Storage
+	db.Storage = nil
+	defer func() { db.Storage = prev }()
+	rep = checkStatus(t.Context(), true)
+	if rep.Components["db"].Status != statusDegraded || rep.Status != statusDegraded {
+		t.Fatalf("expected degraded without a database, got %+v", rep)
+	}
+}
+
+// TestStatusPublicHidesDetails verifies anonymous /status carries no error
+// text or provider list, while the admin token gets both.
+func TestStatusPublicHidesDetails(t *testing.T) {
+	prevDB := db.Storage
+	db.Storage = nil
+	defer func() { db.Storage = prevDB }()
+	prevToken, prevGitHub := config.Cfg.AdminToken, config.Cfg.GitHubClientID
+	config.Cfg.AdminToken, config.Cfg.GitHubClientID = "admin-secret", "gh-id"
+	defer func() { config.Cfg.AdminToken, config.Cfg.GitHubClientID = prevToken, prevGitHub }()
+
+	get := func(token string) statusReport {
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		routes().ServeHTTP(rec, req)
+		var rep statusReport
+		if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return rep
+	}
+
+	rep := get("")
+	if c := rep.Components["db"]; c.Status != statusDegraded || c.Message != "" {
+		t.Fatalf("expected a bare degraded db for anonymous requests, got %+v", c)
+	}
+	if _, ok := rep.Components["provider:github"]; ok {
+		t.Fatalf("expected providers hidden from anonymous requests, got %+v", rep.Components)
+	}
+
+	rep = get("admin-secret")
+	if c := rep.Components["db"]; c.Message == "" {
+		t.Fatalf("expected the db error for admins, got %+v", c)
+	}
+	if _, ok := rep.Components["provider:github"]; !ok {
+		t.Fatalf("expected providers listed for admins, got %+v", rep.Components)
+	}
+}
+
+// TestVersionSchema verifies /version reports the build tag and, once the
+// migrations ran, the schema version of the last embedded migration.
+func TestVersionSchema(t *testing.T) {
+	useTestDB(t)
+	prev := config.Cfg.GitTag
+	config.Cfg.GitTag = "v1.2.3"
+	defer func() { config.Cfg.GitTag = prev }()
+
+	ms, err := migration.List()
+	if err != nil || len(ms) == 0 {
+		t.Fatalf("list migrations: %v (%d)", err, len(ms))
+	}
+	want := ms[len(ms)-1].Version
+
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var rep versionReport
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rep.Version != "v1.2.3" || rep.SchemaVersion == nil || *rep.SchemaVersion != want || rep.SchemaExpected != want {
+		t.Fatalf("expected version v1.2.3 schema %d/%d, got %+v", want, want, rep)
+	}
+}
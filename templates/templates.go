@@ -3,6 +3,7 @@ package templates
 import (
 	"html/template"
 	"log"
+	"strings"
 )
 
 func loadTemplates() *template.Template {
@@ -17,3 +18,11 @@ func loadTemplates() *template.Template {
 
 	return tpl
 }
+
+// RenderToString executes templateName with data and returns the output, so
+// tests can check templates without a running server.
+func RenderToString(templateName string, data any) (string, error) {
+	var b strings.Builder
+	err := ExecuteTemplate(&b, templateName, data)
+	return b.String(), err
+}
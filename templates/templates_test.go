@@ -0,0 +1,102 @@
+//go:build !dev
+
+package templates
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"edev/user"
+)
+
+// TestLogoutForm verifies the partial posts to /logout with the CSRF field.
+func TestLogoutForm(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExecuteTemplate(&buf, "logoutForm", "tok123"); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`<form method="post" action="/logout">`,
+		`name="csrf_token" value="tok123"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output, got %q", want, out)
+		}
+	}
+}
+
+// TestRenderIndex verifies index.ghtml executes for both anonymous and authed
+// data.
+func TestRenderIndex(t *testing.T) {
+	type indexData struct {
+		Authed     bool
+		FirstLogin bool
+		CSRF       string
+		Banner     string
+		User       user.View
+	}
+	for _, tc := range []struct {
+		name string
+		data indexData
+		want string
+	}{
+		{"anonymous", indexData{}, `href="/login"`},
+		{"authed", indexData{
+			Authed:     true,
+			FirstLogin: true,
+			CSRF:       "tok",
+			User:       user.NewView(user.User{ID: "1", Login: "alice", CreatedAt: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)}),
+		}, "06/05/2024"},
+		{"initials without avatar", indexData{
+			Authed: true,
+			User:   user.NewView(user.User{ID: "1", Login: "alice", Name: "Alice Liddell"}),
+		}, `avatar-initials" aria-hidden="true">AL</div>`},
+		{"avatar url", indexData{
+			Authed: true,
+			User:   user.NewView(user.User{ID: "1", Login: "alice", AvatarURL: "https://example.com/a.png"}),
+		}, `src="https://example.com/a.png"`},
+	} {
+		out, err := RenderToString("index.ghtml", tc.data)
+		if err != nil {
+			t.Fatalf("%s: render: %v", tc.name, err)
+		}
+		if !strings.Contains(out, tc.want) {
+			t.Fatalf("%s: expected %q in output", tc.name, tc.want)
+		}
+	}
+}
+
+// TestRenderIndexEscapesUserFields verifies provider-controlled values are
+// escaped in text and attribute contexts.
+func TestRenderIndexEscapesUserFields(t *testing.T) {
+	data := struct {
+		Authed     bool
+		FirstLogin bool
+		CSRF       string
+		Banner     string
+		User       user.View
+	}{
+		Authed: true,
+		User: user.NewView(user.User{
+			ID:        "1",
+			Login:     "alice",
+			Name:      `"><script>alert(1)</script>`,
+			AvatarURL: `javascript:alert(1)`,
+		}),
+	}
+	out, err := RenderToString("index.ghtml", data)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	for _, bad := range []string{"<script>alert(1)</script>", `src="javascript:`} {
+		if strings.Contains(out, bad) {
+			t.Fatalf("expected %q to be escaped, got %q", bad, out)
+		}
+	}
+	if !strings.Contains(out, "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Fatalf("expected escaped name in output")
+	}
+}
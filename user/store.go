@@ -0,0 +1,176 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"edev/config"
+	"edev/db"
+	"edev/utils"
+)
+
+// Upsert records a login through provider in the users/identities tables.
+// The first login creates the account; later logins only refresh the identity
+// (avatar, granted scopes), so users.created_at keeps the original account creation date.
+// When the identity is new and u.AccountID is set (the caller is already
+// signed in), the identity is linked to that account instead, up to
+// config.Cfg.MaxIdentities and one identity per provider; past that
+// ErrIdentityLimit or ErrProviderLinked is returned.
+// The returned User carries AccountID and CreatedAt from the database; created reports
+// whether this login created the account.
+func Upsert(s *db.SQLite, provider string, u User) (_ User, created bool, err error) {
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		return u, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var userID int64
+	err = tx.QueryRow(`
+		SELECT u.id, u.created_at
+		FROM identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider = ? AND i.provider_uid = ?`,
+		provider, u.ID).Scan(&userID, &u.CreatedAt)
+	switch {
+	case err == nil:
+		err = tx.Exec(`UPDATE identities SET avatar_url = ?, scopes = ? WHERE provider = ? AND provider_uid = ?`,
+			u.AvatarURL, strings.Join(u.Scopes, " "), provider, u.ID)
+		if err != nil {
+			return u, false, fmt.Errorf("update identity: %w", err)
+		}
+	case errors.Is(err, sql.ErrNoRows) && u.AccountID != 0:
+		userID = u.AccountID
+		var same, n int
+		err = tx.QueryRow(`
+			SELECT COALESCE(SUM(provider = ?), 0), COUNT(*)
+			FROM identities WHERE user_id = ?`,
+			provider, userID).Scan(&same, &n)
+		if err != nil {
+			return u, false, fmt.Errorf("count identities: %w", err)
+		}
+		switch {
+		case same > 0:
+			return u, false, ErrProviderLinked
+		case n >= config.Cfg.MaxIdentities:
+			return u, false, ErrIdentityLimit
+		}
+		err = tx.QueryRow(`SELECT created_at FROM users WHERE id = ?`, userID).Scan(&u.CreatedAt)
+		if err != nil {
+			return u, false, fmt.Errorf("read user: %w", err)
+		}
+		err = tx.Exec(`INSERT INTO identities(user_id, provider, provider_uid, avatar_url, scopes) VALUES(?, ?, ?, ?, ?)`,
+			userID, provider, u.ID, u.AvatarURL, strings.Join(u.Scopes, " "))
+		if err != nil {
+			return u, false, fmt.Errorf("insert identity: %w", err)
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		created = true
+		userID, err = insertUser(tx, provider, u)
+		if err != nil {
+			return u, false, err
+		}
+		err = tx.QueryRow(`SELECT created_at FROM users WHERE id = ?`, userID).Scan(&u.CreatedAt)
+		if err != nil {
+			return u, false, fmt.Errorf("read user: %w", err)
+		}
+		err = tx.Exec(`INSERT INTO identities(user_id, provider, provider_uid, avatar_url, scopes) VALUES(?, ?, ?, ?, ?)`,
+			userID, provider, u.ID, u.AvatarURL, strings.Join(u.Scopes, " "))
+		if err != nil {
+			return u, false, fmt.Errorf("insert identity: %w", err)
+		}
+	default:
+		return u, false, fmt.Errorf("lookup identity: %w", err)
+	}
+
+	u.AccountID = userID
+	return u, created, tx.Commit()
+}
+
+// insertUser creates the account row. The login is used as username; when it
+// is already taken (same login on another provider) it is suffixed with the
+// provider and, if needed, the provider user ID.
+func insertUser(tx *db.Transaction, provider string, u User) (int64, error) {
+	for _, name := range []string{
+		u.Login,
+		u.Login + "-" + provider,
+		u.Login + "-" + provider + "-" + u.ID,
+	} {
+		var id int64
+		err := tx.QueryRow(`INSERT INTO users(username) VALUES(?)
+			ON CONFLICT(username) DO NOTHING RETURNING id`, name).Scan(&id)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("insert user: %w", err)
+		}
+	}
+	return 0, fmt.Errorf("insert user: username %q unavailable", u.Login)
+}
+
+// ErrIdentityLimit is returned by Upsert when linking an identity to an
+// account that already has config.Cfg.MaxIdentities identities.
+var ErrIdentityLimit = errors.New("identity limit reached for this account")
+
+// ErrProviderLinked is returned by Upsert when linking an identity of a
+// provider the account already has an identity from.
+var ErrProviderLinked = errors.New("provider already linked to this account")
+
+// ErrLastIdentity is returned by Unlink when removing the identity would leave
+// the account without any way to log in.
+var ErrLastIdentity = errors.New("cannot unlink the last identity")
+
+// Providers lists the providers linked to the account, sorted by name.
+func Providers(s *db.SQLite, accountID int64) ([]string, error) {
+	rows, err := s.Query(`SELECT provider FROM identities WHERE user_id = ? ORDER BY provider`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("list identities: %w", err)
+	}
+	defer utils.Closer(rows)
+	var out []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, fmt.Errorf("list identities: %w", err)
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// Unlink removes the account's identity for provider and returns the
+// remaining providers. It refuses with ErrLastIdentity when that identity is
+// the only one left (or all that are left are from provider), and returns
+// sql.ErrNoRows when it is not linked.
+func Unlink(s *db.SQLite, accountID int64, provider string) ([]string, error) {
+	tx, err := s.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var linked, total int
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(provider = ?), 0), COUNT(*)
+		FROM identities WHERE user_id = ?`,
+		provider, accountID).Scan(&linked, &total)
+	if err != nil {
+		return nil, fmt.Errorf("count identities: %w", err)
+	}
+	switch {
+	case linked == 0:
+		return nil, sql.ErrNoRows
+	case total-linked < 1:
+		return nil, ErrLastIdentity
+	}
+	err = tx.Exec(`DELETE FROM identities WHERE user_id = ? AND provider = ?`, accountID, provider)
+	if err != nil {
+		return nil, fmt.Errorf("delete identity: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return Providers(s, accountID)
+}
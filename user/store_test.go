@@ -0,0 +1,221 @@
+package user
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"edev/config"
+	"edev/db"
+	"edev/migration"
+	"edev/secret"
+)
+
+// helper: open an in-memory database with all migrations applied.
+func newTestDB(t *testing.T) *db.SQLite {
+	t.Helper()
+	s, err := db.NewWithPath(db.MemoryPath)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(s.Close)
+	if _, err := migration.Up(s); err != nil {
+		t.Fatalf("apply schema: %v", err)
+	}
+	return s
+}
+
+// TestUpsertKeepsCreatedAt verifies a second login does not change created_at.
+func TestUpsertKeepsCreatedAt(t *testing.T) {
+	s := newTestDB(t)
+	u := User{ID: "42", Login: "octo", AvatarURL: "https://example.test/a.png"}
+
+	first, _, err := Upsert(s, "github", u)
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if first.CreatedAt.IsZero() {
+		t.Fatalf("expected created_at on first login")
+	}
+
+	// Backdate the account so a rewrite would be visible.
+	if err := s.Exec(`UPDATE users SET created_at = '2020-01-02 03:04:05'`); err != nil {
+		t.Fatalf("backdate: %v", err)
+	}
+
+	u.AvatarURL = "https://example.test/b.png"
+	second, _, err := Upsert(s, "github", u)
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !second.CreatedAt.Equal(want) {
+		t.Fatalf("expected created_at %s, got %s", want, second.CreatedAt)
+	}
+
+	var n int
+	if err := s.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 user, got %d", n)
+	}
+}
+
+// TestUpsertCreated verifies only the login that creates the account reports
+// created.
+func TestUpsertCreated(t *testing.T) {
+	s := newTestDB(t)
+	u := User{ID: "42", Login: "octo"}
+
+	_, created, err := Upsert(s, "github", u)
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if !created {
+		t.Fatalf("expected first login to create the account")
+	}
+
+	_, created, err = Upsert(s, "github", u)
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if created {
+		t.Fatalf("expected returning login not to create an account")
+	}
+}
+
+// TestUnlink verifies an identity can be removed while another remains and
+// that the last one is kept.
+func TestUnlink(t *testing.T) {
+	s := newTestDB(t)
+	u, _, err := Upsert(s, "github", User{ID: "42", Login: "octo"})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	err = s.Exec(`INSERT INTO identities(user_id, provider, provider_uid) VALUES(?, 'x', '99')`, u.AccountID)
+	if err != nil {
+		t.Fatalf("link x: %v", err)
+	}
+
+	providers, err := Unlink(s, u.AccountID, "x")
+	if err != nil {
+		t.Fatalf("unlink x: %v", err)
+	}
+	if len(providers) != 1 || providers[0] != "github" {
+		t.Fatalf("expected [github], got %v", providers)
+	}
+
+	if _, err := Unlink(s, u.AccountID, "github"); !errors.Is(err, ErrLastIdentity) {
+		t.Fatalf("expected ErrLastIdentity, got %v", err)
+	}
+	providers, err = Providers(s, u.AccountID)
+	if err != nil {
+		t.Fatalf("providers: %v", err)
+	}
+	if len(providers) != 1 {
+		t.Fatalf("expected the last identity to remain, got %v", providers)
+	}
+}
+
+// TestUpsertLinkLimit verifies signed-in logins link new identities up to
+// MaxIdentities, store their scopes, and the next link is refused.
+func TestUpsertLinkLimit(t *testing.T) {
+	prev := config.Cfg.MaxIdentities
+	config.Cfg.MaxIdentities = 3
+	defer func() { config.Cfg.MaxIdentities = prev }()
+
+	s := newTestDB(t)
+	u, _, err := Upsert(s, "github", User{ID: "42", Login: "octo"})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	for _, p := range []string{"x", "fake"} {
+		linked, created, err := Upsert(s, p, User{ID: "1", Login: "other", AccountID: u.AccountID, Scopes: []string{"read"}})
+		if err != nil {
+			t.Fatalf("link %s: %v", p, err)
+		}
+		if created || linked.AccountID != u.AccountID {
+			t.Fatalf("link %s: expected account %d, got %d (created=%v)", p, u.AccountID, linked.AccountID, created)
+		}
+	}
+	var scopes string
+	if err := s.QueryRow(`SELECT scopes FROM identities WHERE provider = 'x'`).Scan(&scopes); err != nil {
+		t.Fatalf("read scopes: %v", err)
+	}
+	if scopes != "read" {
+		t.Fatalf("expected scopes %q, got %q", "read", scopes)
+	}
+	_, _, err = Upsert(s, "google", User{ID: "1", Login: "other", AccountID: u.AccountID})
+	if !errors.Is(err, ErrIdentityLimit) {
+		t.Fatalf("expected ErrIdentityLimit, got %v", err)
+	}
+	providers, err := Providers(s, u.AccountID)
+	if err != nil || len(providers) != 3 {
+		t.Fatalf("expected 3 providers, got %v (%v)", providers, err)
+	}
+}
+
+// TestUpsertLinkSameProvider verifies a second identity of a provider the
+// account already has is not linked, and that Unlink keeps an account whose
+// identities all come from one provider.
+func TestUpsertLinkSameProvider(t *testing.T) {
+	s := newTestDB(t)
+	u, _, err := Upsert(s, "github", User{ID: "42", Login: "octo"})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	_, _, err = Upsert(s, "github", User{ID: "43", Login: "octo2", AccountID: u.AccountID})
+	if !errors.Is(err, ErrProviderLinked) {
+		t.Fatalf("expected ErrProviderLinked, got %v", err)
+	}
+
+	// The schema alone does not prevent two identities of one provider.
+	err = s.Exec(`INSERT INTO identities(user_id, provider, provider_uid) VALUES(?, 'github', '43')`, u.AccountID)
+	if err != nil {
+		t.Fatalf("link second github: %v", err)
+	}
+	if _, err := Unlink(s, u.AccountID, "github"); !errors.Is(err, ErrLastIdentity) {
+		t.Fatalf("expected ErrLastIdentity, got %v", err)
+	}
+	providers, err := Providers(s, u.AccountID)
+	if err != nil || len(providers) != 2 {
+		t.Fatalf("expected both identities to remain, got %v (%v)", providers, err)
+	}
+}
+
+// TestTokensEncrypted verifies tokens round-trip through SaveTokens and
+// LoadTokens while the stored column holds ciphertext, not the token.
+func TestTokensEncrypted(t *testing.T) {
+	s := newTestDB(t)
+	kr, err := secret.ParseKeys([]string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, secret.KeySize))})
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	if _, _, err := Upsert(s, "github", User{ID: "42", Login: "octo"}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	want := Tokens{Access: "gho_secret", Refresh: "ghr_secret", Expiry: time.Unix(1700000000, 0)}
+	if err := SaveTokens(s, kr, "github", "42", want); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	var raw string
+	if err := s.QueryRow(`SELECT access_token FROM identities WHERE provider_uid = '42'`).Scan(&raw); err != nil {
+		t.Fatalf("read raw: %v", err)
+	}
+	if raw == "" || strings.Contains(raw, want.Access) {
+		t.Fatalf("expected ciphertext in the database, got %q", raw)
+	}
+
+	got, err := LoadTokens(s, kr, "github", "42")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"fmt"
+	"time"
+
+	"edev/db"
+	"edev/secret"
+)
+
+// Tokens are the provider credentials kept for an identity.
+type Tokens struct {
+	Access  string
+	Refresh string
+	Expiry  time.Time // zero when the provider gave none
+}
+
+// SaveTokens encrypts tok with kr and stores it on the identity. Plaintext
+// never reaches the database.
+func SaveTokens(s *db.SQLite, kr *secret.Keyring, provider, providerUID string, tok Tokens) error {
+	access, err := encryptOptional(kr, tok.Access)
+	if err != nil {
+		return fmt.Errorf("encrypt access token: %w", err)
+	}
+	refresh, err := encryptOptional(kr, tok.Refresh)
+	if err != nil {
+		return fmt.Errorf("encrypt refresh token: %w", err)
+	}
+	var expiry int64
+	if !tok.Expiry.IsZero() {
+		expiry = tok.Expiry.Unix()
+	}
+	err = s.Exec(`UPDATE identities SET access_token = ?, refresh_token = ?, token_expires_at = ?
+		WHERE provider = ? AND provider_uid = ?`,
+		access, refresh, expiry, provider, providerUID)
+	if err != nil {
+		return fmt.Errorf("save tokens: %w", err)
+	}
+	return nil
+}
+
+// LoadTokens reads and decrypts the tokens stored for the identity.
+func LoadTokens(s *db.SQLite, kr *secret.Keyring, provider, providerUID string) (Tokens, error) {
+	var (
+		access, refresh string
+		expiry          int64
+		tok             Tokens
+	)
+	err := s.QueryRow(`SELECT access_token, refresh_token, token_expires_at
+		FROM identities WHERE provider = ? AND provider_uid = ?`,
+		provider, providerUID).Scan(&access, &refresh, &expiry)
+	if err != nil {
+		return tok, fmt.Errorf("load tokens: %w", err)
+	}
+	if tok.Access, err = decryptOptional(kr, access); err != nil {
+		return tok, fmt.Errorf("decrypt access token: %w", err)
+	}
+	if tok.Refresh, err = decryptOptional(kr, refresh); err != nil {
+		return tok, fmt.Errorf("decrypt refresh token: %w", err)
+	}
+	if expiry > 0 {
+		tok.Expiry = time.Unix(expiry, 0)
+	}
+	return tok, nil
+}
+
+func encryptOptional(kr *secret.Keyring, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	return kr.Encrypt(s)
+}
+
+func decryptOptional(kr *secret.Keyring, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	return kr.Decrypt(s)
+}
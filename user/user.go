@@ -1,8 +1,14 @@
 package user
 
+import "time"
+
 type User struct {
-	ID        string `json:"id"`
-	Login     string `json:"login"`
-	Name      string `json:"name"`
-	AvatarURL string `json:"avatar_url"`
+	ID        string    `json:"id"`
+	AccountID int64     `json:"account_id,omitempty"`
+	Login     string    `json:"login"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email,omitempty"`
+	AvatarURL string    `json:"avatar_url"`
+	Scopes    []string  `json:"scopes,omitempty"` // granted by the provider
+	CreatedAt time.Time `json:"created_at,omitzero"`
 }
@@ -0,0 +1,50 @@
+package user
+
+import (
+	"strings"
+	"unicode"
+)
+
+// View is what templates get instead of a bare User: the fields stay
+// reachable through the embedding and the display rules live here rather
+// than in the markup.
+type View struct {
+	User
+	DisplayName string // Name, or Login when there is no name
+	Initials    string // up to two letters for an avatar fallback
+}
+
+// NewView builds the template view of u.
+func NewView(u User) View {
+	v := View{User: u, DisplayName: strings.TrimSpace(u.Name)}
+	if v.DisplayName == "" {
+		v.DisplayName = u.Login
+	}
+	v.Initials = initials(v.DisplayName)
+	return v
+}
+
+// initials returns the upper-cased first letter of the first and last words
+// of s, or of its only word. Words are split on spaces, '-', '_' and '.', and
+// leading punctuation ("@handle") is skipped.
+func initials(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == '_' || r == '.'
+	})
+	var out []string
+	for _, w := range words {
+		for _, r := range w {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				out = append(out, string(unicode.ToUpper(r)))
+				break
+			}
+		}
+	}
+	switch len(out) {
+	case 0:
+		return ""
+	case 1:
+		return out[0]
+	}
+	return out[0] + out[len(out)-1]
+}
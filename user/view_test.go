@@ -0,0 +1,27 @@
+package user
+
+import "testing"
+
+// TestNewView verifies the display name falls back to the login and the
+// initials come from the first and last words.
+func TestNewView(t *testing.T) {
+	cases := []struct {
+		u           User
+		name, inits string
+	}{
+		{User{Login: "octocat"}, "octocat", "O"},
+		{User{Login: "ada", Name: "Ada King Lovelace"}, "Ada King Lovelace", "AL"},
+		{User{Login: "jane_doe", Name: "  "}, "jane_doe", "JD"},
+		{User{Name: "élodie ñúñez"}, "élodie ñúñez", "ÉÑ"},
+		{User{Login: "@_@"}, "@_@", ""},
+	}
+	for _, c := range cases {
+		v := NewView(c.u)
+		if v.DisplayName != c.name || v.Initials != c.inits {
+			t.Fatalf("%+v: got name=%q initials=%q", c.u, v.DisplayName, v.Initials)
+		}
+		if v.Login != c.u.Login || v.Name != c.u.Name {
+			t.Fatalf("expected embedded fields to pass through, got %+v", v.User)
+		}
+	}
+}
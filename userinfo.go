@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"edev/config"
+	"edev/log"
+	"edev/metrics"
+	"edev/user"
+)
+
+// flightGroup collapses concurrent userinfo fetches sharing a key (provider +
+// access token) into a single upstream call, in the spirit of
+// golang.org/x/sync/singleflight without the extra dependency. It only dedupes
+// calls made with the same token: a double-clicked login runs two OAuth
+// exchanges, gets two tokens and still makes two calls.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{} // closed once u and err are set
+	u    user.User
+	err  error
+}
+
+var userinfoFlight flightGroup
+
+// Do runs fn once per key at a time; callers arriving while it is in flight
+// share its result. fn runs in its own goroutine with a context that keeps
+// the deadline of the caller that started it but not its cancellation, so
+// that caller going away does not fail the others; each caller still stops
+// waiting when its own ctx is done. A panic in fn reaches every caller as an
+// error.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (user.User, error)) (user.User, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	c, ok := g.m[key]
+	if !ok {
+		c = &flightCall{done: make(chan struct{})}
+		g.m[key] = c
+		go g.run(ctx, key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.u, c.err
+	case <-ctx.Done():
+		return user.User{}, ctx.Err()
+	}
+}
+
+// run calls fn for c and always releases key and the waiters, even when fn
+// panics.
+func (g *flightGroup) run(ctx context.Context, key string, c *flightCall, fn func(ctx context.Context) (user.User, error)) {
+	fctx := context.WithoutCancel(ctx)
+	if dl, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		fctx, cancel = context.WithDeadline(fctx, dl)
+		defer cancel()
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("userinfo fetch panic: %v\n%s", p, debug.Stack())
+			c.u, c.err = user.User{}, fmt.Errorf("userinfo fetch failed: %v", p)
+		}
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.u, c.err = fn(fctx)
+}
+
+// userinfoCache is a TTL-bounded LRU of userinfo results keyed like
+// userinfoFlight, by provider and access token. It only hits when a token is
+// presented again within the TTL; providers that issue a new token on every
+// login always miss, which the hit/miss counters make visible. It is capped at
+// max entries so a login storm evicts old entries instead of growing the map;
+// max <= 0 disables caching.
+type userinfoCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	ll      *list.List // front is most recently used
+	m       map[string]*list.Element
+	hits    *metrics.Counter
+	misses  *metrics.Counter
+	evicted *metrics.Counter
+}
+
+type userinfoEntry struct {
+	key     string
+	u       user.User
+	expires time.Time
+}
+
+func newUserinfoCache(max int, ttl time.Duration, hits, misses, evicted *metrics.Counter) *userinfoCache {
+	return &userinfoCache{
+		max:     max,
+		ttl:     ttl,
+		ll:      list.New(),
+		m:       make(map[string]*list.Element),
+		hits:    hits,
+		misses:  misses,
+		evicted: evicted,
+	}
+}
+
+var userinfoLRU = newUserinfoCache(
+	config.Cfg.UserinfoCacheSize,
+	config.Cfg.UserinfoCacheTTL,
+	metrics.NewCounter("edev_userinfo_cache_hits_total", "Userinfo lookups served from the cache."),
+	metrics.NewCounter("edev_userinfo_cache_misses_total", "Userinfo lookups that called the provider."),
+	metrics.NewCounter("edev_userinfo_cache_evictions_total", "Userinfo entries evicted to stay under the size limit."),
+)
+
+// Configure applies a new size limit and TTL, dropping cached entries.
+func (c *userinfoCache) Configure(max int, ttl time.Duration) {
+	c.mu.Lock()
+	c.max, c.ttl = max, ttl
+	c.ll.Init()
+	clear(c.m)
+	c.mu.Unlock()
+}
+
+// Get returns the cached user for key, counting a hit or a miss.
+func (c *userinfoCache) Get(key string) (user.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[key]; ok {
+		ent := e.Value.(*userinfoEntry)
+		if time.Now().Before(ent.expires) {
+			c.ll.MoveToFront(e)
+			c.hits.Inc()
+			return ent.u, true
+		}
+		c.ll.Remove(e)
+		delete(c.m, key)
+	}
+	c.misses.Inc()
+	return user.User{}, false
+}
+
+// Add stores u under key, evicting the least recently used entry when full.
+func (c *userinfoCache) Add(key string, u user.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max <= 0 || c.ttl <= 0 {
+		return
+	}
+	exp := time.Now().Add(c.ttl)
+	if e, ok := c.m[key]; ok {
+		e.Value = &userinfoEntry{key: key, u: u, expires: exp}
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.m[key] = c.ll.PushFront(&userinfoEntry{key: key, u: u, expires: exp})
+	for c.ll.Len() > c.max {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.m, old.Value.(*userinfoEntry).key)
+		c.evicted.Inc()
+	}
+}
+
+// Len reports the number of cached entries.
+func (c *userinfoCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// fetchUserinfo returns the cached user for key or runs fn through
+// userinfoFlight, caching a successful result. fn must use the ctx it is
+// given rather than the caller's.
+func fetchUserinfo(ctx context.Context, key string, fn func(ctx context.Context) (user.User, error)) (user.User, error) {
+	if u, ok := userinfoLRU.Get(key); ok {
+		return u, nil
+	}
+	u, err := userinfoFlight.Do(ctx, key, fn)
+	if err != nil {
+		return user.User{}, err
+	}
+	userinfoLRU.Add(key, u)
+	return u, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edev/metrics"
+	"edev/user"
+)
+
+// TestUserinfoFlightDedup verifies concurrent fetches for the same access
+// token share a single upstream /user call.
+func TestUserinfoFlightDedup(t *testing.T) {
+	var hits atomic.Int32
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		entered <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":42,"login":"octo","name":"Octo Cat"}`))
+	}))
+	defer srv.Close()
+
+	prev := githubAPIURL
+	githubAPIURL = srv.URL
+	defer func() { githubAPIURL = prev }()
+
+	fetch := func(ctx context.Context) (user.User, error) {
+		return gitHubProvider.fetchUser(ctx, srv.Client())
+	}
+
+	const callers = 8
+	results := make([]user.User, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	wg.Go(func() { results[0], errs[0] = userinfoFlight.Do(context.Background(), "github:tok", fetch) })
+	<-entered
+	for i := 1; i < callers; i++ {
+		wg.Go(func() { results[i], errs[i] = userinfoFlight.Do(context.Background(), "github:tok", fetch) })
+	}
+	time.Sleep(50 * time.Millisecond) // let the followers join the in-flight call
+	close(release)
+	wg.Wait()
+
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+	for i := range callers {
+		if errs[i] != nil {
+			t.Fatalf("caller %d: %v", i, errs[i])
+		}
+		if results[i].Login != "octo" {
+			t.Fatalf("caller %d: expected login octo, got %q", i, results[i].Login)
+		}
+	}
+}
+
+// TestUserinfoFlightPanic verifies a panic in the shared fetch reaches every
+// waiter as an error and frees the key for the next call.
+func TestUserinfoFlightPanic(t *testing.T) {
+	var g flightGroup
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	boom := func(context.Context) (user.User, error) {
+		close(entered)
+		<-release
+		panic("boom")
+	}
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Go(func() { _, errs[0] = g.Do(context.Background(), "k", boom) })
+	<-entered
+	wg.Go(func() { _, errs[1] = g.Do(context.Background(), "k", boom) })
+	time.Sleep(20 * time.Millisecond) // let the follower join
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == nil {
+			t.Fatalf("caller %d: expected an error from the panic", i)
+		}
+	}
+	u, err := g.Do(context.Background(), "k", func(context.Context) (user.User, error) {
+		return user.User{Login: "ok"}, nil
+	})
+	if err != nil || u.Login != "ok" {
+		t.Fatalf("expected a fresh call after the panic, got %+v %v", u, err)
+	}
+}
+
+// TestUserinfoFlightLeaderCancel verifies the caller that started a fetch
+// giving up does not cancel it for the callers waiting on it.
+func TestUserinfoFlightLeaderCancel(t *testing.T) {
+	var g flightGroup
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (user.User, error) {
+		close(entered)
+		select {
+		case <-release:
+			return user.User{Login: "octo"}, nil
+		case <-ctx.Done():
+			return user.User{}, ctx.Err()
+		}
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	var leaderErr, followerErr error
+	var follower user.User
+	var wg sync.WaitGroup
+	wg.Go(func() { _, leaderErr = g.Do(leaderCtx, "k", fetch) })
+	<-entered
+	wg.Go(func() { follower, followerErr = g.Do(context.Background(), "k", fetch) })
+	time.Sleep(20 * time.Millisecond) // let the follower join
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if !errors.Is(leaderErr, context.Canceled) {
+		t.Fatalf("expected the leader to see its cancellation, got %v", leaderErr)
+	}
+	if followerErr != nil || follower.Login != "octo" {
+		t.Fatalf("expected the follower to get the result, got %+v %v", follower, followerErr)
+	}
+}
+
+// TestUserinfoCacheLRU verifies that exceeding the size limit evicts the
+// least recently used entry and that hits and misses are counted.
+func TestUserinfoCacheLRU(t *testing.T) {
+	hits, misses, evicted := &metrics.Counter{}, &metrics.Counter{}, &metrics.Counter{}
+	c := newUserinfoCache(2, time.Minute, hits, misses, evicted)
+
+	c.Add("a", user.User{Login: "a"})
+	c.Add("b", user.User{Login: "b"})
+	if u, ok := c.Get("a"); !ok || u.Login != "a" {
+		t.Fatalf("expected a cached, got %+v ok=%v", u, ok)
+	}
+	c.Add("c", user.User{Login: "c"}) // b is now the least recently used
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("expected %s to remain", k)
+		}
+	}
+	if n := c.Len(); n != 2 {
+		t.Fatalf("expected 2 entries, got %d", n)
+	}
+	if hits.Value() != 3 || misses.Value() != 1 || evicted.Value() != 1 {
+		t.Fatalf("expected hits=3 misses=1 evicted=1, got %d %d %d",
+			hits.Value(), misses.Value(), evicted.Value())
+	}
+}
+
+// TestUserinfoCacheTTL verifies expired entries count as misses and are
+// dropped, and that a zero size disables caching.
+func TestUserinfoCacheTTL(t *testing.T) {
+	hits, misses := &metrics.Counter{}, &metrics.Counter{}
+	c := newUserinfoCache(4, time.Millisecond, hits, misses, &metrics.Counter{})
+	c.Add("a", user.User{Login: "a"})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("expected expired entry to miss")
+	}
+	if c.Len() != 0 || misses.Value() != 1 || hits.Value() != 0 {
+		t.Fatalf("expected expired entry dropped and one miss, len=%d misses=%d", c.Len(), misses.Value())
+	}
+
+	c.Configure(0, time.Minute)
+	c.Add("b", user.User{Login: "b"})
+	if c.Len() != 0 {
+		t.Fatalf("expected size 0 to disable caching")
+	}
+}
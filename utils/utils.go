@@ -1,11 +1,18 @@
 package utils
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"edev/log"
 )
@@ -46,3 +53,95 @@ func MakePKCE() (verifier, challenge string) {
 	challenge = b64urlNoPad(sum[:])
 	return
 }
+
+// SignedToken returns a self-contained token carrying payload and an expiry,
+// authenticated with HMAC-SHA256 under secret. No server-side storage needed.
+// Format: b64url(payload) "." unix-expiry "." b64url(mac).
+func SignedToken(payload string, ttl time.Duration, secret string) string {
+	body := b64urlNoPad([]byte(payload)) + "." +
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return body + "." + b64urlNoPad(tokenMAC(body, secret))
+}
+
+// VerifySignedToken checks the signature and expiry of a SignedToken and
+// returns its payload.
+func VerifySignedToken(tok, secret string) (payload string, ok bool) {
+	i := strings.LastIndexByte(tok, '.')
+	if i < 0 {
+		return "", false
+	}
+	body, sig := tok[:i], tok[i+1:]
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, tokenMAC(body, secret)) {
+		return "", false
+	}
+	p, exp, found := strings.Cut(body, ".")
+	if !found {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func tokenMAC(body, secret string) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	_, _ = m.Write([]byte(body))
+	return m.Sum(nil)
+}
+
+// NormalizeEmail trims and lowercases s and checks it is a bare address
+// (local@domain, no display name). ok is false for malformed values.
+func NormalizeEmail(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || len(s) > 254 {
+		return "", false
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "", false
+	}
+	local, domain, _ := strings.Cut(s, "@")
+	if local == "" || domain == "" || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", false
+	}
+	return s, true
+}
+
+// HasControl reports whether s contains control characters (including
+// newlines and tabs), which have no place in a display name.
+func HasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// SafeImageURL returns s when it is an absolute http(s) URL and "" otherwise,
+// so provider values cannot inject javascript: or data: URLs into src.
+func SafeImageURL(s string) string {
+	s = strings.TrimSpace(s)
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ""
+	}
+	return s
+}
+
+// RequestIsSecure reports whether r reached the server over HTTPS: directly
+// over TLS or, when trustProxy is set, as reported by the first
+// X-Forwarded-Proto entry of a TLS-terminating proxy. Without trustProxy the
+// header is ignored, since any client can send it.
+func RequestIsSecure(r *http.Request, trustProxy bool) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !trustProxy {
+		return false
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
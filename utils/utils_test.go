@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedToken(t *testing.T) {
+	const secret = "s3cret"
+
+	tok := SignedToken("confirm:alice@example.com", time.Minute, secret)
+	payload, ok := VerifySignedToken(tok, secret)
+	if !ok || payload != "confirm:alice@example.com" {
+		t.Fatalf("expected valid round-trip, got %q ok=%v", payload, ok)
+	}
+
+	if _, ok := VerifySignedToken(tok, "other"); ok {
+		t.Fatalf("expected wrong secret to fail")
+	}
+
+	expired := SignedToken("x", -time.Second, secret)
+	if _, ok := VerifySignedToken(expired, secret); ok {
+		t.Fatalf("expected expired token to fail")
+	}
+
+	parts := strings.Split(tok, ".")
+	parts[0] = b64urlNoPad([]byte("confirm:mallory@example.com"))
+	if _, ok := VerifySignedToken(strings.Join(parts, "."), secret); ok {
+		t.Fatalf("expected tampered token to fail")
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	got, ok := NormalizeEmail("  Alice.Smith@Example.COM ")
+	if !ok || got != "alice.smith@example.com" {
+		t.Fatalf("expected normalized email, got %q ok=%v", got, ok)
+	}
+
+	for _, bad := range []string{"", "alice", "alice@", "@example.com", "a b@example.com", "Alice <alice@example.com>", "alice@example."} {
+		if _, ok := NormalizeEmail(bad); ok {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestRequestIsSecure verifies direct TLS counts, X-Forwarded-Proto counts
+// only from a trusted proxy, and plain http does not.
+func TestRequestIsSecure(t *testing.T) {
+	direct := httptest.NewRequest(http.MethodGet, "https://example.test/", nil)
+	if !RequestIsSecure(direct, false) {
+		t.Fatalf("expected direct TLS to be secure")
+	}
+
+	proxied := httptest.NewRequest(http.MethodGet, "/", nil)
+	proxied.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	if !RequestIsSecure(proxied, true) {
+		t.Fatalf("expected trusted X-Forwarded-Proto=https to be secure")
+	}
+	if RequestIsSecure(proxied, false) {
+		t.Fatalf("expected X-Forwarded-Proto to be ignored when the proxy is not trusted")
+	}
+
+	proxied.Header.Set("X-Forwarded-Proto", "http")
+	if RequestIsSecure(proxied, true) {
+		t.Fatalf("expected forwarded http to be insecure")
+	}
+	if RequestIsSecure(httptest.NewRequest(http.MethodGet, "/", nil), true) {
+		t.Fatalf("expected plain http to be insecure")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ValidationError collects per-field input errors. It serializes as
+// {"errors":{"field":"message"}} for API consumers.
+type ValidationError struct {
+	Fields map[string]string `json:"errors"`
+}
+
+// Add records msg for field.
+func (e *ValidationError) Add(field, msg string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	e.Fields[field] = msg
+}
+
+// Empty reports whether no field error was recorded.
+func (e *ValidationError) Empty() bool { return len(e.Fields) == 0 }
+
+func (e *ValidationError) Error() string {
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+": "+e.Fields[k])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// wantsJSON reports whether the client asked for a JSON response.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeValidationError answers 422 with the field errors, as JSON when the
+// client accepts it and as plain text otherwise.
+func writeValidationError(w http.ResponseWriter, r *http.Request, verr *ValidationError) {
+	if !wantsJSON(r) {
+		http.Error(w, verr.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(verr)
+}